@@ -0,0 +1,229 @@
+package avrostry
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrProducerClosed publishing after Close
+var ErrProducerClosed = errors.New("producer closed")
+
+// DeliveryReport result of publishing an event asynchronously
+type DeliveryReport struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Event     DomainEvent
+	Headers   []MessageHeader
+	Err       error
+}
+
+// DeliveryCallback receives the report of a published message, it is called
+// from the producer goroutines and must not block
+type DeliveryCallback func(DeliveryReport)
+
+// pendingMessage travels as sarama message metadata until it is acknowledged
+type pendingMessage struct {
+	event    DomainEvent
+	headers  []MessageHeader
+	callback DeliveryCallback
+}
+
+// KafkaRegistryAsyncProducer publishes events without waiting for the broker.
+//
+// Messages with the same key go to the same partition and keep their order,
+// only one request per broker is in flight so retries can't reorder them.
+// Reports of messages without callback go to the configured DeliveryCallback
+// or, without it, to the Deliveries channel, which must be consumed.
+type KafkaRegistryAsyncProducer struct {
+	producer   sarama.AsyncProducer
+	encoder    *messageEncoder
+	callback   DeliveryCallback
+	deliveries chan DeliveryReport
+	inFlight   chan struct{}
+
+	sync.RWMutex
+	closed bool
+	sends  sync.WaitGroup // to Input, finished before closing it
+	wg     sync.WaitGroup
+}
+
+// NewKafkaRegistryAsyncProducer Constructor for KafkaRegistryAsyncProducer
+func NewKafkaRegistryAsyncProducer(cfg ProducerConfig) (*KafkaRegistryAsyncProducer, error) {
+	if cfg.TransactionalID != "" {
+		return nil, errors.New("transactional producing needs KafkaRegistryProducer")
+	}
+	if len(cfg.Middlewares) > 0 {
+		return nil, errors.New("producer middlewares need KafkaRegistryProducer")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := newSaramaProducerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Net.MaxOpenRequests = 1
+
+	producer, err := sarama.NewAsyncProducer(cfg.Addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	return newKafkaRegistryAsyncProducer(producer, cfg), nil
+}
+
+func newKafkaRegistryAsyncProducer(producer sarama.AsyncProducer, cfg ProducerConfig) *KafkaRegistryAsyncProducer {
+	p := &KafkaRegistryAsyncProducer{
+		producer:   producer,
+		encoder:    newMessageEncoder(cfg),
+		callback:   cfg.DeliveryCallback,
+		deliveries: make(chan DeliveryReport, cfg.MaxInFlight),
+	}
+	if cfg.MaxInFlight > 0 {
+		p.inFlight = make(chan struct{}, cfg.MaxInFlight)
+	}
+
+	p.wg.Add(2)
+	go p.dispatchSuccesses()
+	go p.dispatchErrors()
+	return p
+}
+
+// PublishEvent send a DomainEvent to the topic chosen by the TopicRouter,
+// without waiting for the broker
+func (p *KafkaRegistryAsyncProducer) PublishEvent(event DomainEvent) error {
+	topic, err := routeTopic(p.encoder.router, event)
+	if err != nil {
+		return err
+	}
+	return p.PublishWithCallback(topic, event, nil, nil)
+}
+
+// Publish encode and send a DomainEvent to Kafka, without waiting for the broker
+func (p *KafkaRegistryAsyncProducer) Publish(topic string, event DomainEvent) error {
+	return p.PublishWithCallback(topic, event, nil, nil)
+}
+
+// PublishWithHeaders encode and send a DomainEvent to Kafka, without waiting for the broker
+func (p *KafkaRegistryAsyncProducer) PublishWithHeaders(topic string, event DomainEvent, headers []MessageHeader) error {
+	return p.PublishWithCallback(topic, event, headers, nil)
+}
+
+// PublishWithCallback encode and send a DomainEvent to Kafka, callback receives
+// its delivery report. Encoding errors are returned, the message is not sent.
+// It blocks while MaxInFlight messages are waiting for acknowledgement.
+func (p *KafkaRegistryAsyncProducer) PublishWithCallback(topic string, event DomainEvent, headers []MessageHeader, callback DeliveryCallback) error {
+	return p.PublishWithContext(context.Background(), topic, event, headers, callback)
+}
+
+// PublishWithContext like PublishWithCallback, the envelope of the event
+// continues the one of ctx. Waiting for a MaxInFlight slot stops when ctx is done.
+func (p *KafkaRegistryAsyncProducer) PublishWithContext(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader, callback DeliveryCallback) error {
+	msg, err := p.encoder.encode(ctx, topic, event, headers)
+	if err != nil {
+		return err
+	}
+	msg.Metadata = &pendingMessage{event: event, headers: headers, callback: callback}
+
+	if p.inFlight != nil {
+		select {
+		case p.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	p.RLock()
+	if p.closed {
+		p.RUnlock()
+		if p.inFlight != nil {
+			<-p.inFlight
+		}
+		return ErrProducerClosed
+	}
+	p.sends.Add(1)
+	p.RUnlock()
+
+	defer p.sends.Done()
+	p.producer.Input() <- msg
+	return nil
+}
+
+// Deliveries reports of the messages published without callback,
+// when the producer has no DeliveryCallback
+func (p *KafkaRegistryAsyncProducer) Deliveries() <-chan DeliveryReport {
+	return p.deliveries
+}
+
+// Validate checks the event, and its key for a KeyedEvent, against their schemas
+func (p *KafkaRegistryAsyncProducer) Validate(event DomainEvent) error {
+	return p.encoder.validateEvent(event)
+}
+
+// Close waits until every published message is acknowledged, or fails,
+// and its report delivered. Deliveries is closed afterwards.
+func (p *KafkaRegistryAsyncProducer) Close() error {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return ErrProducerClosed
+	}
+	p.closed = true
+	p.Unlock()
+
+	p.sends.Wait()
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	close(p.deliveries)
+	return nil
+}
+
+func (p *KafkaRegistryAsyncProducer) dispatchSuccesses() {
+	defer p.wg.Done()
+	for msg := range p.producer.Successes() {
+		p.report(msg, nil)
+	}
+}
+
+func (p *KafkaRegistryAsyncProducer) dispatchErrors() {
+	defer p.wg.Done()
+	for err := range p.producer.Errors() {
+		p.report(err.Msg, err.Err)
+	}
+}
+
+func (p *KafkaRegistryAsyncProducer) report(msg *sarama.ProducerMessage, err error) {
+	if p.inFlight != nil {
+		<-p.inFlight
+	}
+
+	report := DeliveryReport{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Err:       err,
+	}
+	pending, _ := msg.Metadata.(*pendingMessage)
+	if pending == nil {
+		pending = &pendingMessage{}
+	}
+	report.Event = pending.event
+	report.Headers = pending.headers
+	if err != nil {
+		report.Partition, report.Offset = -1, -1
+	}
+
+	switch {
+	case pending.callback != nil:
+		pending.callback(report)
+	case p.callback != nil:
+		p.callback(report)
+	default:
+		p.deliveries <- report
+	}
+}
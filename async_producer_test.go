@@ -0,0 +1,109 @@
+package avrostry
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProducerConfig(t *testing.T, broker *sarama.MockBroker) (ProducerConfig, func()) {
+	_, server := newFakeSchemaRegistry()
+	cfg := DefaultProducerConfig()
+	cfg.Addrs = []string{broker.Addr()}
+	cfg.ClientID = "avrostry-test"
+	cfg.Compression = sarama.CompressionNone
+	cfg.SchemaRegistryClient = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	return cfg, server.Close
+}
+
+func newMockProducerBroker(t *testing.T, topic string, produce *sarama.MockProduceResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": produce.SetVersion(3), // Kafka 0.11
+	})
+	return broker
+}
+
+func TestAsyncProducerDeliveries(t *testing.T) {
+	broker := newMockProducerBroker(t, "words", sarama.NewMockProduceResponse(t))
+	defer broker.Close()
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+	cfg.MaxInFlight = 2
+
+	producer, err := NewKafkaRegistryAsyncProducer(cfg)
+	require.Nil(t, err)
+
+	callbacks := make(chan DeliveryReport, 1)
+	require.Nil(t, producer.Publish("words", Word{Word: "uno"}))
+	require.Nil(t, producer.PublishWithCallback("words", Word{Word: "dos"}, nil, func(report DeliveryReport) {
+		callbacks <- report
+	}))
+
+	report := <-producer.Deliveries()
+	require.Nil(t, report.Err)
+	require.Equal(t, "words", report.Topic)
+	require.Equal(t, Word{Word: "uno"}, report.Event)
+
+	report = <-callbacks
+	require.Nil(t, report.Err)
+	require.Equal(t, Word{Word: "dos"}, report.Event)
+
+	require.Nil(t, producer.Close())
+	_, open := <-producer.Deliveries()
+	require.False(t, open)
+	require.Equal(t, ErrProducerClosed, producer.Publish("words", Word{Word: "tres"}))
+}
+
+func TestAsyncProducerReportsErrors(t *testing.T) {
+	broker := newMockProducerBroker(t, "words", sarama.NewMockProduceResponse(t).SetError("words", 0, sarama.ErrMessageSizeTooLarge))
+	defer broker.Close()
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+
+	reports := make(chan DeliveryReport, 1)
+	cfg.DeliveryCallback = func(report DeliveryReport) {
+		reports <- report
+	}
+	producer, err := NewKafkaRegistryAsyncProducer(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, producer.Publish("words", Word{Word: "uno"}))
+	report := <-reports
+	require.Equal(t, sarama.ErrMessageSizeTooLarge, report.Err)
+	require.Equal(t, int64(-1), report.Offset)
+	require.Nil(t, producer.Close())
+}
+
+func TestAsyncProducerStopsWaitingForInFlightSlotOnContextDone(t *testing.T) {
+	broker := newMockProducerBroker(t, "words", sarama.NewMockProduceResponse(t))
+	defer broker.Close()
+	broker.SetLatency(200 * time.Millisecond)
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+	cfg.MaxInFlight = 1
+
+	producer, err := NewKafkaRegistryAsyncProducer(cfg)
+	require.Nil(t, err)
+	require.Nil(t, producer.Publish("words", Word{Word: "uno"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = producer.PublishWithContext(ctx, "words", Word{Word: "dos"}, nil, nil)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	closed := make(chan error)
+	go func() {
+		closed <- producer.Close()
+	}()
+	report := <-producer.Deliveries()
+	require.Equal(t, Word{Word: "uno"}, report.Event)
+	require.Nil(t, <-closed)
+}
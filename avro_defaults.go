@@ -0,0 +1,112 @@
+package avrostry
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/linkedin/goavro"
+)
+
+// MissingFieldsError fields without default value missing in the
+// native event, each one named by its full path, like /phone/number
+type MissingFieldsError struct {
+	Paths []string
+}
+
+func (e *MissingFieldsError) Error() string {
+	return "missing required fields without default value: " + strings.Join(e.Paths, ", ")
+}
+
+// FillDefaults returns a copy of native, as returned by ToStringMap, with the
+// default value declared in the Avro schema of every missing field, nested
+// records included.
+func FillDefaults(schema string, native interface{}) (interface{}, error) {
+	t, err := parseAvroSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return t.fillDefaults(native)
+}
+
+func (t *avroType) fillDefaults(native interface{}) (interface{}, error) {
+	var missing []string
+	filled := t.fill(native, "", &missing)
+	if len(missing) > 0 {
+		return nil, &MissingFieldsError{missing}
+	}
+	return filled, nil
+}
+
+// fill never modifies native, maps and slices with filled values are copied
+func (t *avroType) fill(native interface{}, path string, missing *[]string) interface{} {
+	switch t.kind {
+	case "record":
+		values, ok := native.(map[string]interface{})
+		if !ok {
+			return native
+		}
+		filled := make(map[string]interface{}, len(t.fields))
+		for k, v := range values {
+			filled[k] = v
+		}
+		for _, field := range t.fields {
+			fieldPath := path + "/" + field.name
+			value, found := values[field.name]
+			switch {
+			case found:
+				filled[field.name] = field.t.fill(value, fieldPath, missing)
+			case field.hasDefault:
+				filled[field.name] = field.t.nativeDefault(field.def)
+			default:
+				*missing = append(*missing, fieldPath)
+			}
+		}
+		return filled
+
+	case "union":
+		// Only values wrapped with goavro.Union tell the branch to fill
+		wrapped, ok := native.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return native
+		}
+		for name, value := range wrapped {
+			branch, found := t.branch(name)
+			if !found {
+				return native
+			}
+			return goavro.Union(name, branch.fill(value, path, missing))
+		}
+
+	case "array":
+		var items []interface{}
+		switch values := native.(type) {
+		case []interface{}:
+			items = values
+		case []map[string]interface{}:
+			items = make([]interface{}, len(values))
+			for i, value := range values {
+				items[i] = value
+			}
+		default:
+			return native
+		}
+		filled := make([]interface{}, len(items))
+		for i, item := range items {
+			filled[i] = t.items.fill(item, path+"/"+strconv.Itoa(i), missing)
+		}
+		return filled
+
+	case "map":
+		values, ok := native.(map[string]interface{})
+		if !ok {
+			return native
+		}
+		filled := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			filled[k] = t.values.fill(v, path+"/"+escapePointer(k), missing)
+		}
+		return filled
+	}
+
+	return native
+}
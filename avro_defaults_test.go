@@ -0,0 +1,77 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/require"
+)
+
+const employeeSchema = `{
+	"namespace": "josgilmo.avrostry",
+	"type": "record",
+	"name": "create_employee",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "firstName", "type": "string"},
+		{"name": "age", "type": "int", "default": 18},
+		{"name": "emails", "default": [], "type": {"type": "array", "items": "string"}},
+		{"name": "nickname", "type": ["string", "null"], "default": "none"},
+		{"name": "phone", "type": ["null", {
+			"type": "record",
+			"name": "phone",
+			"fields": [
+				{"name": "countryCode", "type": "string", "default": "34"},
+				{"name": "number", "type": "string"}
+			]
+		}], "default": null},
+		{"name": "address", "default": {"city": "Madrid"}, "type": {
+			"type": "record",
+			"name": "address",
+			"fields": [
+				{"name": "city", "type": "string"},
+				{"name": "zip", "type": "string", "default": "28001"}
+			]
+		}},
+		{"name": "status", "default": "SALARY", "type": {"type": "enum", "name": "Status", "symbols": ["RETIRED", "SALARY"]}}
+	]
+}`
+
+func TestAvroFormatFillsDefaults(t *testing.T) {
+	format := NewAvroFormat(NewCacheCodec())
+
+	payload, err := format.Encode(employeeSchema, map[string]interface{}{
+		"id":        "1",
+		"firstName": "John",
+		"phone":     goavro.Union("josgilmo.avrostry.phone", map[string]interface{}{"number": "2070685000"}),
+	})
+	require.Nil(t, err)
+
+	native, err := format.Decode(employeeSchema, payload)
+	require.Nil(t, err)
+	employee := native.(map[string]interface{})
+	require.Equal(t, int32(18), employee["age"])
+	require.Equal(t, []interface{}{}, employee["emails"])
+	require.Equal(t, map[string]interface{}{"string": "none"}, employee["nickname"])
+	require.Equal(t, map[string]interface{}{"city": "Madrid", "zip": "28001"}, employee["address"])
+	require.Equal(t, "SALARY", employee["status"])
+
+	phone := employee["phone"].(map[string]interface{})["josgilmo.avrostry.phone"]
+	require.Equal(t, map[string]interface{}{"countryCode": "34", "number": "2070685000"}, phone)
+}
+
+func TestFillDefaultsReportsMissingFieldPaths(t *testing.T) {
+	native := map[string]interface{}{
+		"phone":   goavro.Union("josgilmo.avrostry.phone", map[string]interface{}{}),
+		"address": map[string]interface{}{},
+	}
+	_, err := FillDefaults(employeeSchema, native)
+	require.NotNil(t, err)
+
+	missingErr, ok := err.(*MissingFieldsError)
+	require.True(t, ok)
+	require.Equal(t, []string{"/id", "/firstName", "/phone/number", "/address/city"}, missingErr.Paths)
+
+	// The native event is never modified
+	require.Len(t, native, 2)
+}
@@ -0,0 +1,226 @@
+package avrostry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/linkedin/goavro"
+)
+
+// avroType parsed Avro schema, named types are shared so
+// recursive schemas are represented by cycles
+type avroType struct {
+	kind     string // primitive name, record, enum, fixed, array, map or union
+	name     string // full name of named types
+	fields   []*avroField
+	items    *avroType // array
+	values   *avroType // map
+	branches []*avroType
+	symbols  []string // enum
+	size     int      // fixed
+}
+
+type avroField struct {
+	name       string
+	t          *avroType
+	def        interface{}
+	hasDefault bool
+}
+
+func parseAvroSchema(schema string) (*avroType, error) {
+	node, err := parseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	p := &avroParser{named: map[string]*avroType{}}
+	return p.parse(node, "")
+}
+
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func (p *avroParser) parse(node interface{}, namespace string) (*avroType, error) {
+	switch n := node.(type) {
+	case string:
+		if avroPrimitives[n] {
+			return &avroType{kind: n}, nil
+		}
+		t, found := p.named[qualifyName(n, namespace)]
+		if !found {
+			return nil, fmt.Errorf("unknown type: %s", n)
+		}
+		return t, nil
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, branch := range n {
+			t, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		typeName, isString := n["type"].(string)
+		if !isString {
+			return p.parse(n["type"], namespace)
+		}
+		switch typeName {
+		case "record", "error", "enum", "fixed":
+			return p.parseNamed(n, typeName, namespace)
+		case "array":
+			items, err := p.parse(n["items"], namespace)
+			return &avroType{kind: "array", items: items}, err
+		case "map":
+			values, err := p.parse(n["values"], namespace)
+			return &avroType{kind: "map", values: values}, err
+		}
+		return p.parse(typeName, namespace)
+	}
+
+	return nil, fmt.Errorf("invalid schema: %v", node)
+}
+
+func (p *avroParser) parseNamed(n map[string]interface{}, typeName string, namespace string) (*avroType, error) {
+	name, _ := n["name"].(string)
+	if ns, ok := n["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	t := &avroType{kind: typeName, name: qualifyName(name, namespace)}
+	if typeName == "error" {
+		t.kind = "record"
+	}
+	p.named[t.name] = t
+
+	switch t.kind {
+	case "enum":
+		symbols, _ := n["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			t.symbols = append(t.symbols, fmt.Sprint(symbol))
+		}
+	case "fixed":
+		size, _ := n["size"].(json.Number)
+		s, err := size.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("fixed %s without valid size", t.name)
+		}
+		t.size = int(s)
+	case "record":
+		fields, _ := n["fields"].([]interface{})
+		for _, f := range fields {
+			field, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("record %s with invalid field: %v", t.name, f)
+			}
+			fieldType, err := p.parse(field["type"], namespaceOf(t.name))
+			if err != nil {
+				return nil, err
+			}
+			def, hasDefault := field["default"]
+			fieldName, _ := field["name"].(string)
+			t.fields = append(t.fields, &avroField{name: fieldName, t: fieldType, def: def, hasDefault: hasDefault})
+		}
+	}
+	return t, nil
+}
+
+// branchName name used by goavro for the union branch of this type
+func (t *avroType) branchName() string {
+	if t.name != "" {
+		return t.name
+	}
+	return t.kind
+}
+
+func (t *avroType) branch(name string) (*avroType, bool) {
+	for _, branch := range t.branches {
+		if branch.branchName() == name {
+			return branch, true
+		}
+	}
+	return nil, false
+}
+
+// nativeDefault converts a default value, as written in the schema JSON,
+// to the native value goavro expects for this type.
+func (t *avroType) nativeDefault(def interface{}) interface{} {
+	switch t.kind {
+	case "null":
+		return nil
+	case "int", "long", "float", "double":
+		number, ok := def.(json.Number)
+		if !ok {
+			return def
+		}
+		switch t.kind {
+		case "int":
+			i, _ := number.Int64()
+			return int32(i)
+		case "long":
+			i, _ := number.Int64()
+			return i
+		case "float":
+			f, _ := number.Float64()
+			return float32(f)
+		}
+		f, _ := number.Float64()
+		return f
+	case "bytes", "fixed":
+		// Avro writes bytes defaults as strings with code points from 0 to 255
+		s, ok := def.(string)
+		if !ok {
+			return def
+		}
+		buf := make([]byte, 0, len(s))
+		for _, r := range s {
+			buf = append(buf, byte(r))
+		}
+		return buf
+	case "array":
+		values, ok := def.([]interface{})
+		if !ok {
+			return def
+		}
+		native := make([]interface{}, len(values))
+		for i, value := range values {
+			native[i] = t.items.nativeDefault(value)
+		}
+		return native
+	case "map":
+		values, ok := def.(map[string]interface{})
+		if !ok {
+			return def
+		}
+		native := make(map[string]interface{}, len(values))
+		for k, value := range values {
+			native[k] = t.values.nativeDefault(value)
+		}
+		return native
+	case "record":
+		values, ok := def.(map[string]interface{})
+		if !ok {
+			return def
+		}
+		native := make(map[string]interface{}, len(t.fields))
+		for _, field := range t.fields {
+			if value, found := values[field.name]; found {
+				native[field.name] = field.t.nativeDefault(value)
+			} else if field.hasDefault {
+				native[field.name] = field.t.nativeDefault(field.def)
+			}
+		}
+		return native
+	case "union":
+		// Defaults of unions always belong to the first branch
+		if len(t.branches) == 0 || t.branches[0].kind == "null" {
+			return nil
+		}
+		first := t.branches[0]
+		return goavro.Union(first.branchName(), first.nativeDefault(def))
+	}
+	return def
+}
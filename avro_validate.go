@@ -0,0 +1,339 @@
+package avrostry
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchemaViolation a value of the native event not matching its Avro schema
+type SchemaViolation struct {
+	// JSON pointer to the value, like /phone/number, empty for the whole event
+	Path     string
+	Expected string
+	Actual   string
+	Message  string
+	// Union branches able to hold the value, to use with goavro.Union
+	Branches []string
+}
+
+func (v SchemaViolation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "/"
+	}
+	s := fmt.Sprintf("%s: %s, expected %s, got %s", path, v.Message, v.Expected, v.Actual)
+	if len(v.Branches) > 0 {
+		s += fmt.Sprintf(" (use goavro.Union with one of: %s)", strings.Join(v.Branches, ", "))
+	}
+	return s
+}
+
+// ValidationError every violation found validating an event against its schema
+type ValidationError struct {
+	Subject    string
+	Violations []SchemaViolation
+}
+
+func (e *ValidationError) Error() string {
+	violations := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		violations[i] = v.String()
+	}
+	return fmt.Sprintf("event %s does not match its schema: %s", e.Subject, strings.Join(violations, "; "))
+}
+
+// SchemaValidator is implemented by the formats able to check a native
+// event against its schema before encoding it
+type SchemaValidator interface {
+	Validate(schema string, native interface{}) error
+}
+
+var (
+	defaultAvroFormat       = NewAvroFormat(NewCacheCodec())
+	strictAvroFormat        = NewStrictAvroFormat(NewCacheCodec())
+	defaultJSONSchemaFormat = NewJSONSchemaFormat()
+)
+
+// Validate checks the native event returned by ToStringMap against the event
+// schema, which must not use references. It returns a *ValidationError with
+// every violation found, or a *JSONSchemaValidationError for JSON Schema events.
+// Fields not defined in the schema are ignored, like goavro does.
+func Validate(event DomainEvent) error {
+	return validate(event, defaultAvroFormat)
+}
+
+// ValidateStrict Validate reporting the fields not defined in the schema too
+func ValidateStrict(event DomainEvent) error {
+	return validate(event, strictAvroFormat)
+}
+
+func validate(event DomainEvent, avroFormat *AvroFormat) error {
+	schemaType, schema := eventSchema(event)
+	var validator SchemaValidator
+	switch schemaType {
+	case AvroSchemaType:
+		validator = avroFormat
+	case JSONSchemaType:
+		validator = defaultJSONSchemaFormat
+	default:
+		return fmt.Errorf("unsupported schema type: %s", schemaType)
+	}
+	return withSubject(validator.Validate(schema, event.ToStringMap()), event.Subject())
+}
+
+func withSubject(err error, subject string) error {
+	if validationErr, ok := err.(*ValidationError); ok {
+		validationErr.Subject = subject
+	}
+	return err
+}
+
+// Validate checks the native event against the schema, fields with default
+// values may be missing. Fields not defined in the schema are violations only
+// for strict formats.
+func (f *AvroFormat) Validate(schema string, native interface{}) error {
+	if _, err := f.cacheCodec.Get(schema); err != nil {
+		return err
+	}
+	t := f.parse(schema)
+	if t == nil {
+		_, err := parseAvroSchema(schema)
+		return fmt.Errorf("cannot validate schema: %s", err)
+	}
+
+	var violations []SchemaViolation
+	t.validate(native, "", f.strict, &violations)
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func (t *avroType) validate(native interface{}, path string, strict bool, violations *[]SchemaViolation) {
+	violate := func(message string) {
+		*violations = append(*violations, SchemaViolation{
+			Path:     path,
+			Expected: t.String(),
+			Actual:   fmt.Sprintf("%T", native),
+			Message:  message,
+		})
+	}
+
+	switch t.kind {
+	case "null":
+		if native != nil {
+			violate("wrong type")
+		}
+	case "boolean":
+		if _, ok := native.(bool); !ok {
+			violate("wrong type")
+		}
+	case "int", "long", "float", "double":
+		if message := checkAvroNumber(t.kind, native); message != "" {
+			violate(message)
+		}
+	case "string":
+		if _, ok := native.(string); !ok {
+			violate("wrong type")
+		}
+	case "bytes":
+		switch native.(type) {
+		case []byte, string:
+		default:
+			violate("wrong type")
+		}
+	case "fixed":
+		var size int
+		switch v := native.(type) {
+		case []byte:
+			size = len(v)
+		case string:
+			size = len(v)
+		default:
+			violate("wrong type")
+			return
+		}
+		if size != t.size {
+			violate(fmt.Sprintf("size %d, must be %d", size, t.size))
+		}
+	case "enum":
+		symbol, ok := native.(string)
+		if !ok {
+			violate("wrong type")
+			return
+		}
+		for _, s := range t.symbols {
+			if s == symbol {
+				return
+			}
+		}
+		violate(fmt.Sprintf("unknown symbol %q", symbol))
+	case "array":
+		v := reflect.ValueOf(native)
+		if native == nil || v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			violate("wrong type")
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			t.items.validate(v.Index(i).Interface(), path+"/"+strconv.Itoa(i), strict, violations)
+		}
+	case "map":
+		v := reflect.ValueOf(native)
+		if native == nil || v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			violate("wrong type")
+			return
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			t.values.validate(v.MapIndex(key).Interface(), path+"/"+escapePointer(key.String()), strict, violations)
+		}
+	case "record":
+		t.validateRecord(native, path, strict, violations)
+	case "union":
+		t.validateUnion(native, path, strict, violations)
+	}
+}
+
+func (t *avroType) validateRecord(native interface{}, path string, strict bool, violations *[]SchemaViolation) {
+	values, ok := native.(map[string]interface{})
+	if !ok {
+		*violations = append(*violations, SchemaViolation{
+			Path: path, Expected: t.String(), Actual: fmt.Sprintf("%T", native), Message: "wrong type",
+		})
+		return
+	}
+
+	defined := make(map[string]bool, len(t.fields))
+	for _, field := range t.fields {
+		defined[field.name] = true
+		fieldPath := path + "/" + escapePointer(field.name)
+		value, found := values[field.name]
+		if !found {
+			if !field.hasDefault {
+				*violations = append(*violations, SchemaViolation{
+					Path: fieldPath, Expected: field.t.String(), Actual: "nothing", Message: "missing field without default value",
+				})
+			}
+			continue
+		}
+		field.t.validate(value, fieldPath, strict, violations)
+	}
+	if !strict {
+		return
+	}
+
+	var unknown []string
+	for name := range values {
+		if !defined[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		*violations = append(*violations, SchemaViolation{
+			Path: path + "/" + escapePointer(name), Expected: "no field", Actual: fmt.Sprintf("%T", values[name]),
+			Message: fmt.Sprintf("field not defined in record %s", t.name),
+		})
+	}
+}
+
+func (t *avroType) validateUnion(native interface{}, path string, strict bool, violations *[]SchemaViolation) {
+	if native == nil {
+		if _, found := t.branch("null"); found {
+			return
+		}
+		*violations = append(*violations, SchemaViolation{
+			Path: path, Expected: t.String(), Actual: "nil", Message: "null not allowed",
+		})
+		return
+	}
+
+	if wrapped, ok := native.(map[string]interface{}); ok && len(wrapped) == 1 {
+		for name, value := range wrapped {
+			if branch, found := t.branch(name); found {
+				branch.validate(value, path, strict, violations)
+				return
+			}
+		}
+	}
+
+	// Not wrapped, or wrapped with an unknown name, suggest the branches that fit
+	var branches []string
+	for _, branch := range t.branches {
+		var branchViolations []SchemaViolation
+		branch.validate(native, path, strict, &branchViolations)
+		if len(branchViolations) == 0 && branch.kind != "null" {
+			branches = append(branches, branch.branchName())
+		}
+	}
+	message := "union value must be wrapped with goavro.Union"
+	if wrapped, ok := native.(map[string]interface{}); ok && len(wrapped) == 1 {
+		for name := range wrapped {
+			message = fmt.Sprintf("unknown union branch %q", name)
+		}
+	}
+	*violations = append(*violations, SchemaViolation{
+		Path: path, Expected: t.String(), Actual: fmt.Sprintf("%T", native), Message: message, Branches: branches,
+	})
+}
+
+// checkAvroNumber accepts the same Go types than goavro, as long as
+// they can be converted without losing precision
+func checkAvroNumber(kind string, native interface{}) string {
+	var f float64
+	switch v := native.(type) {
+	case int:
+		f = float64(v)
+		if kind == "int" && (v > math.MaxInt32 || v < math.MinInt32) {
+			return "overflows int"
+		}
+	case int32:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+		if kind == "int" && (v > math.MaxInt32 || v < math.MinInt32) {
+			return "overflows int"
+		}
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return "wrong type"
+	}
+
+	switch native.(type) {
+	case float32, float64:
+		if (kind == "int" || kind == "long") && f != math.Trunc(f) {
+			return "would lose precision"
+		}
+		if kind == "int" && (f > math.MaxInt32 || f < math.MinInt32) {
+			return "overflows int"
+		}
+	}
+	return ""
+}
+
+// String describes the type for humans
+func (t *avroType) String() string {
+	switch t.kind {
+	case "record", "enum", "fixed":
+		return t.kind + " " + t.name
+	case "array":
+		return "array of " + t.items.String()
+	case "map":
+		return "map of " + t.values.String()
+	case "union":
+		names := make([]string, len(t.branches))
+		for i, branch := range t.branches {
+			names[i] = branch.branchName()
+		}
+		return "union [" + strings.Join(names, ", ") + "]"
+	}
+	return t.kind
+}
@@ -0,0 +1,73 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type invalidEmployee struct {
+	native map[string]interface{}
+}
+
+func (invalidEmployee) AvroSchema() string {
+	return employeeSchema
+}
+
+func (invalidEmployee) Subject() string {
+	return "josgilmo.avrostry.create_employee"
+}
+
+func (e invalidEmployee) ToStringMap() map[string]interface{} {
+	return e.native
+}
+
+func (invalidEmployee) ID() string {
+	return "1"
+}
+
+func TestValidateReportsEveryViolation(t *testing.T) {
+	err := ValidateStrict(invalidEmployee{map[string]interface{}{
+		"firstName": 42,
+		"age":       int64(1) << 40,
+		"emails":    []interface{}{"john.doe@example.org", 3},
+		"phone":     map[string]interface{}{"number": "2070685000"},
+		"nickname":  "johnny",
+		"status":    "HOURLY",
+		"salary":    1000,
+	}})
+	require.NotNil(t, err)
+
+	validationErr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	require.Equal(t, "josgilmo.avrostry.create_employee", validationErr.Subject)
+
+	byPath := map[string]SchemaViolation{}
+	for _, violation := range validationErr.Violations {
+		byPath[violation.Path] = violation
+	}
+	require.Len(t, byPath, 8)
+
+	require.Equal(t, "missing field without default value", byPath["/id"].Message)
+	require.Equal(t, "string", byPath["/firstName"].Expected)
+	require.Equal(t, "int", byPath["/firstName"].Actual)
+	require.Equal(t, "overflows int", byPath["/age"].Message)
+	require.Equal(t, "string", byPath["/emails/1"].Expected)
+	require.Equal(t, `unknown union branch "number"`, byPath["/phone"].Message)
+	require.Equal(t, []string{"josgilmo.avrostry.phone"}, byPath["/phone"].Branches)
+	require.Equal(t, []string{"string"}, byPath["/nickname"].Branches)
+	require.Equal(t, `unknown symbol "HOURLY"`, byPath["/status"].Message)
+	require.Equal(t, "no field", byPath["/salary"].Expected)
+}
+
+func TestValidateAcceptsEventsGoavroEncodes(t *testing.T) {
+	require.Nil(t, Validate(Word{Word: "Palabro"}))
+	require.Nil(t, Validate(invalidEmployee{map[string]interface{}{
+		"id":        "1",
+		"firstName": "John",
+		"age":       51,
+		"emails":    []string{"john.doe@example.org"},
+		"phone":     nil,
+		"salary":    1000,
+	}}), "fields not defined in the schema are ignored")
+}
@@ -0,0 +1,193 @@
+package avrostry
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// BatchEventHandler handles a batch of messages of the same partition, in
+// order. As long as it returns false it gets the same batch again.
+type BatchEventHandler func([]*ConsumerMessage) (shouldCommit bool)
+
+type batchEntry struct {
+	raw *sarama.ConsumerMessage // sent to the dead letter topic
+	msg *ConsumerMessage
+}
+
+// messageBatch the messages of a partition read and not committed yet
+type messageBatch struct {
+	entries  []batchEntry
+	last     *sarama.ConsumerMessage // committed with the batch, even if skipped
+	deadline time.Time
+}
+
+// readBatches reads messages like ReadMessages, handing them to the
+// BatchEventHandler per partition
+func (rgc *KafkaRegistryConsumerGroup) readBatches(ctx context.Context) error {
+	batches := map[topicPartition]*messageBatch{}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err, ok := <-rgc.consumer.Errors():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			if err := rgc.kafkaError(err); err != nil {
+				return err
+			}
+
+		case msg, ok := <-rgc.consumer.Messages():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			tp := topicPartition{msg.Topic, msg.Partition}
+			batch, found := batches[tp]
+			if !found {
+				batch = &messageBatch{deadline: time.Now().Add(rgc.cfg.BatchMaxDelay)}
+				batches[tp] = batch
+			}
+			if err := rgc.addToBatch(ctx, batch, msg); err != nil {
+				return err
+			}
+			if len(batch.entries) >= rgc.cfg.BatchSize {
+				delete(batches, tp)
+				if err := rgc.flushBatch(ctx, batch); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+			}
+
+		case now := <-nextFlush(timer, batches):
+			for tp, batch := range batches {
+				if batch.deadline.After(now) {
+					continue
+				}
+				delete(batches, tp)
+				if err := rgc.flushBatch(ctx, batch); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+			}
+		}
+	}
+}
+
+// nextFlush fires at the first deadline of batches, nil channel without them
+func nextFlush(timer *time.Timer, batches map[topicPartition]*messageBatch) <-chan time.Time {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+
+	var first time.Time
+	for _, batch := range batches {
+		if first.IsZero() || batch.deadline.Before(first) {
+			first = batch.deadline
+		}
+	}
+	timer.Reset(time.Until(first))
+	return timer.C
+}
+
+// addToBatch decodes msg into batch, the undecodable ones go straight to the
+// dead letter topic
+func (rgc *KafkaRegistryConsumerGroup) addToBatch(ctx context.Context, batch *messageBatch, msg *sarama.ConsumerMessage) error {
+	batch.last = msg
+	if msg.Value == nil && !rgc.cfg.DeliverTombstones {
+		return nil
+	}
+
+	atomic.StoreInt32(&rgc.nErrors, 0)
+
+	consumerMsg, failure := rgc.decode(ctx, msg)
+	if failure != nil {
+		rgc.errHandler(failure)
+		if rgc.republisher != nil && rgc.cfg.DeadLetterTopic != "" {
+			return rgc.sendDeadLetter(msg, failure, 0, time.Time{})
+		}
+		return nil
+	}
+	batch.entries = append(batch.entries, batchEntry{raw: msg, msg: consumerMsg})
+	return nil
+}
+
+// flushBatch handles batch and commits its messages
+func (rgc *KafkaRegistryConsumerGroup) flushBatch(ctx context.Context, batch *messageBatch) error {
+	if len(batch.entries) > 0 {
+		if err := rgc.handleBatch(ctx, batch.entries); err != nil {
+			return err
+		}
+	}
+
+	rgc.commit(batch.last.Topic, batch.last.Partition, batch.last.Offset)
+	return nil
+}
+
+// handleBatch calls the BatchEventHandler with the backoff and retries of
+// process, then bisects the batch or discards it. Errors stop the consumer,
+// the batch must not be committed then.
+func (rgc *KafkaRegistryConsumerGroup) handleBatch(ctx context.Context, entries []batchEntry) error {
+	msgs := make([]*ConsumerMessage, len(entries))
+	for i, entry := range entries {
+		msgs[i] = entry.msg
+	}
+
+	var (
+		attempts     int
+		firstFailure time.Time
+	)
+	for rgc.cfg.MaxRetries == 0 || attempts < rgc.cfg.MaxRetries {
+		if rgc.cfg.BatchEventHandler(msgs) {
+			return nil
+		}
+		if attempts == 0 {
+			firstFailure = time.Now()
+		}
+		attempts++
+
+		if err := rgc.backoff(ctx, attempts); err != nil {
+			return err
+		}
+	}
+
+	if rgc.cfg.BisectBatches && len(entries) > 1 {
+		half := len(entries) / 2
+		if err := rgc.handleBatch(ctx, entries[:half]); err != nil {
+			return err
+		}
+		return rgc.handleBatch(ctx, entries[half:])
+	}
+
+	failure := errors.Errorf("batch of %d messages not processed after %d attempts", len(entries), attempts)
+	if len(entries) == 1 {
+		failure = errors.Errorf("not processed after %d attempts", attempts)
+	}
+	for _, entry := range entries {
+		rgc.errHandler(&DiscardedMessageError{msg: entry.msg})
+		if rgc.republisher != nil && rgc.cfg.DeadLetterTopic != "" {
+			if err := rgc.sendDeadLetter(entry.raw, failure, attempts, firstFailure); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package avrostry
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func batchEntries(n int) []batchEntry {
+	entries := make([]batchEntry, n)
+	for i := range entries {
+		raw := &sarama.ConsumerMessage{Topic: "words", Offset: int64(i), Value: []byte("x")}
+		entries[i] = batchEntry{raw: raw, msg: &ConsumerMessage{Topic: raw.Topic, Offset: raw.Offset}}
+	}
+	return entries
+}
+
+func TestHandleBatchBisectsFailingBatches(t *testing.T) {
+	var (
+		batches   [][]int64
+		discarded []int64
+	)
+	rgc := &KafkaRegistryConsumerGroup{
+		cfg: ConsumerConfig{
+			MaxRetries:    1,
+			BisectBatches: true,
+			BatchEventHandler: func(msgs []*ConsumerMessage) bool {
+				var offsets []int64
+				poisoned := false
+				for _, msg := range msgs {
+					offsets = append(offsets, msg.Offset)
+					poisoned = poisoned || msg.Offset == 2
+				}
+				batches = append(batches, offsets)
+				return !poisoned
+			},
+		},
+		random: rand.New(rand.NewSource(1)),
+		errHandler: func(err error) {
+			discarded = append(discarded, err.(*DiscardedMessageError).Message().Offset)
+		},
+	}
+
+	require.Nil(t, rgc.handleBatch(context.Background(), batchEntries(4)))
+	require.Equal(t, [][]int64{{0, 1, 2, 3}, {0, 1}, {2, 3}, {2}, {3}}, batches)
+	require.Equal(t, []int64{2}, discarded)
+
+	batches, discarded = nil, nil
+	rgc.cfg.BisectBatches = false
+	require.Nil(t, rgc.handleBatch(context.Background(), batchEntries(4)))
+	require.Len(t, batches, 1)
+	require.Equal(t, []int64{0, 1, 2, 3}, discarded)
+}
+
+func TestConsumerConfigBatches(t *testing.T) {
+	cfg, err := NewConsumerConfig(
+		ConsumerBrokers("kafka:9092"),
+		ConsumerName("employees"),
+		ConsumerTopics("employees"),
+	)
+	require.Nil(t, err)
+	cfg.SchemaRegistryURL = "http://registry:8081"
+	cfg.BatchEventHandler = func([]*ConsumerMessage) bool { return true }
+	require.Nil(t, cfg.settings()["batch_size"]("500"))
+	require.Nil(t, cfg.settings()["batch_max_delay"]("250ms"))
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, 500, cfg.BatchSize)
+
+	cfg.BatchSize = 0
+	cfg.Concurrency = 4
+	require.Equal(t, []string{"BatchSize", "Concurrency"}, configFields(cfg.Validate()))
+
+	cfg.BatchSize, cfg.Concurrency = 100, 0
+	cfg.ContextEventHandler = func(context.Context, *ConsumerMessage) Result { return Ack() }
+	cfg.Middlewares = []ConsumerMiddleware{RecoverMiddleware(nil)}
+	require.Equal(t, []string{"ContextEventHandler", "Middlewares"}, configFields(cfg.Validate()))
+}
+
+func TestConsumerConfigBisectBatchesNeedsMaxRetries(t *testing.T) {
+	cfg := DefaultKafkaRegistryConsumerGroupCfg()
+	cfg.KafkaBrokers = []string{"kafka:9092"}
+	cfg.Name = "employees"
+	cfg.Topics = []string{"employees"}
+	cfg.SchemaRegistryURL = "http://registry:8081"
+	cfg.BatchEventHandler = func([]*ConsumerMessage) bool { return false }
+	cfg.BisectBatches = true
+	require.Equal(t, []string{"MaxRetries"}, configFields(cfg.Validate()))
+
+	cfg.MaxRetries = 2
+	require.Nil(t, cfg.Validate())
+}
@@ -8,15 +8,21 @@ import (
 type CacheSchemaRegistry struct {
 	sync.RWMutex
 	//
-	schemaCache map[string]map[string]int32 // subject => schema => id
-	idCache     map[int32]string            // id => schema
+	schemaCache     map[string]map[string]int32          // subject => schema => id
+	idCache         map[int32]string                     // id => schema
+	referencesCache map[int32][]SchemaReference          // id => references
+	typeCache       map[int32]SchemaType                 // id => schema type
+	versionCache    map[string]map[int32]*SchemaMetadata // subject => version => metadata
 }
 
 // NewCacheSchemaRegistry CacheSchemaRegistry constructor.
 func NewCacheSchemaRegistry() *CacheSchemaRegistry {
 	return &CacheSchemaRegistry{
-		schemaCache: make(map[string]map[string]int32),
-		idCache:     make(map[int32]string),
+		schemaCache:     make(map[string]map[string]int32),
+		idCache:         make(map[int32]string),
+		referencesCache: make(map[int32][]SchemaReference),
+		typeCache:       make(map[int32]SchemaType),
+		versionCache:    make(map[string]map[int32]*SchemaMetadata),
 	}
 }
 
@@ -65,3 +71,53 @@ func (cache *CacheSchemaRegistry) GetIDBySubjectAndSquema(subject, schema string
 	cache.RUnlock()
 	return id, exists
 }
+
+// SetReferencesByID Storage the references of a schema hashed by it´s id.
+func (cache *CacheSchemaRegistry) SetReferencesByID(id int32, references []SchemaReference) {
+	cache.Lock()
+	cache.referencesCache[id] = references
+	cache.Unlock()
+}
+
+// GetReferencesByID Get the references of a schema given his id
+func (cache *CacheSchemaRegistry) GetReferencesByID(id int32) ([]SchemaReference, bool) {
+	cache.RLock()
+	references, ok := cache.referencesCache[id]
+	cache.RUnlock()
+	return references, ok
+}
+
+// SetBySubjectVersion Store in cache the metadata of a subject version
+func (cache *CacheSchemaRegistry) SetBySubjectVersion(subject string, version int32, metadata *SchemaMetadata) {
+	cache.Lock()
+	versions, ok := cache.versionCache[subject]
+	if !ok {
+		versions = make(map[int32]*SchemaMetadata)
+		cache.versionCache[subject] = versions
+	}
+	versions[version] = metadata
+	cache.Unlock()
+}
+
+// GetBySubjectVersion Retrieve the metadata of a subject version
+func (cache *CacheSchemaRegistry) GetBySubjectVersion(subject string, version int32) (*SchemaMetadata, bool) {
+	cache.RLock()
+	metadata, ok := cache.versionCache[subject][version]
+	cache.RUnlock()
+	return metadata, ok
+}
+
+// SetSchemaTypeByID Storage the type of a schema hashed by it´s id.
+func (cache *CacheSchemaRegistry) SetSchemaTypeByID(id int32, schemaType SchemaType) {
+	cache.Lock()
+	cache.typeCache[id] = schemaType
+	cache.Unlock()
+}
+
+// GetSchemaTypeByID Get the type of a schema given his id
+func (cache *CacheSchemaRegistry) GetSchemaTypeByID(id int32) (SchemaType, bool) {
+	cache.RLock()
+	schemaType, ok := cache.typeCache[id]
+	cache.RUnlock()
+	return schemaType, ok
+}
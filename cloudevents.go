@@ -0,0 +1,260 @@
+package avrostry
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CloudEventsMode how the producers bind events to Kafka messages following
+// the CloudEvents Kafka protocol binding
+type CloudEventsMode int
+
+const (
+	// CloudEventsDisabled the envelope headers, no CloudEvents
+	CloudEventsDisabled CloudEventsMode = iota
+	// CloudEventsBinary ce_* headers with the attributes, the registry
+	// encoded event is the message value
+	CloudEventsBinary
+	// CloudEventsStructured a JSON CloudEvent is the message value, with the
+	// registry encoded event as data_base64
+	CloudEventsStructured
+)
+
+// CloudEvents constants
+const (
+	CloudEventsSpecVersion   = "1.0"
+	AvroContentType          = "application/avro"
+	CloudEventsJSONType      = "application/cloudevents+json"
+	ContentTypeHeader        = "content-type"
+	CloudEventsHeaderPrefix  = "ce_"
+	correlationIDExtension   = "correlationid"
+	causationIDExtension     = "causationid"
+	cloudEventsDataBase64Key = "data_base64"
+)
+
+// CloudEvent a CloudEvent whose data is the event encoded with the schema
+// registry framing. Extensions hold the attributes without a field, the
+// correlation and causation IDs of the Envelope among them.
+type CloudEvent struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	Data            []byte
+	Extensions      map[string]string
+}
+
+// newCloudEvent the CloudEvent of an event published with envelope
+func newCloudEvent(envelope Envelope, event DomainEvent, data []byte) *CloudEvent {
+	ce := &CloudEvent{
+		ID:              envelope.EventID,
+		Source:          envelope.Producer,
+		SpecVersion:     CloudEventsSpecVersion,
+		Type:            envelope.Type,
+		Subject:         event.ID(),
+		Time:            envelope.OccurredAt,
+		DataContentType: AvroContentType,
+		Data:            data,
+		Extensions:      map[string]string{},
+	}
+	if envelope.CorrelationID != "" {
+		ce.Extensions[correlationIDExtension] = envelope.CorrelationID
+	}
+	if envelope.CausationID != "" {
+		ce.Extensions[causationIDExtension] = envelope.CausationID
+	}
+	return ce
+}
+
+// Envelope the envelope of the CloudEvent, its source is the producer
+func (ce *CloudEvent) Envelope() Envelope {
+	envelope := Envelope{
+		EventID:       ce.ID,
+		Type:          ce.Type,
+		Producer:      ce.Source,
+		OccurredAt:    ce.Time,
+		CorrelationID: ce.Extensions[correlationIDExtension],
+		CausationID:   ce.Extensions[causationIDExtension],
+	}
+	if len(ce.Data) >= 5 && ce.Data[0] == magicBytes[0] {
+		envelope.SchemaID = int32(binary.BigEndian.Uint32(ce.Data[1:5]))
+	}
+	return envelope
+}
+
+// attributes the context attributes of the CloudEvent by name, the empty
+// optional ones are left out
+func (ce *CloudEvent) attributes() map[string]string {
+	attributes := map[string]string{
+		"id":          ce.ID,
+		"source":      ce.Source,
+		"specversion": ce.SpecVersion,
+		"type":        ce.Type,
+	}
+	if ce.Subject != "" {
+		attributes["subject"] = ce.Subject
+	}
+	if !ce.Time.IsZero() {
+		attributes["time"] = ce.Time.UTC().Format(time.RFC3339Nano)
+	}
+	for name, value := range ce.Extensions {
+		attributes[name] = value
+	}
+	return attributes
+}
+
+// setAttribute sets the attribute name, unknown ones are extensions
+func (ce *CloudEvent) setAttribute(name, value string) error {
+	switch name {
+	case "id":
+		ce.ID = value
+	case "source":
+		ce.Source = value
+	case "specversion":
+		ce.SpecVersion = value
+	case "type":
+		ce.Type = value
+	case "subject":
+		ce.Subject = value
+	case "datacontenttype":
+		ce.DataContentType = value
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return errors.Wrap(err, "malformed CloudEvent time")
+		}
+		ce.Time = t
+	default:
+		if ce.Extensions == nil {
+			ce.Extensions = map[string]string{}
+		}
+		ce.Extensions[name] = value
+	}
+	return nil
+}
+
+// BinaryHeaders the message headers of the CloudEvent in binary mode, the
+// message value is Data
+func (ce *CloudEvent) BinaryHeaders() []MessageHeader {
+	attributes := ce.attributes()
+	headers := make([]MessageHeader, 0, len(attributes)+1)
+	headers = append(headers, MessageHeader{Key: ContentTypeHeader, Value: ce.DataContentType})
+	for _, name := range []string{"specversion", "id", "source", "type", "subject", "time"} {
+		if value, ok := attributes[name]; ok {
+			headers = append(headers, MessageHeader{Key: CloudEventsHeaderPrefix + name, Value: value})
+			delete(attributes, name)
+		}
+	}
+	extensions := make([]string, 0, len(attributes))
+	for name := range attributes {
+		extensions = append(extensions, name)
+	}
+	sort.Strings(extensions)
+	for _, name := range extensions {
+		headers = append(headers, MessageHeader{Key: CloudEventsHeaderPrefix + name, Value: attributes[name]})
+	}
+	return headers
+}
+
+// MarshalJSON the CloudEvent in the JSON event format, Data as data_base64
+func (ce *CloudEvent) MarshalJSON() ([]byte, error) {
+	structured := map[string]interface{}{}
+	for name, value := range ce.attributes() {
+		structured[name] = value
+	}
+	if ce.DataContentType != "" {
+		structured["datacontenttype"] = ce.DataContentType
+	}
+	if ce.Data != nil {
+		structured[cloudEventsDataBase64Key] = base64.StdEncoding.EncodeToString(ce.Data)
+	}
+	return json.Marshal(structured)
+}
+
+// UnmarshalJSON reads a CloudEvent in the JSON event format, JSON data is
+// kept as is in Data
+func (ce *CloudEvent) UnmarshalJSON(data []byte) error {
+	var structured map[string]json.RawMessage
+	if err := json.Unmarshal(data, &structured); err != nil {
+		return err
+	}
+	*ce = CloudEvent{}
+	for name, raw := range structured {
+		switch name {
+		case cloudEventsDataBase64Key:
+			var encoded string
+			if err := json.Unmarshal(raw, &encoded); err != nil {
+				return errors.Wrap(err, "malformed CloudEvent data_base64")
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return errors.Wrap(err, "malformed CloudEvent data_base64")
+			}
+			ce.Data = decoded
+		case "data":
+			ce.Data = []byte(raw)
+		default:
+			var value interface{}
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return err
+			}
+			text, ok := value.(string)
+			if !ok {
+				text = string(raw)
+			}
+			if err := ce.setAttribute(name, text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseCloudEvent the CloudEvent of a message in binary or structured mode,
+// nil for other messages
+func parseCloudEvent(headers []MessageHeader, value []byte) (*CloudEvent, error) {
+	var (
+		contentType string
+		ce          *CloudEvent
+	)
+	for _, h := range headers {
+		switch {
+		case strings.EqualFold(h.Key, ContentTypeHeader):
+			contentType = h.Value
+		case strings.HasPrefix(h.Key, CloudEventsHeaderPrefix):
+			if ce == nil {
+				ce = &CloudEvent{}
+			}
+			if err := ce.setAttribute(strings.TrimPrefix(h.Key, CloudEventsHeaderPrefix), h.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if strings.HasPrefix(contentType, CloudEventsJSONType) {
+		ce = &CloudEvent{}
+		if err := json.Unmarshal(value, ce); err != nil {
+			return nil, errors.Wrap(err, "malformed structured CloudEvent")
+		}
+		return ce, nil
+	}
+	if ce == nil {
+		return nil, nil
+	}
+	if ce.SpecVersion == "" {
+		return nil, fmt.Errorf("CloudEvent without %sspecversion header", CloudEventsHeaderPrefix)
+	}
+	ce.DataContentType = contentType
+	ce.Data = value
+	return ce, nil
+}
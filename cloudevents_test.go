@@ -0,0 +1,103 @@
+package avrostry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCloudEventsEncoder(t *testing.T, mode CloudEventsMode) (*messageEncoder, func()) {
+	_, server := newFakeSchemaRegistry()
+	cfg := DefaultProducerConfig()
+	cfg.ClientID = "words-service"
+	cfg.CloudEvents = mode
+	cfg.CloudEventsSource = "/services/words"
+	cfg.SchemaRegistryClient = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	return newMessageEncoder(cfg), server.Close
+}
+
+func TestCloudEventsBinaryMode(t *testing.T) {
+	encoder, closeRegistry := newTestCloudEventsEncoder(t, CloudEventsBinary)
+	defer closeRegistry()
+
+	parent := Envelope{EventID: "uno", CorrelationID: "request-1"}
+	msg, err := encoder.encode(ContextWithEnvelope(context.Background(), parent), "words", identifiedWord{Word{Word: "dos"}}, []MessageHeader{{Key: "tenant", Value: "acme"}})
+	require.Nil(t, err)
+	headers := make([]MessageHeader, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = MessageHeader{Key: string(h.Key), Value: string(h.Value)}
+	}
+	require.Equal(t, MessageHeader{Key: ContentTypeHeader, Value: AvroContentType}, headers[0])
+	require.Equal(t, MessageHeader{Key: "ce_specversion", Value: "1.0"}, headers[1])
+	require.Equal(t, MessageHeader{Key: "tenant", Value: "acme"}, headers[len(headers)-1])
+
+	value, err := msg.Value.Encode()
+	require.Nil(t, err)
+	ce, err := parseCloudEvent(headers, value)
+	require.Nil(t, err)
+	require.Equal(t, "word-dos", ce.ID)
+	require.Equal(t, "/services/words", ce.Source)
+	require.Equal(t, Word{}.Subject(), ce.Type)
+	require.Equal(t, Word{}.ID(), ce.Subject)
+	require.Equal(t, AvroContentType, ce.DataContentType)
+	require.Equal(t, map[string]string{"correlationid": "request-1", "causationid": "uno"}, ce.Extensions)
+	require.WithinDuration(t, time.Now(), ce.Time, time.Minute)
+
+	envelope := ce.Envelope()
+	require.Equal(t, "/services/words", envelope.Producer)
+	require.Equal(t, "request-1", envelope.CorrelationID)
+	require.NotZero(t, envelope.SchemaID)
+
+	subject, event, err := encoder.codec.Decode(ce.Data)
+	require.Nil(t, err)
+	require.Equal(t, ce.Type, subject)
+	require.Equal(t, Word{Word: "dos"}.ToStringMap(), event)
+}
+
+func TestCloudEventsStructuredMode(t *testing.T) {
+	encoder, closeRegistry := newTestCloudEventsEncoder(t, CloudEventsStructured)
+	defer closeRegistry()
+
+	msg, err := encoder.encode(context.Background(), "words", Word{Word: "uno"}, nil)
+	require.Nil(t, err)
+	require.Len(t, msg.Headers, 1)
+	require.Equal(t, CloudEventsJSONType, string(msg.Headers[0].Value))
+
+	value, err := msg.Value.Encode()
+	require.Nil(t, err)
+	var structured map[string]interface{}
+	require.Nil(t, json.Unmarshal(value, &structured))
+	require.Equal(t, "1.0", structured["specversion"])
+	require.Equal(t, AvroContentType, structured["datacontenttype"])
+	require.NotEmpty(t, structured["data_base64"])
+
+	ce, err := parseCloudEvent([]MessageHeader{{Key: ContentTypeHeader, Value: CloudEventsJSONType}}, value)
+	require.Nil(t, err)
+	subject, event, err := encoder.codec.Decode(ce.Data)
+	require.Nil(t, err)
+	require.Equal(t, Word{}.Subject(), subject)
+	require.Equal(t, Word{Word: "uno"}.ToStringMap(), event)
+
+	// lossless in both modes
+	fromBinary, err := parseCloudEvent(ce.BinaryHeaders(), ce.Data)
+	require.Nil(t, err)
+	require.Equal(t, ce, fromBinary)
+	data, err := json.Marshal(fromBinary)
+	require.Nil(t, err)
+	var fromJSON CloudEvent
+	require.Nil(t, json.Unmarshal(data, &fromJSON))
+	require.Equal(t, ce, &fromJSON)
+}
+
+func TestParseCloudEventWithoutSpecVersion(t *testing.T) {
+	_, err := parseCloudEvent([]MessageHeader{{Key: "ce_id", Value: "uno"}}, nil)
+	require.Error(t, err)
+
+	ce, err := parseCloudEvent([]MessageHeader{{Key: EventIDHeader, Value: "uno"}}, nil)
+	require.Nil(t, err)
+	require.Nil(t, ce)
+}
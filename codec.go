@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
 )
 
 var (
@@ -15,16 +16,68 @@ var (
 type KafkaAvroCodec struct {
 	schemaRegistry SchemaRegistryClient
 	cacheCodec     *CacheCodec
+	resolver       *SchemaResolver
+
+	sync.RWMutex
+	formats         map[SchemaType]SchemaFormat
+	encodingSchemas map[subjectSchema]registeredSchema // registered in each subject
+	decodingSchemas map[int32]registeredSchema         // id => schema with references inlined
+}
+
+// subjectSchema a schema as registered in a subject
+type subjectSchema struct {
+	subject string
+	schema  string
+}
+
+type registeredSchema struct {
+	id         int32
+	schemaType SchemaType
+	schema     string
 }
 
 func NewKafkaAvroCodec(s SchemaRegistryClient, cache *CacheCodec) *KafkaAvroCodec {
-	return &KafkaAvroCodec{s, cache}
+	return NewKafkaAvroCodecWithResolver(s, cache, nil)
+}
+
+// NewKafkaAvroCodecWithResolver KafkaAvroCodec constructor, named types used by
+// event schemas are looked up in resolver when they are not defined in the schema.
+func NewKafkaAvroCodecWithResolver(s SchemaRegistryClient, cache *CacheCodec, resolver *SchemaResolver) *KafkaAvroCodec {
+	kac := &KafkaAvroCodec{
+		schemaRegistry:  s,
+		cacheCodec:      cache,
+		resolver:        resolver,
+		formats:         map[SchemaType]SchemaFormat{},
+		encodingSchemas: map[subjectSchema]registeredSchema{},
+		decodingSchemas: map[int32]registeredSchema{},
+	}
+	kac.RegisterFormat(NewAvroFormat(cache))
+	kac.RegisterFormat(NewJSONSchemaFormat())
+	return kac
+}
+
+// RegisterFormat adds, or replaces, the format used to encode and decode
+// the events with its schema type.
+func (kac *KafkaAvroCodec) RegisterFormat(format SchemaFormat) {
+	kac.Lock()
+	kac.formats[format.Type()] = format
+	kac.Unlock()
+}
+
+func (kac *KafkaAvroCodec) format(schemaType SchemaType) (SchemaFormat, error) {
+	kac.RLock()
+	format, exists := kac.formats[schemaType]
+	kac.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unsupported schema type: %s", schemaType)
+	}
+	return format, nil
 }
 
 // Encode Given a DomainEvent interface, encode the message,
 // loading the struct to/from Kafka Schema Registry.
 func (kac *KafkaAvroCodec) Encode(event DomainEvent) ([]byte, error) {
-	id, err := kac.schemaRegistry.Register(event.Subject(), event.AvroSchema())
+	registered, err := kac.register(event)
 	if err != nil {
 		return nil, err
 	}
@@ -36,7 +89,7 @@ func (kac *KafkaAvroCodec) Encode(event DomainEvent) ([]byte, error) {
 
 	// Schema ID
 	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(id))
+	binary.BigEndian.PutUint32(buf, uint32(registered.id))
 	_, err = buffer.Write(buf)
 	if err != nil {
 		return nil, err
@@ -58,20 +111,50 @@ func (kac *KafkaAvroCodec) Encode(event DomainEvent) ([]byte, error) {
 		return nil, err
 	}
 
-	codec, err := kac.cacheCodec.Get(event.AvroSchema())
+	format, err := kac.format(registered.schemaType)
 	if err != nil {
 		return nil, err
 	}
 
-	binary, err := codec.BinaryFromNative(nil, event.ToStringMap())
+	payload, err := format.Encode(registered.schema, event.ToStringMap())
 	if err != nil {
 		return nil, err
 	}
-	_, err = buffer.Write(binary)
+	_, err = buffer.Write(payload)
 
 	return buffer.Bytes(), err
 }
 
+// EncodeKey encode the key of the event, with the same framing than
+// messages, registering the key schema under the subject with KeySubjectSuffix
+func (kac *KafkaAvroCodec) EncodeKey(event KeyedEvent) ([]byte, error) {
+	return kac.Encode(keyEvent{event})
+}
+
+// IsEncoded tells whether buf has the framing written by Encode, so plain
+// string keys can be told apart from encoded keys
+func IsEncoded(buf []byte) bool {
+	return len(buf) >= 6 && buf[0] == magicBytes[0] && 6+int(buf[5]) <= len(buf)
+}
+
+// Validate checks the native event against its schema, with every reference
+// resolved, before encoding it. The schema is registered if needed.
+func (kac *KafkaAvroCodec) Validate(event DomainEvent) error {
+	registered, err := kac.register(event)
+	if err != nil {
+		return err
+	}
+	format, err := kac.format(registered.schemaType)
+	if err != nil {
+		return err
+	}
+	validator, ok := format.(SchemaValidator)
+	if !ok {
+		return fmt.Errorf("schema type: %s doesn't support validation", registered.schemaType)
+	}
+	return withSubject(validator.Validate(registered.schema, event.ToStringMap()), event.Subject())
+}
+
 func (kac *KafkaAvroCodec) Decode(buf []byte) (string, interface{}, error) {
 	//
 	// MagicByte(1) + SchemaID(4) + SubjectLen(1) + Subject + EventData
@@ -88,7 +171,7 @@ func (kac *KafkaAvroCodec) Decode(buf []byte) (string, interface{}, error) {
 
 	// Schema ID
 	id := int32(binary.BigEndian.Uint32(buf[1:5]))
-	schema, err := kac.schemaRegistry.GetByID(id)
+	registered, err := kac.schemaByID(id)
 	if err != nil {
 		return "", nil, err
 	}
@@ -100,15 +183,238 @@ func (kac *KafkaAvroCodec) Decode(buf []byte) (string, interface{}, error) {
 	}
 
 	subject := string(buf[6 : 6+subjectLen])
-	codec, err := kac.cacheCodec.Get(schema)
+	format, err := kac.format(registered.schemaType)
 	if err != nil {
 		return "", nil, err
 	}
 
-	native, _, err := codec.NativeFromBinary(buf[6+subjectLen:])
+	native, err := format.Decode(registered.schema, buf[6+subjectLen:])
 	if err != nil {
 		return "", nil, err
 	}
 
 	return subject, native, nil
 }
+
+// register the event schema, and the subjects it references, in Schema Registry,
+// once per subject. The returned schema has every referenced type inlined, ready
+// to build a codec.
+func (kac *KafkaAvroCodec) register(event DomainEvent) (registeredSchema, error) {
+	schemaType, schema := eventSchema(event)
+	key := subjectSchema{event.Subject(), schema}
+
+	kac.RLock()
+	registered, exists := kac.encodingSchemas[key]
+	kac.RUnlock()
+	if exists {
+		return registered, nil
+	}
+
+	registered, err := kac.registerSchema(event, schemaType, schema)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+
+	// cached even without references, looking them up parses the schema
+	kac.Lock()
+	kac.encodingSchemas[key] = registered
+	kac.Unlock()
+	return registered, nil
+}
+
+func (kac *KafkaAvroCodec) registerSchema(event DomainEvent, schemaType SchemaType, schema string) (registeredSchema, error) {
+	var references []SchemaReference
+	if referencer, ok := event.(SchemaReferencer); ok {
+		references = referencer.SchemaReferences()
+	}
+	if schemaType != AvroSchemaType {
+		return kac.registerWithType(event.Subject(), schemaType, schema, references)
+	}
+
+	references, err := kac.localReferences(schema, references, nil)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+
+	if len(references) == 0 {
+		id, err := kac.schemaRegistry.Register(event.Subject(), schema)
+		if err != nil {
+			return registeredSchema{}, err
+		}
+		return registeredSchema{id, schemaType, schema}, nil
+	}
+
+	client, ok := kac.schemaRegistry.(SchemaReferenceClient)
+	if !ok {
+		return registeredSchema{}, fmt.Errorf("subject: %s has references, unsupported by schema registry client %T", event.Subject(), kac.schemaRegistry)
+	}
+	id, err := client.RegisterWithReferences(event.Subject(), schema, references)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+	expanded, err := kac.resolveReferences(schema, references)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+	return registeredSchema{id, schemaType, expanded}, nil
+}
+
+// localReferences appends to references the named types used in schema that are
+// known by the local resolver, registering the subjects where they are defined.
+func (kac *KafkaAvroCodec) localReferences(schema string, references []SchemaReference, visiting map[string]bool) ([]SchemaReference, error) {
+	if kac.resolver == nil {
+		return references, nil
+	}
+
+	names, err := unresolvedNames(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	for _, reference := range references {
+		referenced[reference.Name] = true
+	}
+	if visiting == nil {
+		visiting = map[string]bool{}
+	}
+
+	for _, name := range names {
+		if referenced[name] {
+			continue
+		}
+		t, found := kac.resolver.get(name)
+		if !found {
+			continue
+		}
+		if visiting[t.subject] {
+			return nil, fmt.Errorf("circular reference to subject: %s", t.subject)
+		}
+
+		client, ok := kac.schemaRegistry.(SchemaReferenceClient)
+		if !ok {
+			return nil, fmt.Errorf("type: %s is defined in subject: %s, references unsupported by schema registry client %T", name, t.subject, kac.schemaRegistry)
+		}
+
+		visiting[t.subject] = true
+		typeReferences, err := kac.localReferences(t.schema, nil, visiting)
+		delete(visiting, t.subject)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.RegisterWithReferences(t.subject, t.schema, typeReferences); err != nil {
+			return nil, err
+		}
+		metadata, err := client.LookupBySubjectAndSchema(t.subject, t.schema, typeReferences)
+		if err != nil {
+			return nil, err
+		}
+
+		references = append(references, SchemaReference{Name: name, Subject: t.subject, Version: metadata.Version})
+		referenced[name] = true
+	}
+	return references, nil
+}
+
+// registerWithType registers a schema, of a type other than Avro, in Schema Registry.
+func (kac *KafkaAvroCodec) registerWithType(subject string, schemaType SchemaType, schema string, references []SchemaReference) (registeredSchema, error) {
+	client, ok := kac.schemaRegistry.(SchemaTypeClient)
+	if !ok {
+		return registeredSchema{}, fmt.Errorf("subject: %s has schema type %s, unsupported by schema registry client %T", subject, schemaType, kac.schemaRegistry)
+	}
+	if _, err := kac.format(schemaType); err != nil {
+		return registeredSchema{}, err
+	}
+	id, err := client.RegisterWithType(subject, schema, schemaType, references)
+	return registeredSchema{id, schemaType, schema}, err
+}
+
+// schemaByID retrieve a schema from Schema Registry with the referenced types inlined.
+func (kac *KafkaAvroCodec) schemaByID(id int32) (registeredSchema, error) {
+	kac.RLock()
+	registered, exists := kac.decodingSchemas[id]
+	kac.RUnlock()
+	if exists {
+		return registered, nil
+	}
+
+	client, ok := kac.schemaRegistry.(interface {
+		GetMetadataByID(id int32) (*SchemaMetadata, error)
+	})
+	if !ok {
+		schema, err := kac.schemaRegistry.GetByID(id)
+		return registeredSchema{id, AvroSchemaType, schema}, err
+	}
+	metadata, err := client.GetMetadataByID(id)
+	if err != nil {
+		return registeredSchema{}, err
+	}
+
+	registered = registeredSchema{id, metadata.Type(), metadata.Schema}
+	if registered.schemaType == AvroSchemaType {
+		schema, err := kac.resolveReferences(metadata.Schema, metadata.References)
+		if err != nil {
+			return registeredSchema{}, err
+		}
+		registered.schema = schema
+	}
+
+	kac.Lock()
+	kac.decodingSchemas[id] = registered
+	kac.Unlock()
+	return registered, nil
+}
+
+// resolveReferences returns schema with the named types defined in references
+// inlined, references of referenced subjects are resolved recursively.
+func (kac *KafkaAvroCodec) resolveReferences(schema string, references []SchemaReference) (string, error) {
+	definitions := map[string]interface{}{}
+	if len(references) > 0 {
+		client, ok := kac.schemaRegistry.(SchemaReferenceClient)
+		if !ok {
+			return "", fmt.Errorf("references unsupported by schema registry client %T", kac.schemaRegistry)
+		}
+		err := collectReferencedTypes(client, references, definitions, map[string]bool{})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return expandSchema(schema, func(fullName string) (interface{}, bool) {
+		if definition, found := definitions[fullName]; found {
+			return definition, true
+		}
+		if kac.resolver != nil {
+			return kac.resolver.lookup(fullName)
+		}
+		return nil, false
+	})
+}
+
+func collectReferencedTypes(client SchemaReferenceClient, references []SchemaReference, definitions map[string]interface{}, visited map[string]bool) error {
+	for _, reference := range references {
+		key := fmt.Sprintf("%s/%d", reference.Subject, reference.Version)
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+
+		metadata, err := client.GetBySubjectAndVersion(reference.Subject, reference.Version)
+		if err != nil {
+			return err
+		}
+		err = collectReferencedTypes(client, metadata.References, definitions, visited)
+		if err != nil {
+			return err
+		}
+
+		types, err := namedTypeDefinitions(metadata.Schema)
+		if err != nil {
+			return err
+		}
+		for name, definition := range types {
+			definitions[name] = definition
+		}
+	}
+	return nil
+}
@@ -72,3 +72,46 @@ func TestAvroKafkaEncoderDecoder(t *testing.T) {
 	wordDecoded := StringMapToWord(data)
 	require.Equal(t, word.Word, wordDecoded.Word, "should be equal")
 }
+
+type keyedWord struct {
+	Word
+	Language string
+}
+
+func (word keyedWord) KeySchema() string {
+	return `{
+		"type": "record",
+		"name": "word_key",
+		"namespace": "com.avro.kafka.golang",
+		"fields": [
+			{"type": "string", "name": "Language"},
+			{"type": "string", "name": "Word"}
+		]
+	}`
+}
+
+func (word keyedWord) KeyMap() map[string]interface{} {
+	return map[string]interface{}{
+		"Language": word.Language,
+		"Word":     word.Word.Word,
+	}
+}
+
+func TestAvroKafkaEncoderDecoderKeys(t *testing.T) {
+	registry, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	codec := NewKafkaAvroCodec(manager, NewCacheCodec())
+
+	word := keyedWord{Word{Word: "Palabro"}, "es"}
+	key, err := codec.EncodeKey(word)
+	require.Nil(t, err)
+	require.True(t, IsEncoded(key))
+	require.False(t, IsEncoded([]byte(word.ID())))
+	require.Len(t, registry.subjects["words-key"], 1)
+
+	subject, decoded, err := codec.Decode(key)
+	require.Nil(t, err)
+	require.Equal(t, "words-key", subject)
+	require.Equal(t, map[string]interface{}{"Language": "es", "Word": "Palabro"}, decoded)
+}
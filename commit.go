@@ -0,0 +1,120 @@
+package avrostry
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// CommitStrategy when the offsets of the messages are committed. Whatever
+// the strategy, the offsets marked are committed every
+// SaramaConfig.Consumer.Offsets.CommitInterval, on rebalance and on Close.
+type CommitStrategy int
+
+const (
+	// CommitEachMessage commits every message once handled, synchronously
+	CommitEachMessage CommitStrategy = iota
+	// CommitEveryN commits after every CommitEvery messages handled
+	CommitEveryN
+	// CommitOnInterval commits every CommitInterval only
+	CommitOnInterval
+	// CommitAtMostOnce commits every message before it is handled, the ones
+	// failing or read during a crash are lost
+	CommitAtMostOnce
+	// CommitManual commits the messages the handler calls Ack on, after the
+	// Ack result. The other results commit the message as usual.
+	CommitManual
+)
+
+// Ack commits the message with CommitManual, up to the first message not
+// acknowledged of its partition. It can be called from any goroutine, only
+// once it returned the Ack result; more calls do nothing.
+func (cm *ConsumerMessage) Ack() {
+	if cm.ack != nil {
+		cm.ack()
+	}
+}
+
+// tracker the offsets of the messages being handled, nil when they are
+// handled in order
+func (rgc *KafkaRegistryConsumerGroup) tracker() *offsetTracker {
+	if rgc.workers != nil {
+		return rgc.workers.tracker
+	}
+	return rgc.acks
+}
+
+// acker commits msg once, for ConsumerMessage.Ack
+func (rgc *KafkaRegistryConsumerGroup) acker(msg *sarama.ConsumerMessage) func() {
+	var (
+		once    sync.Once
+		tracker = rgc.tracker()
+	)
+	return func() {
+		once.Do(func() {
+			rgc.finish(tracker, msg)
+		})
+	}
+}
+
+// finish commits msg handled, with tracker up to the first message not
+// handled of its partition
+func (rgc *KafkaRegistryConsumerGroup) finish(tracker *offsetTracker, msg *sarama.ConsumerMessage) {
+	switch {
+	case rgc.cfg.CommitStrategy == CommitAtMostOnce:
+		return // committed before handling it
+	case tracker == nil:
+		rgc.commit(msg.Topic, msg.Partition, msg.Offset)
+	default:
+		if offset, ok := tracker.done(msg.Topic, msg.Partition, msg.Offset); ok {
+			rgc.commit(msg.Topic, msg.Partition, offset)
+		}
+	}
+}
+
+// commit marks offset, this prevents read message multiple times after
+// restart, and commits it as the CommitStrategy says
+func (rgc *KafkaRegistryConsumerGroup) commit(topic string, partition int32, offset int64) {
+	rgc.consumer.MarkPartitionOffset(topic, partition, offset, "")
+	switch rgc.cfg.CommitStrategy {
+	case CommitEachMessage, CommitAtMostOnce:
+		rgc.commitOffsets()
+	case CommitEveryN:
+		if atomic.AddInt32(&rgc.uncommitted, 1) >= int32(rgc.cfg.CommitEvery) {
+			atomic.StoreInt32(&rgc.uncommitted, 0)
+			rgc.commitOffsets()
+		}
+	}
+}
+
+func (rgc *KafkaRegistryConsumerGroup) commitOffsets() {
+	if err := rgc.consumer.CommitOffsets(); err != nil {
+		rgc.errHandler(errors.Wrap(err, "could not commit message"))
+	}
+}
+
+// commitStrategySetter accepts each_message, every_n, interval,
+// at_most_once and manual
+func commitStrategySetter(strategy *CommitStrategy) setter {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "each_message", "":
+			*strategy = CommitEachMessage
+		case "every_n":
+			*strategy = CommitEveryN
+		case "interval":
+			*strategy = CommitOnInterval
+		case "at_most_once":
+			*strategy = CommitAtMostOnce
+		case "manual":
+			*strategy = CommitManual
+		default:
+			return fmt.Errorf("unknown commit strategy: %s", value)
+		}
+		return nil
+	}
+}
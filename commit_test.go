@@ -0,0 +1,169 @@
+package avrostry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGroupConsumer records the offsets marked and committed
+type fakeGroupConsumer struct {
+	marked    []int64
+	committed []int64 // the last offset marked at each commit
+}
+
+func (f *fakeGroupConsumer) Messages() <-chan *sarama.ConsumerMessage     { return nil }
+func (f *fakeGroupConsumer) Errors() <-chan error                         { return nil }
+func (f *fakeGroupConsumer) Partitions() <-chan cluster.PartitionConsumer { return nil }
+func (f *fakeGroupConsumer) Notifications() <-chan *cluster.Notification  { return nil }
+func (f *fakeGroupConsumer) Close() error                                 { return nil }
+
+func (f *fakeGroupConsumer) MarkPartitionOffset(_ string, _ int32, offset int64, _ string) {
+	f.marked = append(f.marked, offset)
+}
+
+func (f *fakeGroupConsumer) CommitOffsets() error {
+	f.committed = append(f.committed, f.marked[len(f.marked)-1])
+	return nil
+}
+
+// strategyConsumer a consumer of strategy over a fakeGroupConsumer
+func strategyConsumer(strategy CommitStrategy, handler ContextEventHandler) (*KafkaRegistryConsumerGroup, *fakeGroupConsumer) {
+	var errs []error
+	fake := &fakeGroupConsumer{}
+	rgc := resultConsumer(handler, &errs)
+	rgc.consumer = fake
+	rgc.cfg.CommitStrategy = strategy
+	if strategy == CommitManual {
+		rgc.acks = newOffsetTracker()
+	}
+	return rgc, fake
+}
+
+func consumeOffsets(t *testing.T, rgc *KafkaRegistryConsumerGroup, offsets ...int64) {
+	for _, offset := range offsets {
+		require.Nil(t, rgc.consume(context.Background(), &sarama.ConsumerMessage{Topic: "words", Offset: offset}))
+	}
+}
+
+func ack(context.Context, *ConsumerMessage) Result {
+	return Ack()
+}
+
+func TestProcessLeavesManualAcksToTheHandler(t *testing.T) {
+	var (
+		errs  []error
+		acked []*ConsumerMessage
+		next  = Ack()
+	)
+	rgc := resultConsumer(func(_ context.Context, msg *ConsumerMessage) Result {
+		acked = append(acked, msg)
+		return next
+	}, &errs)
+	rgc.cfg.CommitStrategy = CommitManual
+	rgc.acks = newOffsetTracker()
+
+	tombstone := &sarama.ConsumerMessage{Topic: "words", Offset: 4, Key: []byte("1")}
+	rgc.acks.start(tombstone.Topic, tombstone.Partition, tombstone.Offset)
+	committed, err := rgc.process(context.Background(), tombstone)
+	require.Nil(t, err)
+	require.False(t, committed)
+	require.NotNil(t, acked[0].ack)
+
+	next = SendToDeadLetter("unknown word")
+	requireProcessed(t, rgc, tombstone)
+
+	rgc.cfg.CommitStrategy = CommitEachMessage
+	next = Ack()
+	requireProcessed(t, rgc, tombstone)
+	require.Nil(t, acked[2].ack)
+	acked[2].Ack() // nothing to do
+}
+
+func TestConsumerConfigCommitStrategy(t *testing.T) {
+	cfg, err := NewConsumerConfig(
+		ConsumerBrokers("kafka:9092"),
+		ConsumerName("employees"),
+		ConsumerTopics("employees"),
+	)
+	require.Nil(t, err)
+	cfg.SchemaRegistryURL = "http://registry:8081"
+	require.Equal(t, CommitEachMessage, cfg.CommitStrategy)
+
+	require.Nil(t, cfg.settings()["commit_strategy"]("every_n"))
+	require.Nil(t, cfg.settings()["commit_every"]("50"))
+	require.Nil(t, cfg.settings()["commit_interval"]("5s"))
+	require.Equal(t, CommitEveryN, cfg.CommitStrategy)
+	require.Equal(t, 5*time.Second, cfg.CommitInterval)
+	require.Nil(t, cfg.Validate())
+
+	require.Error(t, cfg.settings()["commit_strategy"]("sometimes"))
+
+	cfg.CommitEvery = 0
+	require.Equal(t, []string{"CommitEvery"}, configFields(cfg.Validate()))
+
+	require.Nil(t, cfg.settings()["commit_strategy"]("manual"))
+	cfg.BatchEventHandler = func([]*ConsumerMessage) bool { return true }
+	require.Equal(t, []string{"CommitStrategy"}, configFields(cfg.Validate()))
+}
+
+func TestCommitEachMessage(t *testing.T) {
+	rgc, fake := strategyConsumer(CommitEachMessage, ack)
+	consumeOffsets(t, rgc, 0, 1, 2)
+	require.Equal(t, []int64{0, 1, 2}, fake.marked)
+	require.Equal(t, []int64{0, 1, 2}, fake.committed)
+}
+
+func TestCommitEveryN(t *testing.T) {
+	rgc, fake := strategyConsumer(CommitEveryN, ack)
+	rgc.cfg.CommitEvery = 2
+	consumeOffsets(t, rgc, 0, 1, 2, 3, 4)
+	require.Equal(t, []int64{0, 1, 2, 3, 4}, fake.marked)
+	require.Equal(t, []int64{1, 3}, fake.committed)
+	require.Equal(t, int32(1), rgc.uncommitted)
+}
+
+func TestCommitOnInterval(t *testing.T) {
+	rgc, fake := strategyConsumer(CommitOnInterval, ack)
+	consumeOffsets(t, rgc, 0, 1)
+	require.Equal(t, []int64{0, 1}, fake.marked)
+	require.Empty(t, fake.committed, "committed by sarama-cluster every CommitInterval")
+}
+
+func TestCommitAtMostOnce(t *testing.T) {
+	var (
+		fake              *fakeGroupConsumer
+		committedInHandle []int64
+	)
+	rgc, fake := strategyConsumer(CommitAtMostOnce, func(context.Context, *ConsumerMessage) Result {
+		committedInHandle = append([]int64{}, fake.committed...)
+		return SendToDeadLetter("lost")
+	})
+	consumeOffsets(t, rgc, 0)
+	require.Equal(t, []int64{0}, committedInHandle, "committed before the handler")
+	require.Equal(t, []int64{0}, fake.marked)
+	require.Equal(t, []int64{0}, fake.committed)
+}
+
+func TestCommitManualAcksContiguousOffsets(t *testing.T) {
+	var handled []*ConsumerMessage
+	rgc, fake := strategyConsumer(CommitManual, func(_ context.Context, msg *ConsumerMessage) Result {
+		handled = append(handled, msg)
+		return Ack()
+	})
+	consumeOffsets(t, rgc, 0, 1, 2)
+	require.Empty(t, fake.marked)
+
+	handled[1].Ack()
+	require.Empty(t, fake.marked, "waits for offset 0")
+	handled[0].Ack()
+	require.Equal(t, []int64{1}, fake.marked)
+	handled[0].Ack()
+	handled[2].Ack()
+	require.Equal(t, []int64{1, 2}, fake.marked)
+	require.Empty(t, fake.committed, "committed by sarama-cluster every CommitInterval")
+}
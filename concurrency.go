@@ -0,0 +1,169 @@
+package avrostry
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// MessageOrder which messages keep their order with Concurrency
+type MessageOrder int
+
+const (
+	// OrderByKey messages of the same key are handled in order, the ones
+	// without key in the order of their partition
+	OrderByKey MessageOrder = iota
+	// OrderByPartition messages of the same partition are handled in order
+	OrderByPartition
+)
+
+// offsetTracker the offsets being handled per partition. A partition can
+// only be committed up to the first offset not handled yet, so a crash
+// never skips a message handled after it.
+type offsetTracker struct {
+	sync.Mutex
+	partitions map[topicPartition]*pendingOffsets
+}
+
+type pendingOffsets struct {
+	offsets []int64 // started, in ascending order
+	done    map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: map[topicPartition]*pendingOffsets{}}
+}
+
+// start tracks offset, offsets of a partition start in ascending order
+func (t *offsetTracker) start(topic string, partition int32, offset int64) {
+	t.Lock()
+	defer t.Unlock()
+	tp := topicPartition{topic, partition}
+	pending, ok := t.partitions[tp]
+	if !ok {
+		pending = &pendingOffsets{done: map[int64]bool{}}
+		t.partitions[tp] = pending
+	}
+	if n := len(pending.offsets); n > 0 && pending.offsets[n-1] >= offset {
+		return // delivered again after a rebalance, already tracked
+	}
+	pending.offsets = append(pending.offsets, offset)
+}
+
+// done marks offset handled and returns the highest offset handled with all
+// the previous ones, false when it didn't change
+func (t *offsetTracker) done(topic string, partition int32, offset int64) (int64, bool) {
+	t.Lock()
+	defer t.Unlock()
+	pending, ok := t.partitions[topicPartition{topic, partition}]
+	if !ok {
+		return -1, false
+	}
+	pending.done[offset] = true
+
+	committable, moved := int64(-1), false
+	for len(pending.offsets) > 0 && pending.done[pending.offsets[0]] {
+		committable, moved = pending.offsets[0], true
+		delete(pending.done, committable)
+		pending.offsets = pending.offsets[1:]
+	}
+	return committable, moved
+}
+
+// workerPool handles messages in parallel, messages go to a worker by their
+// key or partition so they keep their order
+type workerPool struct {
+	order   MessageOrder
+	queues  []chan *sarama.ConsumerMessage
+	tracker *offsetTracker
+	fatal   chan error
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// startWorkers starts the pool, the returned context is cancelled by stopWorkers
+func (rgc *KafkaRegistryConsumerGroup) startWorkers(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	wp := &workerPool{
+		order:   rgc.cfg.OrderBy,
+		queues:  make([]chan *sarama.ConsumerMessage, rgc.cfg.Concurrency),
+		tracker: newOffsetTracker(),
+		fatal:   make(chan error, 1),
+		cancel:  cancel,
+	}
+	wp.wg.Add(len(wp.queues))
+	for i := range wp.queues {
+		wp.queues[i] = make(chan *sarama.ConsumerMessage, rgc.cfg.Concurrency)
+		go rgc.work(ctx, wp, wp.queues[i])
+	}
+	rgc.workers = wp
+	return ctx
+}
+
+// stopWorkers waits for the messages being handled, the ones queued are
+// left uncommitted
+func (rgc *KafkaRegistryConsumerGroup) stopWorkers() {
+	wp := rgc.workers
+	wp.cancel()
+	for _, queue := range wp.queues {
+		close(queue)
+	}
+	wp.wg.Wait()
+	rgc.workers = nil
+}
+
+// work handles the messages of queue, after cancellation it only drains it.
+// A failed message is never committed, the offsets of its partition stop there.
+func (rgc *KafkaRegistryConsumerGroup) work(ctx context.Context, wp *workerPool, queue <-chan *sarama.ConsumerMessage) {
+	defer wp.wg.Done()
+	for msg := range queue {
+		if ctx.Err() != nil {
+			continue
+		}
+		acked, err := rgc.process(ctx, msg)
+		if err != nil {
+			if ctx.Err() == nil {
+				select {
+				case wp.fatal <- err:
+				default:
+				}
+			}
+			continue
+		}
+		if acked {
+			rgc.finish(wp.tracker, msg)
+		}
+	}
+}
+
+// dispatch queues msg to its worker, blocking while the worker is busy
+func (wp *workerPool) dispatch(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	wp.tracker.start(msg.Topic, msg.Partition, msg.Offset)
+	select {
+	case wp.queues[wp.worker(msg)] <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (wp *workerPool) worker(msg *sarama.ConsumerMessage) int {
+	hasher := fnv.New32a()
+	if wp.order == OrderByKey && msg.Key != nil {
+		hasher.Write(msg.Key)
+	} else {
+		hasher.Write([]byte(msg.Topic + "/" + strconv.Itoa(int(msg.Partition))))
+	}
+	return int(hasher.Sum32() % uint32(len(wp.queues)))
+}
+
+// failed the first error of a worker, nil channel without pool
+func (wp *workerPool) failed() <-chan error {
+	if wp == nil {
+		return nil
+	}
+	return wp.fatal
+}
@@ -0,0 +1,59 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetTrackerCommitsContiguousOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+	for offset := int64(10); offset < 14; offset++ {
+		tracker.start("words", 0, offset)
+	}
+	tracker.start("words", 1, 3)
+
+	_, moved := tracker.done("words", 0, 12)
+	require.False(t, moved)
+	_, moved = tracker.done("words", 0, 11)
+	require.False(t, moved)
+
+	offset, moved := tracker.done("words", 0, 10)
+	require.True(t, moved)
+	require.Equal(t, int64(12), offset)
+
+	offset, moved = tracker.done("words", 1, 3)
+	require.True(t, moved)
+	require.Equal(t, int64(3), offset)
+
+	// redelivered after a rebalance
+	tracker.start("words", 0, 12)
+	offset, moved = tracker.done("words", 0, 13)
+	require.True(t, moved)
+	require.Equal(t, int64(13), offset)
+
+	_, moved = tracker.done("employees", 0, 1)
+	require.False(t, moved)
+}
+
+func TestWorkerPoolKeepsOrder(t *testing.T) {
+	wp := &workerPool{queues: make([]chan *sarama.ConsumerMessage, 8)}
+
+	workers := map[int]bool{}
+	for partition := int32(0); partition < 4; partition++ {
+		msg := &sarama.ConsumerMessage{Topic: "words", Partition: partition, Key: []byte("uno")}
+		workers[wp.worker(msg)] = true
+	}
+	require.Len(t, workers, 1, "same key, same worker")
+
+	keyless := &sarama.ConsumerMessage{Topic: "words", Partition: 2}
+	require.Equal(t, wp.worker(keyless), wp.worker(&sarama.ConsumerMessage{Topic: "words", Partition: 2}))
+
+	wp.order = OrderByPartition
+	workers = map[int]bool{}
+	for _, key := range []string{"uno", "dos", "tres", "cuatro"} {
+		workers[wp.worker(&sarama.ConsumerMessage{Topic: "words", Partition: 1, Key: []byte(key)})] = true
+	}
+	require.Len(t, workers, 1, "same partition, same worker")
+}
@@ -0,0 +1,564 @@
+package avrostry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// ConfigError invalid field of a configuration
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ConfigErrors every invalid field of a configuration
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// configChecker collects the errors of a configuration
+type configChecker struct {
+	errs ConfigErrors
+}
+
+func (c *configChecker) check(ok bool, field, message string) {
+	if !ok {
+		c.errs = append(c.errs, &ConfigError{Field: field, Message: message})
+	}
+}
+
+func (c *configChecker) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return c.errs
+}
+
+// Validate reports every invalid field, producer constructors call it
+func (cfg ProducerConfig) Validate() error {
+	var c configChecker
+	c.check(len(cfg.Addrs) > 0, "Addrs", "at least one broker is required")
+	c.check(cfg.SchemaRegistryClient != nil || cfg.SchemaRegistryURL != "", "SchemaRegistryClient", "a client or SchemaRegistryURL is required")
+	c.check(cfg.CacheCodec != nil, "CacheCodec", "required")
+	c.check(cfg.MaxRetries >= 0, "MaxRetries", "must not be negative")
+	c.check(cfg.RequiredAcks >= sarama.WaitForAll && cfg.RequiredAcks <= sarama.WaitForLocal, "RequiredAcks",
+		fmt.Sprintf("unknown value: %d", cfg.RequiredAcks))
+	c.check(cfg.Compression >= sarama.CompressionNone && cfg.Compression <= sarama.CompressionZSTD, "Compression",
+		fmt.Sprintf("unknown codec: %d", cfg.Compression))
+	if cfg.Compression == sarama.CompressionZSTD {
+		c.check(cfg.Version.IsAtLeast(sarama.V2_1_0_0), "Version", "zstd compression needs Kafka 2.1 or later")
+	}
+	c.check(cfg.MaxInFlight >= 0, "MaxInFlight", "must not be negative")
+	c.check(cfg.CloudEvents >= CloudEventsDisabled && cfg.CloudEvents <= CloudEventsStructured, "CloudEvents",
+		fmt.Sprintf("unknown mode: %d", cfg.CloudEvents))
+	if cfg.Idempotent || cfg.TransactionalID != "" {
+		c.check(cfg.Version.IsAtLeast(sarama.V0_11_0_0), "Version", "idempotent and transactional producers need Kafka 0.11 or later")
+	}
+	if cfg.Idempotent && cfg.TransactionalID == "" {
+		c.check(cfg.MaxRetries > 0, "MaxRetries", "must be positive for an idempotent producer")
+	}
+	if cfg.TransactionalID != "" {
+		c.check(cfg.TransactionTimeout > 0, "TransactionTimeout", "must be positive with a TransactionalID")
+	}
+	cfg.Security.validate(&c)
+	return c.err()
+}
+
+// Validate reports every invalid field, the consumer constructor calls it
+func (cfg ConsumerConfig) Validate() error {
+	var c configChecker
+	c.check(len(cfg.KafkaBrokers) > 0, "KafkaBrokers", "at least one broker is required")
+	c.check(cfg.Name != "", "Name", "the consumer group is required")
+	c.check(len(cfg.Topics) > 0, "Topics", "at least one topic is required")
+	c.check(cfg.Offset == sarama.OffsetOldest || cfg.Offset == sarama.OffsetNewest, "Offset", "must be OffsetOldest or OffsetNewest")
+	c.check(cfg.ProcessingTimeout > 0, "ProcessingTimeout", "must be positive")
+	c.check(cfg.SchemaRegistryClient != nil || cfg.SchemaRegistryURL != "", "SchemaRegistryClient", "a client or SchemaRegistryURL is required")
+	c.check(cfg.CacheCodec != nil, "CacheCodec", "required")
+	c.check(cfg.EventHandler != nil || cfg.ContextEventHandler != nil, "EventHandler", "EventHandler or ContextEventHandler is required")
+	c.check(cfg.ErrorHandler != nil, "ErrorHandler", "required")
+	c.check(cfg.ErrorThreshold >= 0, "ErrorThreshold", "must not be negative")
+	c.check(cfg.MaxRetries >= 0, "MaxRetries", "must not be negative")
+	c.check(cfg.MaxIntervalSeconds > 0, "MaxIntervalSeconds", "must be positive")
+	c.check(cfg.Concurrency >= 0, "Concurrency", "must not be negative")
+	c.check(cfg.OrderBy == OrderByKey || cfg.OrderBy == OrderByPartition, "OrderBy", fmt.Sprintf("unknown order: %d", cfg.OrderBy))
+	for i, delay := range cfg.RetryDelays {
+		c.check(delay > 0, fmt.Sprintf("RetryDelays[%d]", i), "must be positive")
+	}
+	if len(cfg.RetryDelays) > 0 {
+		c.check(cfg.DeadLetterTopic != "", "DeadLetterTopic", "required with RetryDelays, for the messages out of retries")
+	}
+	c.check(cfg.CommitStrategy >= CommitEachMessage && cfg.CommitStrategy <= CommitManual, "CommitStrategy",
+		fmt.Sprintf("unknown strategy: %d", cfg.CommitStrategy))
+	if cfg.CommitStrategy == CommitEveryN {
+		c.check(cfg.CommitEvery > 0, "CommitEvery", "must be positive with CommitEveryN")
+	}
+	c.check(cfg.CommitInterval >= 0, "CommitInterval", "must not be negative")
+	if cfg.BatchEventHandler != nil {
+		c.check(cfg.CommitStrategy != CommitAtMostOnce && cfg.CommitStrategy != CommitManual, "CommitStrategy",
+			"not supported with a BatchEventHandler")
+		c.check(cfg.BatchSize > 0, "BatchSize", "must be positive with a BatchEventHandler")
+		c.check(cfg.BatchMaxDelay > 0, "BatchMaxDelay", "must be positive with a BatchEventHandler")
+		c.check(cfg.Concurrency <= 1, "Concurrency", "not supported with a BatchEventHandler")
+		c.check(len(cfg.RetryDelays) == 0, "RetryDelays", "not supported with a BatchEventHandler")
+		c.check(cfg.ContextEventHandler == nil, "ContextEventHandler", "not supported with a BatchEventHandler")
+		c.check(len(cfg.Middlewares) == 0, "Middlewares", "not supported with a BatchEventHandler")
+		if cfg.BisectBatches {
+			c.check(cfg.MaxRetries > 0, "MaxRetries", "must be positive with BisectBatches, failing batches are retried forever otherwise")
+		}
+	}
+	cfg.Security.validate(&c)
+	return c.err()
+}
+
+func (sc SecurityConfig) validate(c *configChecker) {
+	if sc.TLS.Enable {
+		c.check((sc.TLS.CertFile == "") == (sc.TLS.KeyFile == ""), "Security.TLS", "CertFile and KeyFile go together")
+	}
+	if sc.SASL.Enable {
+		c.check(sc.SASL.User != "", "Security.SASL.User", "required")
+		if !sc.SASL.Mechanism.supported() {
+			c.check(false, "Security.SASL.Mechanism", (&UnsupportedSASLMechanismError{sc.SASL.Mechanism}).Error())
+		}
+	}
+}
+
+// schemaRegistryClient the configured client, or one for SchemaRegistryURL
+func schemaRegistryClient(client SchemaRegistryClient, url string) SchemaRegistryClient {
+	if client != nil {
+		return client
+	}
+	return NewSchemaRegistryManager(url, NewCacheSchemaRegistry(), http.DefaultClient)
+}
+
+// ProducerOption sets a field of a ProducerConfig
+type ProducerOption func(*ProducerConfig) error
+
+// NewProducerConfig the default configuration with the options applied in order
+func NewProducerConfig(opts ...ProducerOption) (ProducerConfig, error) {
+	cfg := DefaultProducerConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// ProducerBrokers sets Addrs
+func ProducerBrokers(addrs ...string) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.Addrs = addrs
+		return nil
+	}
+}
+
+// ProducerClientID sets ClientID
+func ProducerClientID(clientID string) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.ClientID = clientID
+		return nil
+	}
+}
+
+// ProducerVersion sets Version
+func ProducerVersion(version sarama.KafkaVersion) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.Version = version
+		return nil
+	}
+}
+
+// ProducerRequiredAcks sets RequiredAcks
+func ProducerRequiredAcks(acks sarama.RequiredAcks) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.RequiredAcks = acks
+		return nil
+	}
+}
+
+// ProducerCompression sets Compression
+func ProducerCompression(codec sarama.CompressionCodec) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.Compression = codec
+		return nil
+	}
+}
+
+// ProducerSchemaRegistry sets SchemaRegistryClient
+func ProducerSchemaRegistry(client SchemaRegistryClient) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.SchemaRegistryClient = client
+		return nil
+	}
+}
+
+// ProducerSecurity sets Security
+func ProducerSecurity(security SecurityConfig) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.Security = security
+		return nil
+	}
+}
+
+// ProducerTransactionalID sets TransactionalID
+func ProducerTransactionalID(id string) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		cfg.TransactionalID = id
+		return nil
+	}
+}
+
+// ProducerConfigFile sets the fields of a JSON or YAML file, see LoadProducerConfig
+func ProducerConfigFile(path string) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		s, err := readSettingsFile(path)
+		if err != nil {
+			return err
+		}
+		return s.apply(cfg.settings())
+	}
+}
+
+// ProducerEnv sets the fields of the environment variables, see ProducerConfigFromEnv
+func ProducerEnv(prefix string) ProducerOption {
+	return func(cfg *ProducerConfig) error {
+		setters := cfg.settings()
+		return envSettings(prefix, setters).apply(setters)
+	}
+}
+
+// ConsumerOption sets a field of a ConsumerConfig
+type ConsumerOption func(*ConsumerConfig) error
+
+// NewConsumerConfig the default configuration with the options applied in order
+func NewConsumerConfig(opts ...ConsumerOption) (ConsumerConfig, error) {
+	cfg := DefaultKafkaRegistryConsumerGroupCfg()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// ConsumerBrokers sets KafkaBrokers
+func ConsumerBrokers(addrs ...string) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.KafkaBrokers = addrs
+		return nil
+	}
+}
+
+// ConsumerName sets Name, the consumer group
+func ConsumerName(name string) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.Name = name
+		return nil
+	}
+}
+
+// ConsumerTopics sets Topics
+func ConsumerTopics(topics ...string) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.Topics = topics
+		return nil
+	}
+}
+
+// ConsumerOffset sets Offset
+func ConsumerOffset(offset int64) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.Offset = offset
+		return nil
+	}
+}
+
+// ConsumerVersion sets Version
+func ConsumerVersion(version sarama.KafkaVersion) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.Version = version
+		return nil
+	}
+}
+
+// ConsumerSchemaRegistry sets SchemaRegistryClient
+func ConsumerSchemaRegistry(client SchemaRegistryClient) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.SchemaRegistryClient = client
+		return nil
+	}
+}
+
+// ConsumerSecurity sets Security
+func ConsumerSecurity(security SecurityConfig) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.Security = security
+		return nil
+	}
+}
+
+// ConsumerEventHandler sets EventHandler
+func ConsumerEventHandler(handler EventHandler) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.EventHandler = handler
+		return nil
+	}
+}
+
+// ConsumerContextEventHandler sets ContextEventHandler
+func ConsumerContextEventHandler(handler ContextEventHandler) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.ContextEventHandler = handler
+		return nil
+	}
+}
+
+// ConsumerErrorHandler sets ErrorHandler
+func ConsumerErrorHandler(handler ErrorHandler) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		cfg.ErrorHandler = handler
+		return nil
+	}
+}
+
+// ConsumerConfigFile sets the fields of a JSON or YAML file, see LoadConsumerConfig
+func ConsumerConfigFile(path string) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		s, err := readSettingsFile(path)
+		if err != nil {
+			return err
+		}
+		return s.apply(cfg.settings())
+	}
+}
+
+// ConsumerEnv sets the fields of the environment variables, see ConsumerConfigFromEnv
+func ConsumerEnv(prefix string) ConsumerOption {
+	return func(cfg *ConsumerConfig) error {
+		setters := cfg.settings()
+		return envSettings(prefix, setters).apply(setters)
+	}
+}
+
+// LoadProducerConfig the default configuration with the settings of a JSON,
+// or YAML, file. Keys are the snake case field names, nested for Security:
+//
+//	brokers: [kafka-1:9092, kafka-2:9092]
+//	client_id: employees
+//	compression: lz4
+//	required_acks: all
+//	version: 1.0.0
+//	schema_registry_url: http://registry:8081
+//	security:
+//	  tls:
+//	    enable: true
+//	    ca_file: /etc/kafka/ca.pem
+func LoadProducerConfig(path string) (ProducerConfig, error) {
+	return NewProducerConfig(ProducerConfigFile(path))
+}
+
+// ProducerConfigFromEnv the default configuration with the settings of the
+// environment variables named after the file keys, like PREFIX_CLIENT_ID or
+// PREFIX_SECURITY_SASL_USER. Lists are comma separated.
+func ProducerConfigFromEnv(prefix string) (ProducerConfig, error) {
+	return NewProducerConfig(ProducerEnv(prefix))
+}
+
+// LoadConsumerConfig the default configuration with the settings of a JSON,
+// or YAML, file, with the keys described in LoadProducerConfig
+func LoadConsumerConfig(path string) (ConsumerConfig, error) {
+	return NewConsumerConfig(ConsumerConfigFile(path))
+}
+
+// ConsumerConfigFromEnv the default configuration with the settings of the
+// environment variables, as ProducerConfigFromEnv
+func ConsumerConfigFromEnv(prefix string) (ConsumerConfig, error) {
+	return NewConsumerConfig(ConsumerEnv(prefix))
+}
+
+func (cfg *ProducerConfig) settings() map[string]setter {
+	setters := map[string]setter{
+		"brokers":             listSetter(&cfg.Addrs),
+		"client_id":           stringSetter(&cfg.ClientID),
+		"max_retries":         intSetter(&cfg.MaxRetries),
+		"required_acks":       acksSetter(&cfg.RequiredAcks),
+		"compression":         compressionSetter(&cfg.Compression),
+		"version":             versionSetter(&cfg.Version),
+		"schema_registry_url": stringSetter(&cfg.SchemaRegistryURL),
+		"validate_events":     boolSetter(&cfg.ValidateEvents),
+		"cloud_events":        cloudEventsSetter(&cfg.CloudEvents),
+		"cloud_events_source": stringSetter(&cfg.CloudEventsSource),
+		"max_in_flight":       intSetter(&cfg.MaxInFlight),
+		"idempotent":          boolSetter(&cfg.Idempotent),
+		"transactional_id":    stringSetter(&cfg.TransactionalID),
+		"transaction_timeout": durationSetter(&cfg.TransactionTimeout),
+	}
+	cfg.Security.settings(setters)
+	return setters
+}
+
+func (cfg *ConsumerConfig) settings() map[string]setter {
+	setters := map[string]setter{
+		"brokers":              listSetter(&cfg.KafkaBrokers),
+		"name":                 stringSetter(&cfg.Name),
+		"topics":               listSetter(&cfg.Topics),
+		"offset":               offsetSetter(&cfg.Offset),
+		"version":              versionSetter(&cfg.Version),
+		"processing_timeout":   durationSetter(&cfg.ProcessingTimeout),
+		"schema_registry_url":  stringSetter(&cfg.SchemaRegistryURL),
+		"error_threshold":      intSetter(&cfg.ErrorThreshold),
+		"max_retries":          intSetter(&cfg.MaxRetries),
+		"max_interval_seconds": intSetter(&cfg.MaxIntervalSeconds),
+		"deliver_tombstones":   boolSetter(&cfg.DeliverTombstones),
+		"dead_letter_topic":    stringSetter(&cfg.DeadLetterTopic),
+		"retry_delays":         durationListSetter(&cfg.RetryDelays),
+		"concurrency":          intSetter(&cfg.Concurrency),
+		"batch_size":           intSetter(&cfg.BatchSize),
+		"batch_max_delay":      durationSetter(&cfg.BatchMaxDelay),
+		"bisect_batches":       boolSetter(&cfg.BisectBatches),
+		"commit_strategy":      commitStrategySetter(&cfg.CommitStrategy),
+		"commit_every":         intSetter(&cfg.CommitEvery),
+		"commit_interval":      durationSetter(&cfg.CommitInterval),
+	}
+	cfg.Security.settings(setters)
+	return setters
+}
+
+func (sc *SecurityConfig) settings(setters map[string]setter) {
+	setters["security.tls.enable"] = boolSetter(&sc.TLS.Enable)
+	setters["security.tls.ca_file"] = stringSetter(&sc.TLS.CAFile)
+	setters["security.tls.cert_file"] = stringSetter(&sc.TLS.CertFile)
+	setters["security.tls.key_file"] = stringSetter(&sc.TLS.KeyFile)
+	setters["security.tls.insecure_skip_verify"] = boolSetter(&sc.TLS.InsecureSkipVerify)
+	setters["security.sasl.enable"] = boolSetter(&sc.SASL.Enable)
+	setters["security.sasl.mechanism"] = func(value string) error {
+		sc.SASL.Mechanism = SASLMechanism(strings.ToUpper(value))
+		return nil
+	}
+	setters["security.sasl.user"] = stringSetter(&sc.SASL.User)
+	setters["security.sasl.password"] = stringSetter(&sc.SASL.Password)
+}
+
+// durationListSetter accepts a comma separated list of durations
+func durationListSetter(list *[]time.Duration) setter {
+	return func(value string) error {
+		var items []string
+		if err := listSetter(&items)(value); err != nil {
+			return err
+		}
+		*list = nil
+		for _, item := range items {
+			parsed, err := time.ParseDuration(item)
+			if err != nil {
+				return err
+			}
+			*list = append(*list, parsed)
+		}
+		return nil
+	}
+}
+
+// durationSetter accepts time.ParseDuration values, like 30s
+func durationSetter(d *time.Duration) setter {
+	return func(value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+		return nil
+	}
+}
+
+// acksSetter accepts none, local and all, or their numbers
+func acksSetter(acks *sarama.RequiredAcks) setter {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "none", "0":
+			*acks = sarama.NoResponse
+		case "local", "1":
+			*acks = sarama.WaitForLocal
+		case "all", "-1":
+			*acks = sarama.WaitForAll
+		default:
+			return fmt.Errorf("unknown required acks: %s", value)
+		}
+		return nil
+	}
+}
+
+func compressionSetter(codec *sarama.CompressionCodec) setter {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "none", "":
+			*codec = sarama.CompressionNone
+		case "gzip":
+			*codec = sarama.CompressionGZIP
+		case "snappy":
+			*codec = sarama.CompressionSnappy
+		case "lz4":
+			*codec = sarama.CompressionLZ4
+		case "zstd":
+			*codec = sarama.CompressionZSTD
+		default:
+			return fmt.Errorf("unknown compression: %s", value)
+		}
+		return nil
+	}
+}
+
+func cloudEventsSetter(mode *CloudEventsMode) setter {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "disabled", "":
+			*mode = CloudEventsDisabled
+		case "binary":
+			*mode = CloudEventsBinary
+		case "structured":
+			*mode = CloudEventsStructured
+		default:
+			return fmt.Errorf("unknown CloudEvents mode: %s", value)
+		}
+		return nil
+	}
+}
+
+func versionSetter(version *sarama.KafkaVersion) setter {
+	return func(value string) error {
+		parsed, err := sarama.ParseKafkaVersion(value)
+		if err != nil {
+			return err
+		}
+		*version = parsed
+		return nil
+	}
+}
+
+// offsetSetter accepts oldest and newest
+func offsetSetter(offset *int64) setter {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "oldest":
+			*offset = sarama.OffsetOldest
+		case "newest":
+			*offset = sarama.OffsetNewest
+		default:
+			return fmt.Errorf("unknown offset: %s, oldest or newest", value)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package avrostry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// setter parses a setting into a configuration field
+type setter func(value string) error
+
+func stringSetter(s *string) setter {
+	return func(value string) error {
+		*s = value
+		return nil
+	}
+}
+
+func intSetter(n *int) setter {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*n = parsed
+		return nil
+	}
+}
+
+func boolSetter(b *bool) setter {
+	return func(value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*b = parsed
+		return nil
+	}
+}
+
+// listSetter comma separated values
+func listSetter(list *[]string) setter {
+	return func(value string) error {
+		*list = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*list = append(*list, item)
+			}
+		}
+		return nil
+	}
+}
+
+// settings values by dotted key, as read from a file or the environment
+type settings map[string]string
+
+// apply reports every unknown or invalid setting
+func (s settings) apply(setters map[string]setter) error {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var c configChecker
+	for _, key := range keys {
+		set, ok := setters[key]
+		if !ok {
+			c.check(false, key, "unknown setting")
+			continue
+		}
+		if err := set(s[key]); err != nil {
+			c.check(false, key, err.Error())
+		}
+	}
+	return c.err()
+}
+
+// envSettings the variables of the known keys, PREFIX_SECURITY_TLS_ENABLE
+// for security.tls.enable
+func envSettings(prefix string, setters map[string]setter) settings {
+	s := settings{}
+	for key := range setters {
+		name := strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			s[key] = value
+		}
+	}
+	return s
+}
+
+// readSettingsFile JSON, or YAML for the .yaml and .yml extensions
+func readSettingsFile(path string) (settings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file: %s: %s", path, err)
+	}
+
+	s := settings{}
+	s.flatten("", doc)
+	return s, nil
+}
+
+func (s settings) flatten(prefix string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			s.flatten(key, child)
+		}
+	case map[interface{}]interface{}: // nested YAML mappings
+		for key, child := range v {
+			name := fmt.Sprint(key)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			s.flatten(name, child)
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		s[prefix] = strings.Join(items, ",")
+	case nil:
+		s[prefix] = ""
+	default:
+		s[prefix] = fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,174 @@
+package avrostry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func configFields(err error) []string {
+	var fields []string
+	for _, configErr := range err.(ConfigErrors) {
+		fields = append(fields, configErr.Field)
+	}
+	return fields
+}
+
+func TestProducerConfigValidate(t *testing.T) {
+	cfg := DefaultProducerConfig()
+	cfg.Compression = sarama.CompressionCodec(7)
+	cfg.TransactionalID = "counter-1"
+	cfg.TransactionTimeout = 0
+	cfg.Security.SASL = SASLConfig{Enable: true, Mechanism: "GSSAPI", User: "john"}
+
+	_, err := NewKafkaRegistryProducer(cfg)
+	require.Equal(t, []string{"Addrs", "SchemaRegistryClient", "Compression", "TransactionTimeout", "Security.SASL.Mechanism"}, configFields(err))
+
+	cfg, err = NewProducerConfig(
+		ProducerBrokers("kafka:9092"),
+		ProducerSchemaRegistry(NewSchemaRegistryManager("http://registry:8081", NewCacheSchemaRegistry(), nil)),
+		ProducerCompression(sarama.CompressionLZ4),
+	)
+	require.Nil(t, err)
+	require.Nil(t, cfg.Validate())
+
+	config, err := newSaramaProducerConfig(cfg)
+	require.Nil(t, err)
+	require.Equal(t, sarama.CompressionLZ4, config.Producer.Compression)
+
+	cfg.Idempotent = true
+	config, err = newSaramaProducerConfig(cfg)
+	require.Nil(t, err)
+	require.True(t, config.Producer.Idempotent)
+	require.Equal(t, sarama.WaitForAll, config.Producer.RequiredAcks)
+	cfg.MaxRetries = 0
+	require.Equal(t, []string{"MaxRetries"}, configFields(cfg.Validate()))
+
+	cfg.MaxRetries = 3
+	cfg.Compression = sarama.CompressionZSTD
+	require.Equal(t, []string{"Version"}, configFields(cfg.Validate()))
+	cfg.Version = sarama.V2_1_0_0
+	require.Nil(t, cfg.Validate())
+	config, err = newSaramaProducerConfig(cfg)
+	require.Nil(t, err)
+	require.Equal(t, sarama.CompressionZSTD, config.Producer.Compression)
+}
+
+func TestConsumerConfigValidate(t *testing.T) {
+	cfg := DefaultKafkaRegistryConsumerGroupCfg()
+	cfg.EventHandler = nil
+	_, err := NewKafkaStreamReaderRegistry(cfg)
+	require.Equal(t, []string{"KafkaBrokers", "Name", "Topics", "SchemaRegistryClient", "EventHandler"}, configFields(err))
+
+	cfg, err = NewConsumerConfig(
+		ConsumerBrokers("kafka:9092"),
+		ConsumerName("employees"),
+		ConsumerTopics("employees"),
+		ConsumerOffset(sarama.OffsetNewest),
+	)
+	require.Nil(t, err)
+	cfg.SchemaRegistryURL = "http://registry:8081"
+	require.Nil(t, cfg.Validate())
+}
+
+const producerYAML = `
+# producer of the employees service
+brokers:
+  - kafka-1:9092
+  - kafka-2:9092
+client_id: "employees"   # shown in the broker logs
+compression: lz4
+required_acks: all
+version: 1.0.0
+transaction_timeout: 30s
+schema_registry_url: http://registry:8081
+security:
+  tls:
+    enable: true
+    insecure_skip_verify: true
+  sasl:
+    enable: often
+`
+
+func TestLoadProducerConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avrostry")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlFile := filepath.Join(dir, "producer.yaml")
+	require.Nil(t, ioutil.WriteFile(yamlFile, []byte(producerYAML), 0600))
+	jsonFile := filepath.Join(dir, "producer.json")
+	require.Nil(t, ioutil.WriteFile(jsonFile, []byte(`{
+		"brokers": ["kafka-1:9092", "kafka-2:9092"],
+		"client_id": "employees",
+		"compression": "lz4",
+		"required_acks": "all",
+		"version": "1.0.0",
+		"transaction_timeout": "30s",
+		"schema_registry_url": "http://registry:8081",
+		"max_in_flight": 10,
+		"security": {"tls": {"enable": true, "insecure_skip_verify": true}}
+	}`), 0600))
+
+	cfg, err := LoadProducerConfig(jsonFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"kafka-1:9092", "kafka-2:9092"}, cfg.Addrs)
+	require.Equal(t, "employees", cfg.ClientID)
+	require.Equal(t, sarama.CompressionLZ4, cfg.Compression)
+	require.Equal(t, sarama.WaitForAll, cfg.RequiredAcks)
+	require.Equal(t, sarama.V1_0_0_0, cfg.Version)
+	require.Equal(t, 30*time.Second, cfg.TransactionTimeout)
+	require.Equal(t, 10, cfg.MaxInFlight)
+	require.True(t, cfg.Security.TLS.InsecureSkipVerify)
+	require.Nil(t, cfg.Validate())
+
+	// a boolean neither in YAML nor in Go
+	_, err = LoadProducerConfig(yamlFile)
+	require.Equal(t, []string{"security.sasl.enable"}, configFields(err))
+
+	require.Nil(t, ioutil.WriteFile(yamlFile, []byte(producerYAML[:len(producerYAML)-len("  sasl:\n    enable: often\n")]), 0600))
+	fromYAML, err := LoadProducerConfig(yamlFile)
+	require.Nil(t, err)
+	cfg.MaxInFlight = fromYAML.MaxInFlight
+	require.Equal(t, cfg.Addrs, fromYAML.Addrs)
+	require.Equal(t, cfg.ClientID, fromYAML.ClientID)
+	require.Equal(t, cfg.Security, fromYAML.Security)
+	require.Equal(t, cfg.TransactionTimeout, fromYAML.TransactionTimeout)
+
+	require.Nil(t, ioutil.WriteFile(jsonFile, []byte(`{"brokers": "kafka:9092", "acks": "all"}`), 0600))
+	_, err = LoadProducerConfig(jsonFile)
+	require.Equal(t, []string{"acks"}, configFields(err))
+}
+
+func TestConsumerConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		"EMPLOYEES_BROKERS":              "kafka-1:9092, kafka-2:9092",
+		"EMPLOYEES_NAME":                 "employees",
+		"EMPLOYEES_TOPICS":               "employees",
+		"EMPLOYEES_OFFSET":               "newest",
+		"EMPLOYEES_PROCESSING_TIMEOUT":   "1m",
+		"EMPLOYEES_SECURITY_SASL_ENABLE": "true",
+		"EMPLOYEES_SECURITY_SASL_USER":   "john",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	cfg, err := ConsumerConfigFromEnv("EMPLOYEES")
+	require.Nil(t, err)
+	require.Equal(t, []string{"kafka-1:9092", "kafka-2:9092"}, cfg.KafkaBrokers)
+	require.Equal(t, "employees", cfg.Name)
+	require.Equal(t, sarama.OffsetNewest, cfg.Offset)
+	require.Equal(t, time.Minute, cfg.ProcessingTimeout)
+	require.Equal(t, SASLConfig{Enable: true, User: "john"}, cfg.Security.SASL)
+
+	os.Setenv("EMPLOYEES_OFFSET", "latest")
+	_, err = ConsumerConfigFromEnv("EMPLOYEES")
+	require.Equal(t, []string{"offset"}, configFields(err))
+}
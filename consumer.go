@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -14,14 +16,35 @@ import (
 )
 
 type ConsumerMessage struct {
-	Key       []byte
-	Topic     string
-	Partition int32
-	Offset    int64
-	Subject   string
-	Timestamp time.Time
-	Headers   []MessageHeader
-	Event     map[string]interface{}
+	Key        []byte
+	DecodedKey map[string]interface{} // only for keys encoded by a KeyedEvent
+	Topic      string
+	Partition  int32
+	Offset     int64
+	Subject    string
+	Timestamp  time.Time
+	Headers    []MessageHeader
+	Envelope   Envelope    // read from Headers, or from CloudEvent
+	CloudEvent *CloudEvent // nil unless published with the CloudEvents binding
+	Event      map[string]interface{}
+	// A message without value deleting Key from a compacted topic, without
+	// Subject and Event
+	IsTombstone bool
+	// Deliveries from the retry topics before this one, the message keeps
+	// the Topic, Partition and Offset of its first delivery
+	Attempt int
+
+	ctx context.Context
+	ack func() // nil unless CommitManual
+}
+
+// Context of the message, carries its Envelope so the events published
+// with it are correlated with and caused by the message
+func (cm *ConsumerMessage) Context() context.Context {
+	if cm.ctx != nil {
+		return cm.ctx
+	}
+	return ContextWithEnvelope(context.Background(), cm.Envelope)
 }
 
 func (cm *ConsumerMessage) GetFieldValuesFromEvent(fieldsToRetreive map[string]interface{}) error {
@@ -77,13 +100,22 @@ func (cm *ConsumerMessage) GetFieldValuesFromEvent(fieldsToRetreive map[string]i
 }
 
 type DiscardedMessageError struct {
-	msg *ConsumerMessage
+	msg    *ConsumerMessage
+	reason string // given with SendToDeadLetter
 }
 
 func (e *DiscardedMessageError) Error() string {
+	if e.reason != "" {
+		return fmt.Sprintf("discarded message: key: %s, topic: %s, partition: %d, offset: %d: %s", string(e.msg.Key), e.msg.Topic, e.msg.Partition, e.msg.Offset, e.reason)
+	}
 	return fmt.Sprintf("discarded message: key: %s, topic: %s, partition: %d, offset: %d", string(e.msg.Key), e.msg.Topic, e.msg.Partition, e.msg.Offset)
 }
 
+// Reason why the handler discarded the message, empty after MaxRetries
+func (e *DiscardedMessageError) Reason() string {
+	return e.reason
+}
+
 func (e *DiscardedMessageError) Message() *ConsumerMessage {
 	return e.msg
 }
@@ -99,26 +131,64 @@ type ErrorHandler func(error)
 func NullErrorHandler(error) {
 }
 
-type consumerConfig struct {
+type ConsumerConfig struct {
 	KafkaBrokers         []string
 	Name                 string
 	Topics               []string
 	Offset               int64
 	Version              sarama.KafkaVersion
+	Security             SecurityConfig
+	SaramaConfig         *sarama.Config // optional, base for the settings not covered here
 	ProcessingTimeout    time.Duration
 	SchemaRegistryClient SchemaRegistryClient
+	SchemaRegistryURL    string // used without SchemaRegistryClient
 	CacheCodec           *CacheCodec
+	SchemaResolver       *SchemaResolver // optional, named types defined in other subjects
+	DeliverTombstones    bool            // messages without value reach EventHandler, skipped otherwise
 	EventHandler         EventHandler
+	ContextEventHandler  ContextEventHandler // optional, replaces EventHandler
 	ErrorHandler         ErrorHandler
+	// Around the handler, the first one outermost
+	Middlewares []ConsumerMiddleware
 	// If we receive this amount of errors in a row we finish the consumer, 0 to disable
 	ErrorThreshold int
 	// Backoff config
 	MaxRetries         int // 0 for infinite retries
 	MaxIntervalSeconds int // max seconds to sleep between retries
+	// Undecodable messages and the ones discarded after MaxRetries are sent
+	// there with their original bytes and the DeadLetter headers, optional
+	DeadLetterTopic string
+	// Failed messages are sent to a retry topic per delay, see RetryTopic,
+	// instead of being retried in place; replaces MaxRetries and the backoff.
+	// Requires DeadLetterTopic, where messages go after the last delay.
+	RetryDelays []time.Duration
+	// Workers handling messages in parallel, the handler is called
+	// concurrently. Messages of the same key, or partition with
+	// OrderByPartition, keep their order. Offsets are committed up to the
+	// first message not yet handled of each partition. 0 or 1 for one
+	// message at a time.
+	Concurrency int
+	OrderBy     MessageOrder
+	// Replaces EventHandler, gets the messages of a partition in batches of
+	// up to BatchSize, or the ones read within BatchMaxDelay. The batch is
+	// retried and sent to the DeadLetterTopic as a whole; with BisectBatches
+	// a batch failing MaxRetries times, which must be positive then, is split
+	// in halves retried on their own, down to the failing messages. Neither
+	// Middlewares nor a ContextEventHandler go with it.
+	BatchEventHandler BatchEventHandler
+	BatchSize         int
+	BatchMaxDelay     time.Duration
+	BisectBatches     bool
+	// When offsets are committed. A BatchEventHandler supports
+	// CommitEachMessage, CommitEveryN and CommitOnInterval, committing
+	// every batch as a message.
+	CommitStrategy CommitStrategy
+	CommitEvery    int           // messages handled between commits with CommitEveryN
+	CommitInterval time.Duration // optional, replaces SaramaConfig.Consumer.Offsets.CommitInterval
 }
 
-func DefaultKafkaRegistryConsumerGroupCfg() consumerConfig {
-	return consumerConfig{
+func DefaultKafkaRegistryConsumerGroupCfg() ConsumerConfig {
+	return ConsumerConfig{
 		Offset:             sarama.OffsetOldest,
 		Version:            sarama.V0_11_0_0,
 		ProcessingTimeout:  10 * time.Second,
@@ -128,48 +198,138 @@ func DefaultKafkaRegistryConsumerGroupCfg() consumerConfig {
 		ErrorThreshold:     10,
 		MaxRetries:         0,
 		MaxIntervalSeconds: 30,
+		BatchSize:          100,
+		BatchMaxDelay:      time.Second,
+	}
+}
+
+// handler ContextEventHandler, or EventHandler adapted
+func (cfg ConsumerConfig) handler() ContextEventHandler {
+	if cfg.ContextEventHandler != nil {
+		return cfg.ContextEventHandler
 	}
+	return AdaptEventHandler(cfg.EventHandler)
+}
+
+// groupConsumer the methods of cluster.Consumer the consumer group uses
+type groupConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	Partitions() <-chan cluster.PartitionConsumer
+	Notifications() <-chan *cluster.Notification
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
+	CommitOffsets() error
+	Close() error
 }
 
 // KafkaRegistryConsumerGroup Consumer Kafka tool with decoder.
 type KafkaRegistryConsumerGroup struct {
-	cfg        consumerConfig
-	consumer   *cluster.Consumer
-	codec      *KafkaAvroCodec
-	random     *rand.Rand
-	handler    EventHandler
-	errHandler ErrorHandler
+	cfg         ConsumerConfig
+	consumer    groupConsumer
+	codec       *KafkaAvroCodec
+	random      *rand.Rand
+	randomMu    sync.Mutex // random isn't safe for the workers
+	handler     ContextEventHandler
+	errHandler  ErrorHandler
+	republisher sarama.SyncProducer      // dead letters and retries, nil without them
+	retryTopics map[string]time.Duration // delay of each retry topic
+	handlerMu   sync.Mutex
+	nErrors     int32          // kafka errors in a row
+	workers     *workerPool    // nil without Concurrency, or while not reading
+	acks        *offsetTracker // messages not acknowledged with CommitManual, without workers
+	uncommitted int32          // messages marked since the last commit with CommitEveryN
 }
 
 // NewKafkaStreamReaderRegistry Constructor for KafkaRegistryConsumerGroup
-func NewKafkaStreamReaderRegistry(cfg consumerConfig) (*KafkaRegistryConsumerGroup, error) {
-	config := cluster.NewConfig()
-	config.Config.Version = cfg.Version
+func NewKafkaStreamReaderRegistry(cfg ConsumerConfig) (*KafkaRegistryConsumerGroup, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	config, err := newClusterConfig(cfg.SaramaConfig, cfg.Security, cfg.Version)
+	if err != nil {
+		return nil, err
+	}
 	config.Group.Session.Timeout = cfg.ProcessingTimeout
 	config.Consumer.Offsets.Initial = cfg.Offset
-	config.Consumer.Return.Errors = true
+	if cfg.CommitInterval > 0 {
+		config.Consumer.Offsets.CommitInterval = cfg.CommitInterval
+	}
+
+	var republisher sarama.SyncProducer
+	if cfg.DeadLetterTopic != "" || len(cfg.RetryDelays) > 0 {
+		if republisher, err = newRepublisher(cfg.KafkaBrokers, config.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	topics := cfg.Topics
+	retryTopics := map[string]time.Duration{}
+	if len(cfg.RetryDelays) > 0 {
+		config.Group.Mode = cluster.ConsumerModePartitions
+		config.Group.Return.Notifications = true // to stop waiting on released partitions
+		topics = append([]string{}, cfg.Topics...)
+		for _, topic := range cfg.Topics {
+			for _, delay := range cfg.RetryDelays {
+				retryTopics[RetryTopic(topic, delay)] = delay
+				topics = append(topics, RetryTopic(topic, delay))
+			}
+		}
+	}
 
-	consumer, err := cluster.NewConsumer(cfg.KafkaBrokers, cfg.Name, cfg.Topics, config)
+	consumer, err := cluster.NewConsumer(cfg.KafkaBrokers, cfg.Name, topics, config)
 	if err != nil {
+		if republisher != nil {
+			republisher.Close()
+		}
 		return nil, err
 	}
 
-	codec := NewKafkaAvroCodec(cfg.SchemaRegistryClient, cfg.CacheCodec)
+	var acks *offsetTracker
+	if cfg.CommitStrategy == CommitManual {
+		acks = newOffsetTracker()
+	}
+
+	codec := NewKafkaAvroCodecWithResolver(schemaRegistryClient(cfg.SchemaRegistryClient, cfg.SchemaRegistryURL), cfg.CacheCodec, cfg.SchemaResolver)
 	return &KafkaRegistryConsumerGroup{
-		cfg:        cfg,
-		consumer:   consumer,
-		codec:      codec,
-		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
-		handler:    cfg.EventHandler,
-		errHandler: cfg.ErrorHandler}, nil
+		cfg:         cfg,
+		consumer:    consumer,
+		codec:       codec,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		handler:     chainConsumerMiddlewares(cfg.Middlewares, cfg.handler()),
+		errHandler:  cfg.ErrorHandler,
+		republisher: republisher,
+		retryTopics: retryTopics,
+		acks:        acks}, nil
+}
+
+// newClusterConfig the consumer group settings over base, with security
+func newClusterConfig(base *sarama.Config, security SecurityConfig, version sarama.KafkaVersion) (*cluster.Config, error) {
+	config := cluster.NewConfig()
+	if base != nil {
+		config.Config = *base
+	}
+	if err := security.apply(&config.Config); err != nil {
+		return nil, err
+	}
+	config.Config.Version = version
+	config.Consumer.Return.Errors = true
+	return config, nil
 }
 
 // ReadMessages read messages from Kafka, decode them and propagete them
 // to handler, only returns when context is cancelled
 func (rgc *KafkaRegistryConsumerGroup) ReadMessages(ctx context.Context) error {
-	var (
-		nErrors int
-	)
+	if rgc.cfg.Concurrency > 1 {
+		ctx = rgc.startWorkers(ctx)
+		defer rgc.stopWorkers()
+	}
+	if len(rgc.cfg.RetryDelays) > 0 {
+		return rgc.readPartitions(ctx)
+	}
+	if rgc.cfg.BatchEventHandler != nil {
+		return rgc.readBatches(ctx)
+	}
 
 	for {
 		select {
@@ -180,112 +340,331 @@ func (rgc *KafkaRegistryConsumerGroup) ReadMessages(ctx context.Context) error {
 			if !ok {
 				return io.ErrClosedPipe
 			}
-			
-			nErrors++
-			if rgc.cfg.ErrorThreshold > 0 && nErrors >= rgc.cfg.ErrorThreshold {
-				return errors.New("too many kafka errors")
+			if err := rgc.kafkaError(err); err != nil {
+				return err
 			}
 
-			rgc.errHandler(errors.Wrap(err, "received error from kafka"))
-
 		case msg, ok := <-rgc.consumer.Messages():
 			if !ok {
 				return io.ErrClosedPipe
 			}
-
-			if msg.Value == nil {
-				break
-			}
-
-			nErrors = 0
-
-			var (
-				eventMap       map[string]interface{}
-				consumerMsg    *ConsumerMessage
-				retry          int
-				backoff        float64
-				maxBackoff     bool
-				messageHeaders []MessageHeader
-			)
-
-			// Taking message headers
-			if len(msg.Headers) > 0 {
-				messageHeaders = make([]MessageHeader, len(msg.Headers))
-				for z, h := range msg.Headers {
-					messageHeaders[z] = MessageHeader{
-						Key:   string(h.Key),
-						Value: string(h.Value),
-					}
+			if err := rgc.consume(ctx, msg); err != nil {
+				if ctx.Err() != nil {
+					return nil
 				}
+				return err
 			}
 
-			subject, event, err := rgc.codec.Decode(msg.Value)
-			if err != nil {
-				rgc.errHandler(errors.Wrap(err, "could not decode message"))
-				goto commit
-			}
+		case err := <-rgc.workers.failed():
+			return err
+		}
+	}
+}
 
-			eventMap, ok = event.(map[string]interface{})
-			if !ok {
-				rgc.errHandler(errors.Errorf("unexpected message format for subject: %s", subject))
-				goto commit
-			}
+// kafkaError reports err, failing after ErrorThreshold errors in a row
+func (rgc *KafkaRegistryConsumerGroup) kafkaError(err error) error {
+	nErrors := atomic.AddInt32(&rgc.nErrors, 1)
+	if rgc.cfg.ErrorThreshold > 0 && int(nErrors) >= rgc.cfg.ErrorThreshold {
+		return errors.New("too many kafka errors")
+	}
 
-			consumerMsg = &ConsumerMessage{
-				Key:       msg.Key,
-				Topic:     msg.Topic,
-				Partition: msg.Partition,
-				Offset:    msg.Offset,
-				Subject:   subject,
-				Timestamp: msg.Timestamp,
-				Event:     eventMap,
-				Headers:   messageHeaders,
-			}
+	rgc.errHandler(errors.Wrap(err, "received error from kafka"))
+	return nil
+}
 
-			for {
-				if rgc.cfg.MaxRetries > 0 && retry >= rgc.cfg.MaxRetries {
-					rgc.errHandler(&DiscardedMessageError{consumerMsg})
-					break // max num of retries reached, commit message anyway
-				}
+// process decodes msg and hands it to the handler, retrying it in place or
+// through the retry topics. Errors stop the consumer, msg must not be
+// committed then, nor when acked is false: the handler commits it with
+// ConsumerMessage.Ack.
+func (rgc *KafkaRegistryConsumerGroup) process(ctx context.Context, msg *sarama.ConsumerMessage) (acked bool, err error) {
+	if msg.Value == nil && !rgc.cfg.DeliverTombstones {
+		return true, nil
+	}
 
-				// As long as handler returns false we retry the same message.
-				// Clients must know in which situation messages cannnot be commited
-				// and should stop the consumption loop.
+	atomic.StoreInt32(&rgc.nErrors, 0)
 
-				shouldCommit := rgc.handler(consumerMsg)
-				if shouldCommit {
-					break
-				}
+	var (
+		consumerMsg  *ConsumerMessage
+		result       Result
+		handled      bool
+		failure      error // the message goes to the dead letter topic
+		attempts     int
+		firstFailure time.Time
+		state        = parseRetryState(msg)
+	)
 
-				if !maxBackoff {
-					retry++
-					backoff = float64(uint(1) << uint(retry))         // 2 ^ retry
-					backoff += backoff * (0.1 * rgc.random.Float64()) // add a maximum of 10%
-					if backoff > float64(rgc.cfg.MaxIntervalSeconds) {
-						backoff = float64(rgc.cfg.MaxIntervalSeconds)
-						maxBackoff = true
-					}
-				}
+	consumerMsg, failure = rgc.decode(ctx, msg)
+	if failure != nil {
+		rgc.errHandler(failure)
+		goto commit
+	}
+	if rgc.cfg.CommitStrategy == CommitManual {
+		consumerMsg.ack = rgc.acker(msg)
+	}
 
-				select {
-				case <-time.After(time.Second * time.Duration(backoff)):
-					break
-				case <-ctx.Done():
-					return nil
+	if len(rgc.cfg.RetryDelays) > 0 {
+		result, handled = rgc.handle(consumerMsg), true
+		switch result.action {
+		case actionStop:
+			return false, rgc.stopped(consumerMsg, result)
+		case actionDeadLetter:
+			attempts, firstFailure = state.attempt+1, state.firstFailure
+			failure = errors.New(result.reason)
+			rgc.errHandler(&DiscardedMessageError{msg: consumerMsg, reason: result.reason})
+		case actionRetry:
+			if state.attempt < len(rgc.cfg.RetryDelays) {
+				if err = rgc.sendRetry(msg, state); err != nil {
+					return false, err // not committed, read again after restart
 				}
+				goto commit
 			}
+			attempts, firstFailure = state.attempt+1, state.firstFailure
+			failure = errors.Errorf("not processed after %d attempts", attempts)
+			rgc.errHandler(&DiscardedMessageError{msg: consumerMsg})
+		}
+		goto commit
+	}
+
+	for {
+		if rgc.cfg.MaxRetries > 0 && attempts >= rgc.cfg.MaxRetries {
+			failure = errors.Errorf("not processed after %d attempts", attempts)
+			rgc.errHandler(&DiscardedMessageError{msg: consumerMsg})
+			break // max num of retries reached, commit message anyway
+		}
+
+		// As long as handler returns Retry we retry the same message.
+		// Clients must know in which situation messages cannnot be commited
+		// and should stop the consumption loop.
+
+		result, handled = rgc.handle(consumerMsg), true
+		if result.action != actionRetry {
+			break
+		}
+		if attempts == 0 {
+			firstFailure = time.Now()
+		}
+		attempts++
+
+		if result.after > 0 {
+			err = sleep(ctx, result.after)
+		} else {
+			err = rgc.backoff(ctx, attempts)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch result.action {
+	case actionStop:
+		return false, rgc.stopped(consumerMsg, result)
+	case actionDeadLetter:
+		if attempts == 0 {
+			firstFailure = time.Now()
+		}
+		attempts++
+		failure = errors.New(result.reason)
+		rgc.errHandler(&DiscardedMessageError{msg: consumerMsg, reason: result.reason})
+	}
+
+commit:
+	if failure != nil && rgc.republisher != nil && rgc.cfg.DeadLetterTopic != "" {
+		if err = rgc.sendDeadLetter(msg, failure, attempts, firstFailure); err != nil {
+			return false, err // not committed, read again after restart
+		}
+	}
+	return !handled || result.action != actionAck || rgc.cfg.CommitStrategy != CommitManual, nil
+}
+
+// decode msg as handed to the handler, the error means it can't be handled
+func (rgc *KafkaRegistryConsumerGroup) decode(ctx context.Context, msg *sarama.ConsumerMessage) (*ConsumerMessage, error) {
+	var (
+		eventMap       map[string]interface{}
+		messageHeaders []MessageHeader
+		cloudEvent     *CloudEvent
+		value          = msg.Value
+		subject        string
+		event          interface{}
+		ok             bool
+		err            error
+		state          = parseRetryState(msg)
+	)
 
-		commit:
-			// commit message, this prevents read message multiple times after restart
-			rgc.consumer.MarkOffset(msg, "")
-			err = rgc.consumer.CommitOffsets()
-			if err != nil {
-				rgc.errHandler(errors.Wrap(err, "could not commit message"))
+	// Taking message headers
+	if len(msg.Headers) > 0 {
+		messageHeaders = make([]MessageHeader, len(msg.Headers))
+		for z, h := range msg.Headers {
+			messageHeaders[z] = MessageHeader{
+				Key:   string(h.Key),
+				Value: string(h.Value),
 			}
 		}
 	}
+
+	// Tombstones have no event to decode
+	if msg.Value != nil {
+		cloudEvent, err = parseCloudEvent(messageHeaders, msg.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read CloudEvent")
+		}
+		if cloudEvent != nil {
+			value = cloudEvent.Data
+		}
+
+		subject, event, err = rgc.codec.Decode(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode message")
+		}
+
+		eventMap, ok = event.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("unexpected message format for subject: %s", subject)
+		}
+	}
+
+	consumerMsg := &ConsumerMessage{
+		Key:        msg.Key,
+		Topic:      msg.Topic,
+		Partition:  msg.Partition,
+		Offset:     msg.Offset,
+		Subject:    subject,
+		Timestamp:  msg.Timestamp,
+		Event:      eventMap,
+		Headers:    messageHeaders,
+		CloudEvent: cloudEvent,
+
+		IsTombstone: msg.Value == nil,
+	}
+	if state.attempt > 0 {
+		consumerMsg.Topic, consumerMsg.Partition, consumerMsg.Offset = state.topic, state.partition, state.offset
+		consumerMsg.Attempt = state.attempt
+	}
+	if cloudEvent != nil {
+		consumerMsg.Envelope = cloudEvent.Envelope()
+	} else if consumerMsg.Envelope, err = ParseEnvelope(messageHeaders); err != nil {
+		rgc.errHandler(errors.Wrap(err, "could not parse message envelope"))
+	}
+	consumerMsg.ctx = ContextWithEnvelope(ctx, consumerMsg.Envelope)
+
+	if IsEncoded(msg.Key) {
+		consumerMsg.DecodedKey, err = rgc.decodeKey(msg.Key)
+		if err != nil {
+			rgc.errHandler(errors.Wrap(err, "could not decode message key"))
+		}
+	}
+	return consumerMsg, nil
+}
+
+// backoff waits before retry, 2^retry seconds plus up to 10%, at most
+// MaxIntervalSeconds
+func (rgc *KafkaRegistryConsumerGroup) backoff(ctx context.Context, retry int) error {
+	seconds := float64(rgc.cfg.MaxIntervalSeconds)
+	if retry < 32 {
+		rgc.randomMu.Lock()
+		backoff := float64(uint(1) << uint(retry))        // 2 ^ retry
+		backoff += backoff * (0.1 * rgc.random.Float64()) // add a maximum of 10%
+		rgc.randomMu.Unlock()
+		if backoff < seconds {
+			seconds = backoff
+		}
+	}
+
+	return sleep(ctx, time.Second*time.Duration(seconds))
+}
+
+// sleep waits d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// consume processes msg and commits it, or hands it to a worker with Concurrency
+func (rgc *KafkaRegistryConsumerGroup) consume(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	if rgc.cfg.CommitStrategy == CommitAtMostOnce {
+		rgc.commit(msg.Topic, msg.Partition, msg.Offset)
+	}
+	if rgc.workers != nil {
+		return rgc.workers.dispatch(ctx, msg)
+	}
+	if rgc.acks != nil {
+		rgc.acks.start(msg.Topic, msg.Partition, msg.Offset)
+	}
+	acked, err := rgc.process(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if acked {
+		rgc.finish(rgc.acks, msg)
+	}
+	return nil
+}
+
+// handle calls the handler within the ProcessingTimeout, one message at a
+// time without Concurrency
+func (rgc *KafkaRegistryConsumerGroup) handle(msg *ConsumerMessage) Result {
+	ctx, cancel := context.WithTimeout(msg.Context(), rgc.cfg.ProcessingTimeout)
+	defer cancel()
+	if rgc.workers == nil {
+		rgc.handlerMu.Lock()
+		defer rgc.handlerMu.Unlock()
+	}
+	return rgc.handler(ctx, msg)
+}
+
+// stopped the error stopping the consumer for msg
+func (rgc *KafkaRegistryConsumerGroup) stopped(msg *ConsumerMessage, result Result) error {
+	err := result.err
+	if err == nil {
+		err = errors.New("stopped by the handler")
+	}
+	return errors.Wrapf(err, "handler stopped the consumer: topic: %s, partition: %d, offset: %d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// sendDeadLetter sends msg to the dead letter topic, it failed attempts times
+// since firstFailure, or couldn't be decoded
+func (rgc *KafkaRegistryConsumerGroup) sendDeadLetter(msg *sarama.ConsumerMessage, failure error, attempts int, firstFailure time.Time) error {
+	now := time.Now()
+	if firstFailure.IsZero() {
+		firstFailure = now
+	}
+	dl := DeadLetter{
+		Reason:       failure.Error(),
+		Attempts:     attempts,
+		Topic:        msg.Topic,
+		Partition:    msg.Partition,
+		Offset:       msg.Offset,
+		FirstFailure: firstFailure,
+		LastFailure:  now,
+	}
+	if state := parseRetryState(msg); state.attempt > 0 {
+		dl.Topic, dl.Partition, dl.Offset = state.topic, state.partition, state.offset
+	}
+	_, _, err := rgc.republisher.SendMessage(deadLetterMessage(rgc.cfg.DeadLetterTopic, msg, dl))
+	return errors.Wrapf(err, "could not send message to dead letter topic: %s", rgc.cfg.DeadLetterTopic)
+}
+
+func (rgc *KafkaRegistryConsumerGroup) decodeKey(buf []byte) (map[string]interface{}, error) {
+	subject, key, err := rgc.codec.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	keyMap, ok := key.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected key format for subject: %s", subject)
+	}
+	return keyMap, nil
 }
 
 func (rgc *KafkaRegistryConsumerGroup) Close() error {
-	return rgc.consumer.Close()
+	err := rgc.consumer.Close()
+	if rgc.republisher != nil {
+		if perr := rgc.republisher.Close(); err == nil {
+			err = perr
+		}
+	}
+	return err
 }
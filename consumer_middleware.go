@@ -0,0 +1,124 @@
+package avrostry
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// ConsumerMiddleware wraps the handler of the messages. It sees the message
+// before the handler, can change it, its context or not call next at all,
+// and decides on the Result of next.
+type ConsumerMiddleware func(next ContextEventHandler) ContextEventHandler
+
+func chainConsumerMiddlewares(middlewares []ConsumerMiddleware, handler ContextEventHandler) ContextEventHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RecoverMiddleware turns a panic of the handler into the Result of onPanic,
+// SendToDeadLetter with the panic and its stack when nil
+func RecoverMiddleware(onPanic func(msg *ConsumerMessage, recovered interface{}) Result) ConsumerMiddleware {
+	if onPanic == nil {
+		onPanic = func(_ *ConsumerMessage, recovered interface{}) Result {
+			return SendToDeadLetter(fmt.Sprintf("handler panic: %v\n%s", recovered, debug.Stack()))
+		}
+	}
+	return func(next ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) (result Result) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					result = onPanic(msg, recovered)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// ConsumerLoggingMiddleware logs every message handled with its Result
+func ConsumerLoggingMiddleware(logger sarama.StdLogger) ConsumerMiddleware {
+	return func(next ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) Result {
+			start := time.Now()
+			result := next(ctx, msg)
+			logger.Printf("handled message: %s, id: %s, topic: %s, partition: %d, offset: %d, attempt: %d, result: %s, in %s",
+				msg.Subject, msg.Envelope.EventID, msg.Topic, msg.Partition, msg.Offset, msg.Attempt, result, time.Since(start))
+			return result
+		}
+	}
+}
+
+// ConsumerMetricsMiddleware records in registry the handle-latency timer and
+// the handle-failure-rate meter of the Retry, SendToDeadLetter and Stop
+// results, for every topic and per topic with the -for-topic-<topic> suffix
+func ConsumerMetricsMiddleware(registry metrics.Registry) ConsumerMiddleware {
+	return func(next ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) Result {
+			start := time.Now()
+			result := next(ctx, msg)
+			elapsed := time.Since(start)
+			for _, suffix := range []string{"", "-for-topic-" + msg.Topic} {
+				metrics.GetOrRegisterTimer("handle-latency"+suffix, registry).Update(elapsed)
+				if result.failed() {
+					metrics.GetOrRegisterMeter("handle-failure-rate"+suffix, registry).Mark(1)
+				}
+			}
+			return result
+		}
+	}
+}
+
+// TimeoutMiddleware shortens the context of the handler to timeout, it is
+// up to the handler to give up when it is done
+func TimeoutMiddleware(timeout time.Duration) ConsumerMiddleware {
+	return func(next ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) Result {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// RateLimitMiddleware calls the handler at most perSecond times a second,
+// the messages waiting longer than their context are retried. It panics
+// when perSecond is not positive.
+func RateLimitMiddleware(perSecond float64) ConsumerMiddleware {
+	if !(perSecond > 0) {
+		panic(fmt.Sprintf("avrostry: RateLimitMiddleware: perSecond must be positive, got %v", perSecond))
+	}
+	var (
+		mu       sync.Mutex
+		next     time.Time
+		interval = time.Duration(float64(time.Second) / perSecond)
+	)
+	return func(handler ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) Result {
+			mu.Lock()
+			now := time.Now()
+			if next.Before(now) {
+				next = now
+			}
+			wait := next.Sub(now)
+			next = next.Add(interval)
+			mu.Unlock()
+
+			if wait > 0 && sleep(ctx, wait) != nil {
+				// give the slot back, the handler wasn't called
+				mu.Lock()
+				next = next.Add(-interval)
+				mu.Unlock()
+				return Retry(0)
+			}
+			return handler(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package avrostry
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumerMiddlewares(t *testing.T) {
+	var (
+		logs     bytes.Buffer
+		registry = metrics.NewRegistry()
+		calls    []string
+		errs     []error
+		deadline time.Time
+	)
+	recorder := func(name string) ConsumerMiddleware {
+		return func(next ContextEventHandler) ContextEventHandler {
+			return func(ctx context.Context, msg *ConsumerMessage) Result {
+				calls = append(calls, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	handler := func(ctx context.Context, msg *ConsumerMessage) Result {
+		deadline, _ = ctx.Deadline()
+		if msg.Offset == 3 {
+			panic("nil employee")
+		}
+		return Ack()
+	}
+	rgc := resultConsumer(chainConsumerMiddlewares([]ConsumerMiddleware{
+		recorder("outer"),
+		ConsumerLoggingMiddleware(log.New(&logs, "", 0)),
+		ConsumerMetricsMiddleware(registry),
+		RecoverMiddleware(nil),
+		TimeoutMiddleware(time.Second),
+		recorder("inner"),
+	}, handler), &errs)
+
+	tombstone := &sarama.ConsumerMessage{Topic: "words", Offset: 1, Key: []byte("1")}
+	requireProcessed(t, rgc, tombstone)
+	require.Equal(t, []string{"outer", "inner"}, calls)
+	require.WithinDuration(t, time.Now().Add(time.Second), deadline, 500*time.Millisecond)
+	require.Contains(t, logs.String(), "topic: words, partition: 0, offset: 1, attempt: 0, result: ack")
+
+	tombstone.Offset = 3
+	requireProcessed(t, rgc, tombstone)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].(*DiscardedMessageError).Reason(), "handler panic: nil employee")
+	require.Contains(t, logs.String(), "offset: 3, attempt: 0, result: dead letter: handler panic")
+
+	require.Equal(t, int64(2), metrics.GetOrRegisterTimer("handle-latency-for-topic-words", registry).Count())
+	require.Equal(t, int64(1), metrics.GetOrRegisterMeter("handle-failure-rate", registry).Count())
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	handler := RateLimitMiddleware(100)(func(context.Context, *ConsumerMessage) Result {
+		return Ack()
+	})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.Equal(t, Ack(), handler(context.Background(), &ConsumerMessage{}))
+	}
+	require.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, Retry(0), handler(ctx, &ConsumerMessage{}))
+
+	// the cancelled messages don't keep their slots
+	handler = RateLimitMiddleware(10)(func(context.Context, *ConsumerMessage) Result {
+		return Ack()
+	})
+	require.Equal(t, Ack(), handler(context.Background(), &ConsumerMessage{}))
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		require.Equal(t, Retry(0), handler(ctx, &ConsumerMessage{}))
+	}
+	require.Equal(t, Ack(), handler(context.Background(), &ConsumerMessage{}))
+	require.True(t, time.Since(start) < 200*time.Millisecond)
+
+	require.Panics(t, func() { RateLimitMiddleware(0) })
+	require.Panics(t, func() { RateLimitMiddleware(-1) })
+}
@@ -0,0 +1,247 @@
+package avrostry
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/pkg/errors"
+)
+
+// Headers added to the original ones of a message sent to a dead letter topic
+const (
+	DeadLetterHeaderPrefix       = "dead_letter_"
+	DeadLetterReasonHeader       = DeadLetterHeaderPrefix + "reason"
+	DeadLetterAttemptsHeader     = DeadLetterHeaderPrefix + "attempts"
+	DeadLetterTopicHeader        = DeadLetterHeaderPrefix + "topic"
+	DeadLetterPartitionHeader    = DeadLetterHeaderPrefix + "partition"
+	DeadLetterOffsetHeader       = DeadLetterHeaderPrefix + "offset"
+	DeadLetterFirstFailureHeader = DeadLetterHeaderPrefix + "first_failure" // RFC 3339 with nanoseconds
+	DeadLetterLastFailureHeader  = DeadLetterHeaderPrefix + "last_failure"
+)
+
+// DeadLetter why and where from a message was sent to a dead letter topic
+type DeadLetter struct {
+	Reason       string
+	Attempts     int // times the handler failed, 0 for undecodable messages
+	Topic        string
+	Partition    int32
+	Offset       int64
+	FirstFailure time.Time
+	LastFailure  time.Time
+}
+
+// Headers the dead letter headers
+func (dl DeadLetter) Headers() []MessageHeader {
+	return []MessageHeader{
+		{Key: DeadLetterReasonHeader, Value: dl.Reason},
+		{Key: DeadLetterAttemptsHeader, Value: strconv.Itoa(dl.Attempts)},
+		{Key: DeadLetterTopicHeader, Value: dl.Topic},
+		{Key: DeadLetterPartitionHeader, Value: strconv.FormatInt(int64(dl.Partition), 10)},
+		{Key: DeadLetterOffsetHeader, Value: strconv.FormatInt(dl.Offset, 10)},
+		{Key: DeadLetterFirstFailureHeader, Value: dl.FirstFailure.UTC().Format(time.RFC3339Nano)},
+		{Key: DeadLetterLastFailureHeader, Value: dl.LastFailure.UTC().Format(time.RFC3339Nano)},
+	}
+}
+
+// ParseDeadLetter reads the dead letter headers of a message, it fails when
+// they are missing or malformed
+func ParseDeadLetter(headers []MessageHeader) (DeadLetter, error) {
+	var (
+		dl       DeadLetter
+		err      error
+		hasTopic bool
+	)
+	for _, h := range headers {
+		switch h.Key {
+		case DeadLetterReasonHeader:
+			dl.Reason = h.Value
+		case DeadLetterAttemptsHeader:
+			dl.Attempts, err = strconv.Atoi(h.Value)
+		case DeadLetterTopicHeader:
+			dl.Topic, hasTopic = h.Value, true
+		case DeadLetterPartitionHeader:
+			var partition int64
+			partition, err = strconv.ParseInt(h.Value, 10, 32)
+			dl.Partition = int32(partition)
+		case DeadLetterOffsetHeader:
+			dl.Offset, err = strconv.ParseInt(h.Value, 10, 64)
+		case DeadLetterFirstFailureHeader:
+			dl.FirstFailure, err = time.Parse(time.RFC3339Nano, h.Value)
+		case DeadLetterLastFailureHeader:
+			dl.LastFailure, err = time.Parse(time.RFC3339Nano, h.Value)
+		}
+		if err != nil {
+			return dl, errors.Wrapf(err, "malformed header: %s", h.Key)
+		}
+	}
+	if !hasTopic || dl.Topic == "" {
+		return dl, errors.Errorf("not a dead letter, %s header missing", DeadLetterTopicHeader)
+	}
+	return dl, nil
+}
+
+// originalHeaders the headers of msg without the dead letter and retry ones
+func originalHeaders(msg *sarama.ConsumerMessage) []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		if h != nil && !strings.HasPrefix(string(h.Key), DeadLetterHeaderPrefix) && !strings.HasPrefix(string(h.Key), RetryHeaderPrefix) {
+			headers = append(headers, *h)
+		}
+	}
+	return headers
+}
+
+// copyMessage a message to topic with the key, value and headers of msg as
+// they were read
+func copyMessage(topic string, msg *sarama.ConsumerMessage, headers []sarama.RecordHeader) *sarama.ProducerMessage {
+	copied := &sarama.ProducerMessage{Topic: topic, Headers: headers}
+	if msg.Key != nil {
+		copied.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if msg.Value != nil {
+		copied.Value = sarama.ByteEncoder(msg.Value)
+	}
+	return copied
+}
+
+// deadLetterMessage msg as sent to the dead letter topic
+func deadLetterMessage(topic string, msg *sarama.ConsumerMessage, dl DeadLetter) *sarama.ProducerMessage {
+	return copyMessage(topic, msg, append(originalHeaders(msg), toRecordHeaders(dl.Headers())...))
+}
+
+// redriveMessage a message of a dead letter topic as sent back to its topic
+func redriveMessage(msg *sarama.ConsumerMessage) (*sarama.ProducerMessage, DeadLetter, error) {
+	headers := make([]MessageHeader, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = MessageHeader{Key: string(h.Key), Value: string(h.Value)}
+	}
+	dl, err := ParseDeadLetter(headers)
+	if err != nil {
+		return nil, dl, err
+	}
+	return copyMessage(dl.Topic, msg, originalHeaders(msg)), dl, nil
+}
+
+// newRepublisher the producer of dead letters and retries with the settings
+// of the consumer
+func newRepublisher(brokers []string, config sarama.Config) (sarama.SyncProducer, error) {
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	return sarama.NewSyncProducer(brokers, &config)
+}
+
+// RedriveConfig DeadLetterRedriver configuration
+type RedriveConfig struct {
+	KafkaBrokers    []string
+	Name            string // consumer group of the redriver, its offsets tell what was redriven
+	DeadLetterTopic string
+	Version         sarama.KafkaVersion
+	Security        SecurityConfig
+	SaramaConfig    *sarama.Config // optional, base for the settings not covered here
+	// Optional, messages it rejects are skipped and stay in the dead letter topic only
+	Filter       func(DeadLetter) bool
+	ErrorHandler ErrorHandler
+}
+
+// DefaultRedriveConfig RedriveConfig defaults
+func DefaultRedriveConfig() RedriveConfig {
+	return RedriveConfig{
+		Version:      sarama.V0_11_0_0,
+		ErrorHandler: NullErrorHandler,
+	}
+}
+
+// Validate reports every invalid field, the redriver constructor calls it
+func (cfg RedriveConfig) Validate() error {
+	var c configChecker
+	c.check(len(cfg.KafkaBrokers) > 0, "KafkaBrokers", "at least one broker is required")
+	c.check(cfg.Name != "", "Name", "the consumer group is required")
+	c.check(cfg.DeadLetterTopic != "", "DeadLetterTopic", "required")
+	c.check(cfg.ErrorHandler != nil, "ErrorHandler", "required")
+	cfg.Security.validate(&c)
+	return c.err()
+}
+
+// DeadLetterRedriver sends the messages of a dead letter topic back to the
+// topics they came from, with their original key, value and headers
+type DeadLetterRedriver struct {
+	cfg      RedriveConfig
+	consumer *cluster.Consumer
+	producer sarama.SyncProducer
+}
+
+// NewDeadLetterRedriver DeadLetterRedriver constructor
+func NewDeadLetterRedriver(cfg RedriveConfig) (*DeadLetterRedriver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := newClusterConfig(cfg.SaramaConfig, cfg.Security, cfg.Version)
+	if err != nil {
+		return nil, err
+	}
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	producer, err := newRepublisher(cfg.KafkaBrokers, config.Config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := cluster.NewConsumer(cfg.KafkaBrokers, cfg.Name, []string{cfg.DeadLetterTopic}, config)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return &DeadLetterRedriver{cfg: cfg, consumer: consumer, producer: producer}, nil
+}
+
+// Run redrives the messages until ctx is cancelled. Messages that aren't dead
+// letters go to the ErrorHandler, a failure to republish stops it without
+// committing the message.
+func (r *DeadLetterRedriver) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err, ok := <-r.consumer.Errors():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			r.cfg.ErrorHandler(errors.Wrap(err, "received error from kafka"))
+
+		case msg, ok := <-r.consumer.Messages():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+
+			redriven, dl, err := redriveMessage(msg)
+			switch {
+			case err != nil:
+				r.cfg.ErrorHandler(errors.Wrapf(err, "could not redrive message: partition: %d, offset: %d", msg.Partition, msg.Offset))
+			case r.cfg.Filter == nil || r.cfg.Filter(dl):
+				if _, _, err = r.producer.SendMessage(redriven); err != nil {
+					return errors.Wrapf(err, "could not redrive message to topic: %s", dl.Topic)
+				}
+			}
+
+			r.consumer.MarkOffset(msg, "")
+			if err = r.consumer.CommitOffsets(); err != nil {
+				r.cfg.ErrorHandler(errors.Wrap(err, "could not commit message"))
+			}
+		}
+	}
+}
+
+// Close stops consuming the dead letter topic
+func (r *DeadLetterRedriver) Close() error {
+	err := r.consumer.Close()
+	if perr := r.producer.Close(); err == nil {
+		err = perr
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package avrostry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+// consumed msg as a consumer would read it
+func consumed(t *testing.T, msg *sarama.ProducerMessage, offset int64) *sarama.ConsumerMessage {
+	read := &sarama.ConsumerMessage{Topic: msg.Topic, Offset: offset}
+	var err error
+	if msg.Key != nil {
+		read.Key, err = msg.Key.Encode()
+		require.Nil(t, err)
+	}
+	if msg.Value != nil {
+		read.Value, err = msg.Value.Encode()
+		require.Nil(t, err)
+	}
+	for i := range msg.Headers {
+		read.Headers = append(read.Headers, &msg.Headers[i])
+	}
+	return read
+}
+
+func TestDeadLetterRoundTrip(t *testing.T) {
+	original := &sarama.ConsumerMessage{
+		Topic:     "words",
+		Partition: 2,
+		Offset:    41,
+		Key:       []byte("1"),
+		Value:     []byte{0, 0, 0, 0, 1, 'x'},
+		Headers:   []*sarama.RecordHeader{{Key: []byte(EventIDHeader), Value: []byte("uno")}},
+	}
+	first := time.Date(2018, 5, 1, 10, 30, 0, 0, time.UTC)
+	dl := DeadLetter{
+		Reason:       "not processed after 3 attempts",
+		Attempts:     3,
+		Topic:        original.Topic,
+		Partition:    original.Partition,
+		Offset:       original.Offset,
+		FirstFailure: first,
+		LastFailure:  first.Add(time.Minute),
+	}
+
+	sent := deadLetterMessage("words.dlq", original, dl)
+	require.Equal(t, "words.dlq", sent.Topic)
+	require.Len(t, sent.Headers, 8)
+	require.Equal(t, []byte(EventIDHeader), sent.Headers[0].Key)
+
+	redriven, parsed, err := redriveMessage(consumed(t, sent, 7))
+	require.Nil(t, err)
+	require.Equal(t, dl, parsed)
+	require.Equal(t, "words", redriven.Topic)
+	require.Equal(t, sarama.ByteEncoder(original.Key), redriven.Key)
+	require.Equal(t, sarama.ByteEncoder(original.Value), redriven.Value)
+	require.Equal(t, []sarama.RecordHeader{*original.Headers[0]}, redriven.Headers)
+
+	// failing again after the redrive replaces the dead letter headers
+	again := deadLetterMessage("words.dlq", consumed(t, redriven, 90), dl)
+	require.Len(t, again.Headers, 8)
+
+	tombstone := deadLetterMessage("words.dlq", &sarama.ConsumerMessage{Topic: "words", Key: []byte("1")}, dl)
+	require.Nil(t, tombstone.Value)
+}
+
+func TestParseDeadLetterErrors(t *testing.T) {
+	_, err := ParseDeadLetter([]MessageHeader{{Key: EventIDHeader, Value: "uno"}})
+	require.Error(t, err)
+
+	_, err = ParseDeadLetter([]MessageHeader{
+		{Key: DeadLetterTopicHeader, Value: "words"},
+		{Key: DeadLetterAttemptsHeader, Value: "three"},
+	})
+	require.Contains(t, err.Error(), DeadLetterAttemptsHeader)
+
+	_, _, err = redriveMessage(&sarama.ConsumerMessage{Topic: "words.dlq", Value: []byte("x")})
+	require.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package dedup
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josgilmo/avrostry/internal/sqltest"
+)
+
+func openMemDB() (*sql.DB, *memDB) {
+	mem := &memDB{keys: map[string]*time.Time{}}
+	return sqltest.Open(mem), mem
+}
+
+// memDB sqltest.Handler understanding the dedup queries
+type memDB struct {
+	sync.Mutex
+	keys map[string]*time.Time // expires_at
+}
+
+func (db *memDB) len() int {
+	db.Lock()
+	defer db.Unlock()
+	return len(db.keys)
+}
+
+func expiresAt(value driver.Value) *time.Time {
+	if value == nil {
+		return nil
+	}
+	at := value.(time.Time)
+	return &at
+}
+
+func (db *memDB) Exec(query string, args []driver.Value) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO consumer_dedup"):
+		key := args[0].(string)
+		if _, ok := db.keys[key]; ok {
+			return 0, fmt.Errorf("UNIQUE constraint failed: consumer_dedup.dedup_key")
+		}
+		db.keys[key] = expiresAt(args[1])
+		return 1, nil
+	case strings.HasPrefix(query, "UPDATE consumer_dedup SET expires_at = ? WHERE dedup_key = ? AND expires_at < ?"):
+		key := args[1].(string)
+		if expires, ok := db.keys[key]; ok && expires != nil && expires.Before(args[2].(time.Time)) {
+			db.keys[key] = expiresAt(args[0])
+			return 1, nil
+		}
+		return 0, nil
+	case strings.HasPrefix(query, "DELETE FROM consumer_dedup WHERE dedup_key"):
+		delete(db.keys, args[0].(string))
+		return 1, nil
+	case strings.HasPrefix(query, "DELETE FROM consumer_dedup WHERE expires_at <"):
+		var affected int64
+		for key, expires := range db.keys {
+			if expires != nil && expires.Before(args[0].(time.Time)) {
+				delete(db.keys, key)
+				affected++
+			}
+		}
+		return affected, nil
+	}
+	return 0, fmt.Errorf("unsupported query: %s", query)
+}
+
+func (db *memDB) Query(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+	if !strings.HasPrefix(query, "SELECT 1 FROM consumer_dedup WHERE dedup_key =") {
+		return nil, nil, fmt.Errorf("unsupported query: %s", query)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	var values [][]driver.Value
+	if _, ok := db.keys[args[0].(string)]; ok {
+		values = append(values, []driver.Value{int64(1)})
+	}
+	return []string{"1"}, values, nil
+}
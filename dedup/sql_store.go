@@ -0,0 +1,134 @@
+// Package dedup stores the dedup keys of avrostry.IdempotencyMiddleware in a
+// SQL table, shared by every consumer of the group.
+//
+// The table must have these columns, with the types of your database:
+//
+//	CREATE TABLE consumer_dedup (
+//		dedup_key  VARCHAR(255) PRIMARY KEY,
+//		expires_at TIMESTAMP NULL
+//	)
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultTable name of the dedup table
+const DefaultTable = "consumer_dedup"
+
+// Placeholder bind parameter syntax of the SQL driver
+type Placeholder int
+
+const (
+	// QuestionPlaceholder ?, for MySQL and SQLite
+	QuestionPlaceholder Placeholder = iota
+	// DollarPlaceholder $1, for PostgreSQL
+	DollarPlaceholder
+)
+
+// Config dedup table configuration
+type Config struct {
+	Table       string
+	Placeholder Placeholder
+}
+
+func (cfg Config) table() string {
+	if cfg.Table == "" {
+		return DefaultTable
+	}
+	return cfg.Table
+}
+
+// query replaces the ? of the query with the configured placeholder
+func (cfg Config) query(format string) string {
+	query := fmt.Sprintf(format, cfg.table())
+	if cfg.Placeholder != DollarPlaceholder {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// SQLStore avrostry.DedupStore on a SQL table. Expired keys are replaced
+// when added again, Purge deletes the others.
+type SQLStore struct {
+	db  *sql.DB
+	cfg Config
+}
+
+// NewSQLStore SQLStore constructor
+func NewSQLStore(db *sql.DB, cfg Config) *SQLStore {
+	return &SQLStore{db: db, cfg: cfg}
+}
+
+// Add avrostry.DedupStore implementation. An expired key is taken over by
+// a conditional UPDATE, a new one by an INSERT, so of the consumers adding
+// the same key at once only one gets true. An INSERT failing on a key
+// already there, the unique violation of any driver, is false.
+func (s *SQLStore) Add(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	var expires *time.Time
+	if ttl > 0 {
+		at := now.Add(ttl)
+		expires = &at
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		s.cfg.query("UPDATE %s SET expires_at = ? WHERE dedup_key = ? AND expires_at < ?"), expires, key, now)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if updated > 0 {
+		return true, nil
+	}
+
+	_, err = s.db.ExecContext(ctx, s.cfg.query("INSERT INTO %s (dedup_key, expires_at) VALUES (?, ?)"), key, expires)
+	if err == nil {
+		return true, nil
+	}
+	if exists, existsErr := s.exists(ctx, key); existsErr == nil && exists {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *SQLStore) exists(ctx context.Context, key string) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx, s.cfg.query("SELECT 1 FROM %s WHERE dedup_key = ?"), key).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove avrostry.DedupStore implementation
+func (s *SQLStore) Remove(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.cfg.query("DELETE FROM %s WHERE dedup_key = ?"), key)
+	return err
+}
+
+// Purge deletes the expired keys, returns how many
+func (s *SQLStore) Purge(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.cfg.query("DELETE FROM %s WHERE expires_at < ?"), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
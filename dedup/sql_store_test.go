@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josgilmo/avrostry"
+	"github.com/stretchr/testify/require"
+)
+
+var _ avrostry.DedupStore = (*SQLStore)(nil)
+
+func TestSQLStore(t *testing.T) {
+	ctx := context.Background()
+	db, mem := openMemDB()
+	store := NewSQLStore(db, Config{})
+
+	added, err := store.Add(ctx, "uno", 0)
+	require.Nil(t, err)
+	require.True(t, added)
+	added, err = store.Add(ctx, "uno", time.Hour)
+	require.Nil(t, err)
+	require.False(t, added)
+
+	added, _ = store.Add(ctx, "dos", time.Millisecond)
+	require.True(t, added)
+	time.Sleep(2 * time.Millisecond)
+	added, _ = store.Add(ctx, "dos", time.Millisecond)
+	require.True(t, added, "expired keys are added again")
+
+	require.Nil(t, store.Remove(ctx, "uno"))
+	added, _ = store.Add(ctx, "uno", 0)
+	require.True(t, added)
+
+	time.Sleep(2 * time.Millisecond)
+	purged, err := store.Purge(ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), purged)
+	require.Equal(t, 1, mem.len())
+}
+
+func TestSQLStoreAddsOnce(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openMemDB()
+	store := NewSQLStore(db, Config{})
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		added int
+		errs  []error
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.Add(ctx, "uno", time.Hour)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				added++
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, errs)
+	require.Equal(t, 1, added)
+}
+
+func TestConfigQuery(t *testing.T) {
+	cfg := Config{Table: "dedup", Placeholder: DollarPlaceholder}
+	require.Equal(t, "UPDATE dedup SET expires_at = $1 WHERE dedup_key = $2",
+		cfg.query("UPDATE %s SET expires_at = ? WHERE dedup_key = ?"))
+}
@@ -0,0 +1,183 @@
+package avrostry
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Headers of the event envelope, set by the producers on every event
+const (
+	EventIDHeader       = "event_id"
+	EventTypeHeader     = "event_type"
+	ProducerHeader      = "event_producer"
+	OccurredAtHeader    = "event_time" // RFC 3339 with nanoseconds
+	CorrelationIDHeader = "correlation_id"
+	CausationIDHeader   = "causation_id"
+	SchemaIDHeader      = "schema_id"
+)
+
+// IdentifiedEvent is implemented by events with their own unique ID, the ID
+// of DomainEvent is the partition key and other events can share it.
+// Otherwise a random UUID identifies the event.
+type IdentifiedEvent interface {
+	EventID() string
+}
+
+// TimedEvent is implemented by events knowing when they occurred,
+// otherwise they occur when published
+type TimedEvent interface {
+	OccurredAt() time.Time
+}
+
+// Envelope standard metadata of an event, travelling as message headers.
+//
+// An event published with the context of a consumed message, or of an
+// Envelope set with ContextWithEnvelope, shares its correlation ID and is
+// caused by it. Events published without one start a correlation.
+type Envelope struct {
+	EventID       string
+	Type          string // subject of the event
+	Producer      string // client ID of the producer
+	OccurredAt    time.Time
+	CorrelationID string
+	CausationID   string // event ID of the message the event reacts to
+	SchemaID      int32
+}
+
+// newEnvelope the envelope of event published within ctx
+func newEnvelope(ctx context.Context, producer string, event DomainEvent, schemaID int32) Envelope {
+	envelope := Envelope{
+		Type:       event.Subject(),
+		Producer:   producer,
+		OccurredAt: time.Now(),
+		SchemaID:   schemaID,
+	}
+	if identified, ok := event.(IdentifiedEvent); ok {
+		envelope.EventID = identified.EventID()
+	} else {
+		envelope.EventID = newUUID()
+	}
+	envelope.CorrelationID = envelope.EventID
+	if timed, ok := event.(TimedEvent); ok {
+		envelope.OccurredAt = timed.OccurredAt()
+	}
+	if parent, ok := EnvelopeFromContext(ctx); ok {
+		envelope.CausationID = parent.EventID
+		if parent.CorrelationID != "" {
+			envelope.CorrelationID = parent.CorrelationID
+		} else if parent.EventID != "" {
+			envelope.CorrelationID = parent.EventID
+		}
+	}
+	return envelope
+}
+
+// newUUID random UUID, version 4
+func newUUID() string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		panic(err)
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// Headers the message headers of the envelope, empty fields are left out
+func (e Envelope) Headers() []MessageHeader {
+	var headers []MessageHeader
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, MessageHeader{Key: key, Value: value})
+		}
+	}
+	add(EventIDHeader, e.EventID)
+	add(EventTypeHeader, e.Type)
+	add(ProducerHeader, e.Producer)
+	if !e.OccurredAt.IsZero() {
+		add(OccurredAtHeader, e.OccurredAt.UTC().Format(time.RFC3339Nano))
+	}
+	add(CorrelationIDHeader, e.CorrelationID)
+	add(CausationIDHeader, e.CausationID)
+	if e.SchemaID != 0 {
+		add(SchemaIDHeader, strconv.FormatInt(int64(e.SchemaID), 10))
+	}
+	return headers
+}
+
+// ParseEnvelope reads the envelope from message headers, the fields of
+// missing headers are empty. The error names the first malformed header,
+// the other fields are still read.
+func ParseEnvelope(headers []MessageHeader) (Envelope, error) {
+	var (
+		envelope Envelope
+		err      error
+	)
+	for _, h := range headers {
+		switch h.Key {
+		case EventIDHeader:
+			envelope.EventID = h.Value
+		case EventTypeHeader:
+			envelope.Type = h.Value
+		case ProducerHeader:
+			envelope.Producer = h.Value
+		case OccurredAtHeader:
+			occurredAt, parseErr := time.Parse(time.RFC3339Nano, h.Value)
+			if parseErr != nil && err == nil {
+				err = errors.Wrapf(parseErr, "malformed header: %s", h.Key)
+			}
+			envelope.OccurredAt = occurredAt
+		case CorrelationIDHeader:
+			envelope.CorrelationID = h.Value
+		case CausationIDHeader:
+			envelope.CausationID = h.Value
+		case SchemaIDHeader:
+			id, parseErr := strconv.ParseInt(h.Value, 10, 32)
+			if parseErr != nil && err == nil {
+				err = errors.Wrapf(parseErr, "malformed header: %s", h.Key)
+			}
+			envelope.SchemaID = int32(id)
+		}
+	}
+	return envelope, err
+}
+
+// withHeaders base followed by headers, a header given in headers replaces
+// the base one, like the envelope headers
+func withHeaders(base, headers []MessageHeader) []MessageHeader {
+	given := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		given[h.Key] = true
+	}
+	merged := make([]MessageHeader, 0, len(base)+len(headers))
+	for _, h := range base {
+		if !given[h.Key] {
+			merged = append(merged, h)
+		}
+	}
+	return append(merged, headers...)
+}
+
+type envelopeKey struct{}
+
+// ContextWithEnvelope the events published with the returned context are
+// caused by the event of envelope. An Envelope with only a CorrelationID
+// starts that correlation.
+func ContextWithEnvelope(ctx context.Context, envelope Envelope) context.Context {
+	return context.WithValue(ctx, envelopeKey{}, envelope)
+}
+
+// EnvelopeFromContext the envelope set with ContextWithEnvelope, like the
+// one of a consumed message
+func EnvelopeFromContext(ctx context.Context) (Envelope, bool) {
+	if ctx == nil {
+		return Envelope{}, false
+	}
+	envelope, ok := ctx.Value(envelopeKey{}).(Envelope)
+	return envelope, ok
+}
@@ -0,0 +1,83 @@
+package avrostry
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// identifiedWord a Word with its own event ID
+type identifiedWord struct {
+	Word
+}
+
+func (w identifiedWord) EventID() string {
+	return "word-" + w.Word.Word
+}
+
+func messageHeaders(t *testing.T, encoder *messageEncoder, ctx context.Context, event DomainEvent, headers []MessageHeader) []MessageHeader {
+	msg, err := encoder.encode(ctx, "words", event, headers)
+	require.Nil(t, err)
+	var result []MessageHeader
+	for _, h := range msg.Headers {
+		result = append(result, MessageHeader{Key: string(h.Key), Value: string(h.Value)})
+	}
+	return result
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	_, server := newFakeSchemaRegistry()
+	defer server.Close()
+	cfg := DefaultProducerConfig()
+	cfg.ClientID = "words-service"
+	cfg.SchemaRegistryClient = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	encoder := newMessageEncoder(cfg)
+
+	headers := messageHeaders(t, encoder, context.Background(), Word{Word: "uno"}, []MessageHeader{{Key: "tenant", Value: "acme"}})
+	require.Equal(t, MessageHeader{Key: "tenant", Value: "acme"}, headers[len(headers)-1])
+	first, err := ParseEnvelope(headers)
+	require.Nil(t, err)
+	require.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", first.EventID)
+	require.Equal(t, Word{}.Subject(), first.Type)
+	require.Equal(t, "words-service", first.Producer)
+	require.Equal(t, first.EventID, first.CorrelationID)
+	require.Empty(t, first.CausationID)
+	require.NotZero(t, first.SchemaID)
+	require.WithinDuration(t, time.Now(), first.OccurredAt, time.Minute)
+
+	// consumed message handler publishing an event in reaction
+	consumed := &ConsumerMessage{Envelope: first}
+	headers = messageHeaders(t, encoder, consumed.Context(), identifiedWord{Word{Word: "dos"}}, []MessageHeader{{Key: ProducerHeader, Value: "replayer"}})
+	second, err := ParseEnvelope(headers)
+	require.Nil(t, err)
+	require.Equal(t, "word-dos", second.EventID)
+	require.Equal(t, first.EventID, second.CorrelationID)
+	require.Equal(t, first.EventID, second.CausationID)
+	require.Equal(t, "replayer", second.Producer)
+	require.Len(t, headers, 7)
+
+	ctx := ContextWithEnvelope(context.Background(), Envelope{CorrelationID: "request-1"})
+	third, err := ParseEnvelope(messageHeaders(t, encoder, ctx, Word{Word: "tres"}, nil))
+	require.Nil(t, err)
+	require.Equal(t, "request-1", third.CorrelationID)
+	require.Empty(t, third.CausationID)
+}
+
+func TestParseEnvelopeMalformed(t *testing.T) {
+	envelope, err := ParseEnvelope([]MessageHeader{
+		{Key: EventIDHeader, Value: "uno"},
+		{Key: SchemaIDHeader, Value: "one"},
+		{Key: OccurredAtHeader, Value: "yesterday"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), SchemaIDHeader)
+	require.Equal(t, "uno", envelope.EventID)
+
+	occurredAt := time.Date(2018, 5, 1, 10, 30, 0, 123, time.UTC)
+	envelope, err = ParseEnvelope(Envelope{EventID: "uno", OccurredAt: occurredAt, SchemaID: 7}.Headers())
+	require.Nil(t, err)
+	require.Equal(t, Envelope{EventID: "uno", OccurredAt: occurredAt, SchemaID: 7}, envelope)
+}
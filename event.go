@@ -17,6 +17,42 @@ type DomainEvent interface {
 	ID() string
 }
 
+// KeyedEvent is implemented by events whose message key is
+// encoded in Avro, instead of the plain ID, with its own schema
+type KeyedEvent interface {
+	DomainEvent
+
+	// The message key schema according to Avro spec
+	KeySchema() string
+
+	// Convert the key to a map for encoding
+	KeyMap() map[string]interface{}
+}
+
+// KeySubjectSuffix is appended to the event subject to register the key schema
+const KeySubjectSuffix = "-key"
+
+// keyEvent encodes the key of a KeyedEvent as an event on its own
+type keyEvent struct {
+	event KeyedEvent
+}
+
+func (k keyEvent) AvroSchema() string {
+	return k.event.KeySchema()
+}
+
+func (k keyEvent) Subject() string {
+	return k.event.Subject() + KeySubjectSuffix
+}
+
+func (k keyEvent) ToStringMap() map[string]interface{} {
+	return k.event.KeyMap()
+}
+
+func (k keyEvent) ID() string {
+	return k.event.ID()
+}
+
 // Message sending header
 type MessageHeader struct {
 	Key   string
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"github.com/josgilmo/avrostry"
 	"github.com/linkedin/goavro"
 )
 
@@ -41,15 +42,7 @@ func (e Employee) AvroSchema() string {
 			{"name": "lastName", "type": "string"},
 			{"name": "age",  "type": "int", "default": 18},
 			{"name": "emails", "default":[], "type":{"type": "array", "items": "string"}},
-			{"name": "phone", "type": ["null", {
-				"namespace": "josgilmo.avrostry",
-				"type": "record",
-				"name": "phone",
-				"fields": [
-					{"name": "countryCode", "type": "string", "default" : "34"},
-					{"name": "number", "type": "string"}
-				]
-			}]},
+			{"name": "phone", "type": ["null", "josgilmo.avrostry.phone"]},
 			{"name":"status", "default" :"SALARY", 
 				"type": {"type": "enum", 
 					"name": "Status", 
@@ -60,6 +53,31 @@ func (e Employee) AvroSchema() string {
 	}`
 }
 
+// AvroSchema for Phone, registered in its own subject and
+// referenced by name from other schemas
+func (Phone) AvroSchema() string {
+	return `{
+		"namespace": "josgilmo.avrostry",
+		"type": "record",
+		"name": "phone",
+		"fields": [
+			{"name": "countryCode", "type": "string", "default" : "34"},
+			{"name": "number", "type": "string"}
+		]
+	}`
+}
+
+func (Phone) Subject() string {
+	return "josgilmo.avrostry.phone"
+}
+
+// NewSchemaResolver resolver with the common types used by the example events
+func NewSchemaResolver() (*avrostry.SchemaResolver, error) {
+	resolver := avrostry.NewSchemaResolver()
+	err := resolver.Add(Phone{}.Subject(), Phone{}.AvroSchema())
+	return resolver, err
+}
+
 func (Employee) Subject() string {
 	return "josgilmo.avrostry.create_employee"
 }
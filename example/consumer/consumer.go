@@ -20,12 +20,8 @@ func ErrorHandler(err error) {
 	fmt.Println(err)
 }
 
-func EventHandler(msg *avrostry.ConsumerMessage) bool {
-	if msg.Subject != (Employee{}).Subject() {
-		return true
-	}
-	employee := StringMapToEmployee(msg.Event)
-	spew.Dump(*employee)
+func EmployeeHandler(event avrostry.DomainEvent, msg *avrostry.ConsumerMessage) bool {
+	spew.Dump(event)
 	fmt.Printf("Consumed event:\n")
 	fmt.Printf("\tKey: %s\n", string(msg.Key))
 	fmt.Printf("\tTopic: %s\n", msg.Topic)
@@ -37,6 +33,10 @@ func EventHandler(msg *avrostry.ConsumerMessage) bool {
 	return true
 }
 
+func EmployeeFactory(event map[string]interface{}) (avrostry.DomainEvent, error) {
+	return *StringMapToEmployee(event), nil
+}
+
 func main() {
 	cfg := avrostry.DefaultKafkaRegistryConsumerGroupCfg()
 	cfg.Name = ConsumerGroup
@@ -47,7 +47,9 @@ func main() {
 		avrostry.NewCacheSchemaRegistry(),
 		http.DefaultClient,
 	)
-	cfg.EventHandler = EventHandler
+	cfg.EventHandler = avrostry.NewEventRouter(ErrorHandler).
+		HandleEvent(Employee{}, EmployeeFactory, EmployeeHandler).
+		HandleMessage
 	cfg.ErrorHandler = ErrorHandler
 
 	sarama.Logger = log.New(os.Stdout, "", log.Ltime)
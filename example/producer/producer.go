@@ -22,6 +22,12 @@ func main() {
 		SchemaRegistryURL,
 		avrostry.NewCacheSchemaRegistry(),
 		http.DefaultClient)
+	resolver, err := NewSchemaResolver()
+	if err != nil {
+		panic(err)
+	}
+	cfg.SchemaResolver = resolver
+	cfg.ValidateEvents = true
 
 	sarama.Logger = log.New(os.Stdout, "", log.Ltime)
 
@@ -0,0 +1,174 @@
+package avrostry
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// DedupStore records the dedup keys of the messages handled
+type DedupStore interface {
+	// Add records key for ttl, 0 for ever, false when it is already there
+	Add(ctx context.Context, key string, ttl time.Duration) (added bool, err error)
+	// Remove forgets key, its message is handled again next time
+	Remove(ctx context.Context, key string) error
+}
+
+// DedupKeyFunc the dedup key of msg, empty to handle it without deduplication
+type DedupKeyFunc func(msg *ConsumerMessage) string
+
+// EventIDKey the EventID of the Envelope, the same on every redelivery
+func EventIDKey(msg *ConsumerMessage) string {
+	return msg.Envelope.EventID
+}
+
+// KeyFieldKey the message key with the value of field of the event, like a
+// version, for the events without ID
+func KeyFieldKey(field string) DedupKeyFunc {
+	return func(msg *ConsumerMessage) string {
+		value, ok := msg.Event[field]
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("%s/%v", msg.Key, value)
+	}
+}
+
+// IdempotencyConfig IdempotencyMiddleware configuration
+type IdempotencyConfig struct {
+	Store DedupStore    // required
+	Key   DedupKeyFunc  // EventIDKey when nil
+	TTL   time.Duration // how long a key is remembered, 0 for ever
+	// Optional, records the duplicate-skip-rate meter, for every topic and
+	// per topic with the -for-topic-<topic> suffix
+	Registry metrics.Registry
+}
+
+// IdempotencyMiddleware skips the messages whose dedup key is already in the
+// store. The key is added before the handler runs and removed when it
+// returns Retry, SendToDeadLetter or Stop, or panics, so the message is
+// handled again, redriven from the dead letter topic included. A failing
+// store retries the message.
+//
+// A consumer crashing while the handler runs leaves the key in the store:
+// the message read again after the restart is skipped though it may not
+// have been handled. A TTL bounds how long such messages are skipped.
+// It panics without a Store.
+func IdempotencyMiddleware(cfg IdempotencyConfig) ConsumerMiddleware {
+	if cfg.Store == nil {
+		panic("avrostry: IdempotencyMiddleware: Store is required")
+	}
+	keyOf := cfg.Key
+	if keyOf == nil {
+		keyOf = EventIDKey
+	}
+	return func(next ContextEventHandler) ContextEventHandler {
+		return func(ctx context.Context, msg *ConsumerMessage) Result {
+			key := keyOf(msg)
+			if key == "" {
+				return next(ctx, msg)
+			}
+
+			added, err := cfg.Store.Add(ctx, key, cfg.TTL)
+			if err != nil {
+				return Retry(0)
+			}
+			if !added {
+				if cfg.Registry != nil {
+					for _, suffix := range []string{"", "-for-topic-" + msg.Topic} {
+						metrics.GetOrRegisterMeter("duplicate-skip-rate"+suffix, cfg.Registry).Mark(1)
+					}
+				}
+				return Skip()
+			}
+
+			returned := false
+			defer func() {
+				if !returned {
+					cfg.Store.Remove(context.Background(), key) // the handler panicked
+				}
+			}()
+			result := next(ctx, msg)
+			returned = true
+
+			if result.failed() {
+				if err := cfg.Store.Remove(context.Background(), key); err != nil {
+					return Stop(errors.Wrapf(err, "could not remove dedup key: %s", key))
+				}
+			}
+			return result
+		}
+	}
+}
+
+// MemoryDedupStore DedupStore keeping the most recently added keys in memory
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  *list.List // *dedupEntry, most recent first
+	keys     map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time // zero for ever
+}
+
+// NewMemoryDedupStore MemoryDedupStore constructor, it forgets the oldest
+// keys beyond capacity
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{capacity: capacity, entries: list.New(), keys: map[string]*list.Element{}}
+}
+
+// Add DedupStore implementation
+func (s *MemoryDedupStore) Add(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := s.keys[key]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			s.entries.MoveToFront(elem)
+			return false, nil
+		}
+		s.remove(elem)
+	}
+
+	entry := &dedupEntry{key: key}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	s.keys[key] = s.entries.PushFront(entry)
+	for s.capacity > 0 && s.entries.Len() > s.capacity {
+		s.remove(s.entries.Back())
+	}
+	return true, nil
+}
+
+// Remove DedupStore implementation
+func (s *MemoryDedupStore) Remove(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.keys[key]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+// Len keys stored, the expired ones included until they are evicted
+func (s *MemoryDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries.Len()
+}
+
+func (s *MemoryDedupStore) remove(elem *list.Element) {
+	s.entries.Remove(elem)
+	delete(s.keys, elem.Value.(*dedupEntry).key)
+}
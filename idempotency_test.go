@@ -0,0 +1,117 @@
+package avrostry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryDedupStore(2)
+
+	added, err := store.Add(ctx, "uno", 0)
+	require.Nil(t, err)
+	require.True(t, added)
+	added, _ = store.Add(ctx, "uno", 0)
+	require.False(t, added)
+
+	store.Add(ctx, "dos", 0)
+	store.Add(ctx, "tres", 0)
+	require.Equal(t, 2, store.Len())
+	added, _ = store.Add(ctx, "uno", 0)
+	require.True(t, added, "the oldest key is evicted")
+
+	added, _ = store.Add(ctx, "cuatro", time.Millisecond)
+	require.True(t, added)
+	time.Sleep(2 * time.Millisecond)
+	added, _ = store.Add(ctx, "cuatro", time.Millisecond)
+	require.True(t, added, "expired")
+
+	require.Nil(t, store.Remove(ctx, "cuatro"))
+	added, _ = store.Add(ctx, "cuatro", 0)
+	require.True(t, added)
+
+	store = NewMemoryDedupStore(2)
+	store.Add(ctx, "uno", 0)
+	store.Add(ctx, "dos", 0)
+	store.Add(ctx, "uno", 0) // the duplicate is the most recent again
+	store.Add(ctx, "tres", 0)
+	added, _ = store.Add(ctx, "uno", 0)
+	require.False(t, added)
+	added, _ = store.Add(ctx, "dos", 0)
+	require.True(t, added, "the least recently seen key is evicted")
+}
+
+type failingDedupStore struct{}
+
+func (failingDedupStore) Add(context.Context, string, time.Duration) (bool, error) {
+	return false, errors.New("store down")
+}
+
+func (failingDedupStore) Remove(context.Context, string) error {
+	return errors.New("store down")
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var (
+		registry = metrics.NewRegistry()
+		handled  []int64
+		next     = Ack()
+	)
+	handler := IdempotencyMiddleware(IdempotencyConfig{
+		Store:    NewMemoryDedupStore(100),
+		Registry: registry,
+	})(func(_ context.Context, msg *ConsumerMessage) Result {
+		handled = append(handled, msg.Offset)
+		return next
+	})
+	message := func(offset int64, id string) *ConsumerMessage {
+		return &ConsumerMessage{Topic: "words", Offset: offset, Envelope: Envelope{EventID: id}}
+	}
+	ctx := context.Background()
+
+	require.Equal(t, Ack(), handler(ctx, message(1, "uno")))
+	require.Equal(t, Skip(), handler(ctx, message(2, "uno")))
+	require.Equal(t, Ack(), handler(ctx, message(3, "")))
+
+	next = Retry(0)
+	require.Equal(t, Retry(0), handler(ctx, message(4, "dos")))
+	next = Ack()
+	require.Equal(t, Ack(), handler(ctx, message(4, "dos")), "handled again after a retry")
+
+	next = SendToDeadLetter("unknown word")
+	require.Equal(t, SendToDeadLetter("unknown word"), handler(ctx, message(5, "tres")))
+	next = Ack()
+	require.Equal(t, Ack(), handler(ctx, message(5, "tres")), "handled again when redriven")
+
+	require.Equal(t, []int64{1, 3, 4, 4, 5, 5}, handled)
+	require.Equal(t, int64(1), metrics.GetOrRegisterMeter("duplicate-skip-rate-for-topic-words", registry).Count())
+
+	panicking := IdempotencyMiddleware(IdempotencyConfig{Store: NewMemoryDedupStore(100)})(
+		func(_ context.Context, msg *ConsumerMessage) Result {
+			if msg.Offset == 6 {
+				panic("handler bug")
+			}
+			return Ack()
+		})
+	require.Panics(t, func() { panicking(ctx, message(6, "cuatro")) })
+	require.Equal(t, Ack(), panicking(ctx, message(7, "cuatro")), "handled again after a panic")
+
+	handler = IdempotencyMiddleware(IdempotencyConfig{Store: failingDedupStore{}})(handler)
+	require.Equal(t, Retry(0), handler(ctx, message(8, "cinco")))
+
+	require.PanicsWithValue(t, "avrostry: IdempotencyMiddleware: Store is required", func() {
+		IdempotencyMiddleware(IdempotencyConfig{})
+	})
+}
+
+func TestKeyFieldKey(t *testing.T) {
+	keyOf := KeyFieldKey("Version")
+	require.Equal(t, "1/3", keyOf(&ConsumerMessage{Key: []byte("1"), Event: map[string]interface{}{"Version": int64(3)}}))
+	require.Equal(t, "", keyOf(&ConsumerMessage{Key: []byte("1"), Event: map[string]interface{}{}}))
+}
@@ -0,0 +1,149 @@
+// Package sqltest an in-process database/sql driver for the tests of the
+// SQL stores, a Handler executes the statements over its own tables.
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Handler executes the statements of a fake database, one at a time
+type Handler interface {
+	Exec(query string, args []driver.Value) (affected int64, err error)
+	Query(query string, args []driver.Value) (columns []string, rows [][]driver.Value, err error)
+}
+
+// Open a database whose statements are executed by handler. Statements
+// within a transaction are executed on commit, in order, and report one
+// row affected.
+func Open(handler Handler) *sql.DB {
+	return sql.OpenDB(&connector{handler: handler})
+}
+
+type connector struct {
+	sync.Mutex // one statement, or commit, at a time
+	handler    Handler
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+// fakeDriver only opens connections through the connector
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, driver.ErrBadConn
+}
+
+type statement struct {
+	query string
+	args  []driver.Value
+}
+
+type conn struct {
+	db      *connector
+	pending []statement // of the open transaction, executed on commit
+	tx      bool
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	c.tx, c.pending = true, nil
+	return c, nil
+}
+
+func (c *conn) Commit() error {
+	c.db.Lock()
+	defer c.db.Unlock()
+	pending := c.pending
+	c.tx, c.pending = false, nil
+	for _, st := range pending {
+		if _, err := c.db.handler.Exec(st.query, st.args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) Rollback() error {
+	c.tx, c.pending = false, nil
+	return nil
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.tx {
+		s.conn.pending = append(s.conn.pending, statement{s.query, args})
+		return driver.RowsAffected(1), nil
+	}
+
+	db := s.conn.db
+	db.Lock()
+	defer db.Unlock()
+	affected, err := db.handler.Exec(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.Lock()
+	defer db.Unlock()
+	columns, values, err := db.handler.Query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: columns, values: values}, nil
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,484 @@
+package avrostry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// JSONSchemaFormat JSON payloads validated against a JSON Schema.
+//
+// The validator supports the keywords of draft-07 not related to annotations
+// or formats: type, enum, const, properties, required, additionalProperties,
+// patternProperties, min/maxProperties, items, additionalItems, min/maxItems,
+// uniqueItems, contains, min/maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not
+// and local $ref (#/definitions/...).
+type JSONSchemaFormat struct {
+	sync.RWMutex
+	cache map[string]*jsonSchema
+}
+
+// NewJSONSchemaFormat JSONSchemaFormat constructor
+func NewJSONSchemaFormat() *JSONSchemaFormat {
+	return &JSONSchemaFormat{cache: map[string]*jsonSchema{}}
+}
+
+func (f *JSONSchemaFormat) Type() SchemaType {
+	return JSONSchemaType
+}
+
+// Encode marshals native to JSON, failing if it doesn't follow the schema
+func (f *JSONSchemaFormat) Encode(schema string, native interface{}) ([]byte, error) {
+	payload, err := json.Marshal(native)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Decode(schema, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Decode unmarshals a JSON payload, failing if it doesn't follow the schema
+func (f *JSONSchemaFormat) Decode(schema string, payload []byte) (interface{}, error) {
+	compiled, err := f.compile(schema)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	if err := compiled.validate(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Validate checks native, as it would be encoded to JSON, against the schema
+func (f *JSONSchemaFormat) Validate(schema string, native interface{}) error {
+	_, err := f.Encode(schema, native)
+	return err
+}
+
+func (f *JSONSchemaFormat) compile(schema string) (*jsonSchema, error) {
+	f.RLock()
+	compiled, exists := f.cache[schema]
+	f.RUnlock()
+	if exists {
+		return compiled, nil
+	}
+
+	var root interface{}
+	if err := json.Unmarshal([]byte(schema), &root); err != nil {
+		return nil, fmt.Errorf("cannot parse json schema: %s", err)
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, fmt.Errorf("json schema must be an object or a boolean, got %s", jsonType(root))
+	}
+
+	compiled = &jsonSchema{root: root, patterns: map[string]*regexp.Regexp{}}
+	f.Lock()
+	f.cache[schema] = compiled
+	f.Unlock()
+	return compiled, nil
+}
+
+// JSONSchemaViolation a value not following its JSON Schema
+type JSONSchemaViolation struct {
+	// JSON pointer to the value, # is the whole document
+	Path    string
+	Message string
+}
+
+// JSONSchemaValidationError every violation found validating a JSON document
+type JSONSchemaValidationError struct {
+	Violations []JSONSchemaViolation
+}
+
+func (e *JSONSchemaValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = fmt.Sprintf("%s: %s", v.Path, v.Message)
+	}
+	return "json schema validation failed: " + strings.Join(messages, "; ")
+}
+
+type jsonSchema struct {
+	root interface{}
+
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (s *jsonSchema) validate(value interface{}) error {
+	violations := s.check(s.root, value, "#", 0)
+	if len(violations) > 0 {
+		return &JSONSchemaValidationError{violations}
+	}
+	return nil
+}
+
+// maxRefDepth protects from schemas with circular references without data
+const maxRefDepth = 64
+
+func (s *jsonSchema) check(node interface{}, value interface{}, path string, depth int) []JSONSchemaViolation {
+	var violations []JSONSchemaViolation
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf(format, args...)})
+	}
+
+	switch n := node.(type) {
+	case bool:
+		if !n {
+			violate("no value allowed")
+		}
+		return violations
+	case map[string]interface{}:
+	default:
+		violate("invalid schema: %s", jsonType(node))
+		return violations
+	}
+	schema := node.(map[string]interface{})
+
+	if ref, ok := schema["$ref"].(string); ok {
+		if depth >= maxRefDepth {
+			violate("too many nested $ref")
+			return violations
+		}
+		target, err := s.resolveRef(ref)
+		if err != nil {
+			violate("%s", err)
+			return violations
+		}
+		// $ref overrides any sibling keyword in draft-07
+		return s.check(target, value, path, depth+1)
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		violate("expected %s, got %s", describeTypes(t), jsonType(value))
+		return violations
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !containsValue(enum, value) {
+		violate("value not in enum %s", compactJSON(enum))
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		violate("expected const %s", compactJSON(c))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		violations = append(violations, s.checkObject(schema, v, path, depth)...)
+	case []interface{}:
+		violations = append(violations, s.checkArray(schema, v, path, depth)...)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if min, ok := number(schema["minLength"]); ok && float64(length) < min {
+			violate("length %d shorter than %v", length, min)
+		}
+		if max, ok := number(schema["maxLength"]); ok && float64(length) > max {
+			violate("length %d longer than %v", length, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := s.pattern(pattern)
+			if err != nil {
+				violate("invalid pattern %q: %s", pattern, err)
+			} else if !re.MatchString(v) {
+				violate("does not match pattern %q", pattern)
+			}
+		}
+	case float64:
+		for _, message := range checkNumber(schema, v) {
+			violate("%s", message)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			violations = append(violations, s.check(sub, value, path, depth)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(s.check(sub, value, path, depth)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violate("does not match any schema of anyOf")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if len(s.check(sub, value, path, depth)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			violate("matches %d schemas of oneOf, expected 1", matched)
+		}
+	}
+	if not, ok := schema["not"]; ok && len(s.check(not, value, path, depth)) == 0 {
+		violate("matches a schema in not")
+	}
+
+	return violations
+}
+
+func (s *jsonSchema) checkObject(schema map[string]interface{}, object map[string]interface{}, path string, depth int) []JSONSchemaViolation {
+	var violations []JSONSchemaViolation
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, found := object[name]; !found {
+				violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("missing required property %q", name)})
+			}
+		}
+	}
+	if min, ok := number(schema["minProperties"]); ok && float64(len(object)) < min {
+		violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("%d properties, less than %v", len(object), min)})
+	}
+	if max, ok := number(schema["maxProperties"]); ok && float64(len(object)) > max {
+		violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("%d properties, more than %v", len(object), max)})
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	patternProperties, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+
+	// Sorted, so violations are reported always in the same order
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertyPath := path + "/" + escapePointer(name)
+		matched := false
+		if sub, ok := properties[name]; ok {
+			matched = true
+			violations = append(violations, s.check(sub, object[name], propertyPath, depth)...)
+		}
+		for pattern, sub := range patternProperties {
+			re, err := s.pattern(pattern)
+			if err != nil || !re.MatchString(name) {
+				continue
+			}
+			matched = true
+			violations = append(violations, s.check(sub, object[name], propertyPath, depth)...)
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				violations = append(violations, JSONSchemaViolation{propertyPath, "additional property not allowed"})
+			} else if !ok {
+				violations = append(violations, s.check(additional, object[name], propertyPath, depth)...)
+			}
+		}
+	}
+	return violations
+}
+
+func (s *jsonSchema) checkArray(schema map[string]interface{}, array []interface{}, path string, depth int) []JSONSchemaViolation {
+	var violations []JSONSchemaViolation
+
+	if min, ok := number(schema["minItems"]); ok && float64(len(array)) < min {
+		violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("%d items, less than %v", len(array), min)})
+	}
+	if max, ok := number(schema["maxItems"]); ok && float64(len(array)) > max {
+		violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("%d items, more than %v", len(array), max)})
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := 1; i < len(array); i++ {
+			if containsValue(array[:i], array[i]) {
+				violations = append(violations, JSONSchemaViolation{path, fmt.Sprintf("item %d is duplicated", i)})
+			}
+		}
+	}
+
+	switch items := schema["items"].(type) {
+	case []interface{}:
+		for i, value := range array {
+			itemPath := path + "/" + strconv.Itoa(i)
+			if i < len(items) {
+				violations = append(violations, s.check(items[i], value, itemPath, depth)...)
+			} else if additional, ok := schema["additionalItems"]; ok {
+				violations = append(violations, s.check(additional, value, itemPath, depth)...)
+			}
+		}
+	case nil:
+	default:
+		for i, value := range array {
+			violations = append(violations, s.check(items, value, path+"/"+strconv.Itoa(i), depth)...)
+		}
+	}
+
+	if contains, ok := schema["contains"]; ok {
+		found := false
+		for _, value := range array {
+			if len(s.check(contains, value, path, depth)) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, JSONSchemaViolation{path, "no item matches contains"})
+		}
+	}
+	return violations
+}
+
+func checkNumber(schema map[string]interface{}, v float64) []string {
+	var messages []string
+	if min, ok := number(schema["minimum"]); ok && v < min {
+		messages = append(messages, fmt.Sprintf("%v less than minimum %v", v, min))
+	}
+	if max, ok := number(schema["maximum"]); ok && v > max {
+		messages = append(messages, fmt.Sprintf("%v greater than maximum %v", v, max))
+	}
+	if min, ok := number(schema["exclusiveMinimum"]); ok && v <= min {
+		messages = append(messages, fmt.Sprintf("%v not greater than exclusive minimum %v", v, min))
+	}
+	if max, ok := number(schema["exclusiveMaximum"]); ok && v >= max {
+		messages = append(messages, fmt.Sprintf("%v not less than exclusive maximum %v", v, max))
+	}
+	if multiple, ok := number(schema["multipleOf"]); ok && multiple > 0 {
+		quotient := v / multiple
+		if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			messages = append(messages, fmt.Sprintf("%v not multiple of %v", v, multiple))
+		}
+	}
+	return messages
+}
+
+// resolveRef follows a JSON pointer to a subschema in the same document
+func (s *jsonSchema) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q, only local references are supported", ref)
+	}
+	node := s.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return node, nil
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch n := node.(type) {
+		case map[string]interface{}:
+			next, found := n[token]
+			if !found {
+				return nil, fmt.Errorf("$ref %q not found", ref)
+			}
+			node = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("$ref %q not found", ref)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("$ref %q not found", ref)
+		}
+	}
+	return node, nil
+}
+
+func (s *jsonSchema) pattern(pattern string) (*regexp.Regexp, error) {
+	s.Lock()
+	defer s.Unlock()
+	if re, exists := s.patterns[pattern]; exists {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.patterns[pattern] = re
+	return re, nil
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		actual := jsonType(value)
+		return actual == t || (t == "number" && actual == "integer")
+	case []interface{}:
+		for _, each := range t {
+			if matchesType(each, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func describeTypes(t interface{}) string {
+	if types, ok := t.([]interface{}); ok {
+		names := make([]string, len(types))
+		for i, each := range types {
+			names[i] = fmt.Sprint(each)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func number(value interface{}) (float64, bool) {
+	f, ok := value.(float64)
+	return f, ok
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, each := range values {
+		if reflect.DeepEqual(each, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compactJSON(value interface{}) string {
+	buf, _ := json.Marshal(value)
+	return string(buf)
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,163 @@
+package avrostry
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const personJSONSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["id", "name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^[0-9]+$"},
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 18},
+		"emails": {"type": "array", "items": {"type": "string"}, "uniqueItems": true},
+		"phone": {"$ref": "#/definitions/phone"}
+	},
+	"definitions": {
+		"phone": {
+			"type": "object",
+			"required": ["number"],
+			"properties": {
+				"countryCode": {"type": "string", "default": "34"},
+				"number": {"type": "string"}
+			}
+		}
+	}
+}`
+
+type person struct {
+	Data map[string]interface{}
+}
+
+func (person) AvroSchema() string {
+	return ""
+}
+
+func (person) SchemaType() SchemaType {
+	return JSONSchemaType
+}
+
+func (person) Schema() string {
+	return personJSONSchema
+}
+
+func (person) Subject() string {
+	return "person"
+}
+
+func (p person) ToStringMap() map[string]interface{} {
+	return p.Data
+}
+
+func (p person) ID() string {
+	return p.Data["id"].(string)
+}
+
+func TestJSONSchemaFormatValidDocument(t *testing.T) {
+	format := NewJSONSchemaFormat()
+
+	payload, err := format.Encode(personJSONSchema, map[string]interface{}{
+		"id":     "1",
+		"name":   "John",
+		"age":    int32(51),
+		"emails": []string{"john.doe@example.org"},
+		"phone":  map[string]interface{}{"number": "2070685000"},
+	})
+	require.Nil(t, err)
+
+	native, err := format.Decode(personJSONSchema, payload)
+	require.Nil(t, err)
+	require.Equal(t, float64(51), native.(map[string]interface{})["age"])
+}
+
+func TestJSONSchemaFormatReportsEveryViolation(t *testing.T) {
+	err := NewJSONSchemaFormat().Validate(personJSONSchema, map[string]interface{}{
+		"id":     "a1",
+		"age":    17.5,
+		"emails": []string{"a", "a"},
+		"phone":  map[string]interface{}{"countryCode": 44},
+		"other":  true,
+	})
+	require.NotNil(t, err)
+
+	validationErr, ok := err.(*JSONSchemaValidationError)
+	require.True(t, ok)
+	paths := map[string]bool{}
+	for _, violation := range validationErr.Violations {
+		paths[violation.Path] = true
+	}
+	require.Equal(t, map[string]bool{
+		"#":                   true, // name is required
+		"#/id":                true,
+		"#/age":               true,
+		"#/emails":            true,
+		"#/phone":             true, // number is required
+		"#/phone/countryCode": true,
+		"#/other":             true,
+	}, paths)
+}
+
+func TestJSONSchemaFormatCombinators(t *testing.T) {
+	schema := `{
+		"oneOf": [
+			{"type": "string", "maxLength": 3},
+			{"type": "number", "multipleOf": 0.5}
+		],
+		"not": {"const": "no"}
+	}`
+	format := NewJSONSchemaFormat()
+
+	require.Nil(t, format.Validate(schema, "yes"))
+	require.Nil(t, format.Validate(schema, 1.5))
+	require.NotNil(t, format.Validate(schema, "no"))
+	require.NotNil(t, format.Validate(schema, 1.2))
+	require.NotNil(t, format.Validate(schema, "long"))
+	require.NotNil(t, format.Validate(schema, true))
+}
+
+func TestCodecDecodesTopicsMixingSchemaTypes(t *testing.T) {
+	_, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	codec := NewKafkaAvroCodec(manager, NewCacheCodec())
+
+	avroMessage, err := codec.Encode(Word{Word: "Palabro"})
+	require.Nil(t, err)
+	jsonMessage, err := codec.Encode(person{map[string]interface{}{"id": "1", "name": "John", "age": 51}})
+	require.Nil(t, err)
+
+	_, err = codec.Encode(person{map[string]interface{}{"id": "1", "name": "John", "age": 5}})
+	require.NotNil(t, err)
+
+	// Consumers get the schema type from the registry
+	codec = NewKafkaAvroCodec(NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient), NewCacheCodec())
+
+	subject, event, err := codec.Decode(avroMessage)
+	require.Nil(t, err)
+	require.Equal(t, "words", subject)
+	require.Equal(t, "Palabro", event.(map[string]interface{})["Word"])
+
+	subject, event, err = codec.Decode(jsonMessage)
+	require.Nil(t, err)
+	require.Equal(t, "person", subject)
+	require.Equal(t, "John", event.(map[string]interface{})["name"])
+}
+
+func TestCodecUnsupportedSchemaType(t *testing.T) {
+	_, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+
+	id, err := manager.RegisterWithType("proto", `syntax = "proto3"; message Phone { string number = 1; }`, ProtobufSchemaType, nil)
+	require.Nil(t, err)
+
+	codec := NewKafkaAvroCodec(manager, NewCacheCodec())
+	_, _, err = codec.Decode([]byte{0, 0, 0, 0, byte(id), 0})
+	require.EqualError(t, err, "unsupported schema type: PROTOBUF")
+}
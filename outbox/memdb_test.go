@@ -0,0 +1,123 @@
+package outbox
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josgilmo/avrostry/internal/sqltest"
+)
+
+func openMemDB() (*sql.DB, *memDB) {
+	mem := &memDB{}
+	return sqltest.Open(mem), mem
+}
+
+type memRow struct {
+	id        int64
+	topic     string
+	subject   string
+	schema    string
+	key       []byte
+	headers   string
+	payload   []byte
+	sentAt    *time.Time
+	attempts  int
+	lastError string
+}
+
+// memDB sqltest.Handler understanding the outbox queries
+type memDB struct {
+	sync.Mutex
+	rows   []*memRow
+	nextID int64
+}
+
+func (db *memDB) snapshot() []memRow {
+	db.Lock()
+	defer db.Unlock()
+	rows := make([]memRow, len(db.rows))
+	for i, row := range db.rows {
+		rows[i] = *row
+	}
+	return rows
+}
+
+func (db *memDB) Exec(query string, args []driver.Value) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO outbox"):
+		db.nextID++
+		db.rows = append(db.rows, &memRow{
+			id:      db.nextID,
+			topic:   args[0].(string),
+			subject: args[1].(string),
+			schema:  args[2].(string),
+			key:     args[3].([]byte),
+			headers: args[4].(string),
+			payload: args[5].([]byte),
+		})
+	case strings.HasPrefix(query, "UPDATE outbox SET sent_at"):
+		sentAt := args[0].(time.Time)
+		db.row(args[1].(int64)).sentAt = &sentAt
+	case strings.HasPrefix(query, "UPDATE outbox SET attempts"):
+		row := db.row(args[1].(int64))
+		row.attempts++
+		row.lastError = args[0].(string)
+	default:
+		return 0, fmt.Errorf("unsupported query: %s", query)
+	}
+	return 1, nil
+}
+
+func (db *memDB) row(id int64) *memRow {
+	for _, row := range db.rows {
+		if row.id == id {
+			return row
+		}
+	}
+	return &memRow{}
+}
+
+func (db *memDB) Query(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+	if !strings.HasPrefix(query, "SELECT id, topic, event_key, headers, payload FROM outbox e WHERE sent_at IS NULL AND NOT EXISTS") ||
+		!strings.HasSuffix(query, "ORDER BY attempts, id LIMIT ?") {
+		return nil, nil, fmt.Errorf("unsupported query: %s", query)
+	}
+	limit := int(args[0].(int64))
+
+	db.Lock()
+	defer db.Unlock()
+	var pending []*memRow
+	for _, row := range db.rows {
+		if row.sentAt == nil && !db.behindFailed(row) {
+			pending = append(pending, row)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].attempts < pending[j].attempts
+	})
+
+	var values [][]driver.Value
+	for _, row := range pending {
+		if len(values) < limit {
+			values = append(values, []driver.Value{row.id, row.topic, row.key, row.headers, row.payload})
+		}
+	}
+	return []string{"id", "topic", "event_key", "headers", "payload"}, values, nil
+}
+
+// behindFailed whether an earlier unsent row of the key of row failed
+func (db *memDB) behindFailed(row *memRow) bool {
+	for _, earlier := range db.rows {
+		if earlier.id < row.id && earlier.sentAt == nil && earlier.attempts > 0 && string(earlier.key) == string(row.key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+// Package outbox stores events in the same SQL transaction as the domain
+// state, a Relay publishes them to Kafka afterwards.
+//
+// The outbox table must have these columns, with the types of your database:
+//
+//	CREATE TABLE outbox (
+//		id           BIGINT AUTO_INCREMENT PRIMARY KEY,
+//		topic        VARCHAR(255) NOT NULL,
+//		subject      VARCHAR(255) NOT NULL,
+//		event_schema TEXT NOT NULL,
+//		event_key    BLOB,
+//		headers      TEXT NOT NULL,
+//		payload      BLOB NOT NULL,
+//		created_at   TIMESTAMP NOT NULL,
+//		sent_at      TIMESTAMP NULL,
+//		attempts     INT NOT NULL DEFAULT 0,
+//		last_error   TEXT
+//	)
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/josgilmo/avrostry"
+)
+
+// DefaultTable name of the outbox table
+const DefaultTable = "outbox"
+
+// Placeholder bind parameter syntax of the SQL driver
+type Placeholder int
+
+const (
+	// QuestionPlaceholder ?, for MySQL and SQLite
+	QuestionPlaceholder Placeholder = iota
+	// DollarPlaceholder $1, for PostgreSQL
+	DollarPlaceholder
+)
+
+// Config outbox table configuration, shared by Outbox and Relay
+type Config struct {
+	Table       string
+	Placeholder Placeholder
+	// How Outbox encodes the events, like ProducerConfig: the envelope
+	// Producer and the CloudEvents binding
+	Producer    string
+	CloudEvents avrostry.CloudEventsMode
+}
+
+func (cfg Config) table() string {
+	if cfg.Table == "" {
+		return DefaultTable
+	}
+	return cfg.Table
+}
+
+// query replaces the ? of the query with the configured placeholder
+func (cfg Config) query(format string) string {
+	query := fmt.Sprintf(format, cfg.table())
+	if cfg.Placeholder != DollarPlaceholder {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Outbox writes events in the outbox table, encoded as they will be published
+type Outbox struct {
+	codec *avrostry.KafkaAvroCodec
+	cfg   Config
+}
+
+// New Outbox constructor, the codec registers the schemas of the events
+func New(codec *avrostry.KafkaAvroCodec, cfg Config) *Outbox {
+	return &Outbox{codec: codec, cfg: cfg}
+}
+
+// Store encodes the event and inserts it in the outbox with tx, it is
+// published once tx commits. The message key is the ID of the event, or its
+// encoded key for a KeyedEvent, as KafkaRegistryProducer does.
+func (o *Outbox) Store(tx *sql.Tx, topic string, event avrostry.DomainEvent, headers []avrostry.MessageHeader) error {
+	return o.StoreWithContext(context.Background(), tx, topic, event, headers)
+}
+
+// StoreWithContext like Store, the envelope of the event continues the one of
+// ctx. The envelope headers, or the CloudEvent, are stored with the event:
+// the Relay publishes them as they are, every retry with the same event ID.
+func (o *Outbox) StoreWithContext(ctx context.Context, tx *sql.Tx, topic string, event avrostry.DomainEvent, headers []avrostry.MessageHeader) error {
+	payload, err := o.codec.Encode(event)
+	if err != nil {
+		return err
+	}
+	payload, headers, err = avrostry.EventMessage(ctx, o.cfg.CloudEvents, o.cfg.Producer, event, payload, headers)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(event.ID())
+	if keyed, ok := event.(avrostry.KeyedEvent); ok {
+		if key, err = o.codec.EncodeKey(keyed); err != nil {
+			return err
+		}
+	}
+
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	schema := event.AvroSchema()
+	if typed, ok := event.(avrostry.TypedSchemaEvent); ok {
+		schema = typed.Schema()
+	}
+
+	_, err = tx.ExecContext(ctx, o.cfg.query(
+		"INSERT INTO %s (topic, subject, event_schema, event_key, headers, payload, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		topic, event.Subject(), schema, key, string(encodedHeaders), payload, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,229 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/josgilmo/avrostry"
+	"github.com/stretchr/testify/require"
+)
+
+type account struct {
+	id     string
+	amount int
+}
+
+func (account) AvroSchema() string {
+	return `{"type": "record", "name": "account", "fields": [{"name": "amount", "type": "int"}]}`
+}
+
+func (account) Subject() string {
+	return "account_credited"
+}
+
+func (a account) ToStringMap() map[string]interface{} {
+	return map[string]interface{}{"amount": a.amount}
+}
+
+func (a account) ID() string {
+	return a.id
+}
+
+// memRegistry schema registry keeping the schemas in memory
+type memRegistry struct {
+	sync.Mutex
+	schemas []string
+}
+
+func (r *memRegistry) Register(subject, schema string) (int32, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.schemas = append(r.schemas, schema)
+	return int32(len(r.schemas)), nil
+}
+
+func (r *memRegistry) GetByID(id int32) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.schemas[id-1], nil
+}
+
+type published struct {
+	topic   string
+	key     string
+	value   []byte
+	headers []avrostry.MessageHeader
+}
+
+func (p published) header(key string) string {
+	for _, h := range p.headers {
+		if h.Key == key {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// fakePublisher fails the keys in down
+type fakePublisher struct {
+	down      map[string]bool
+	published []published
+}
+
+func (p *fakePublisher) PublishEncoded(topic string, key, value []byte, headers []avrostry.MessageHeader) (int32, int64, error) {
+	if p.down[string(key)] {
+		return -1, -1, errors.New("broker down")
+	}
+	p.published = append(p.published, published{topic, string(key), value, headers})
+	return 0, int64(len(p.published) - 1), nil
+}
+
+func TestStoreWritesWithTheCallerTransaction(t *testing.T) {
+	db, mem := openMemDB()
+	codec := avrostry.NewKafkaAvroCodec(&memRegistry{}, avrostry.NewCacheCodec())
+	o := New(codec, Config{})
+
+	tx, err := db.Begin()
+	require.Nil(t, err)
+	require.Nil(t, o.Store(tx, "accounts", account{"a1", 10}, []avrostry.MessageHeader{{Key: "trace", Value: "1"}}))
+	require.Nil(t, tx.Rollback())
+	require.Len(t, mem.snapshot(), 0)
+
+	tx, err = db.Begin()
+	require.Nil(t, err)
+	require.Nil(t, o.Store(tx, "accounts", account{"a1", 10}, nil))
+	require.Nil(t, tx.Commit())
+
+	rows := mem.snapshot()
+	require.Len(t, rows, 1)
+	require.Equal(t, "accounts", rows[0].topic)
+	require.Equal(t, "account_credited", rows[0].subject)
+	require.Equal(t, account{}.AvroSchema(), rows[0].schema)
+	require.Equal(t, []byte("a1"), rows[0].key)
+
+	subject, native, err := codec.Decode(rows[0].payload)
+	require.Nil(t, err)
+	require.Equal(t, "account_credited", subject)
+	require.Equal(t, map[string]interface{}{"amount": int32(10)}, native)
+}
+
+func TestRelayPublishesTheStoredEnvelope(t *testing.T) {
+	db, _ := openMemDB()
+	o := New(avrostry.NewKafkaAvroCodec(&memRegistry{}, avrostry.NewCacheCodec()), Config{Producer: "accounts-service"})
+
+	ctx := avrostry.ContextWithEnvelope(context.Background(), avrostry.Envelope{EventID: "command-1", CorrelationID: "request-1"})
+	tx, err := db.Begin()
+	require.Nil(t, err)
+	require.Nil(t, o.StoreWithContext(ctx, tx, "accounts", account{"a1", 10}, nil))
+	require.Nil(t, tx.Commit())
+
+	publisher := &fakePublisher{}
+	_, err = NewRelay(db, publisher, DefaultRelayConfig()).RelayOnce(context.Background())
+	require.Nil(t, err)
+
+	envelope, err := avrostry.ParseEnvelope(publisher.published[0].headers)
+	require.Nil(t, err)
+	require.NotEmpty(t, envelope.EventID)
+	require.Equal(t, "accounts-service", envelope.Producer)
+	require.Equal(t, "account_credited", envelope.Type)
+	require.Equal(t, "request-1", envelope.CorrelationID)
+	require.Equal(t, "command-1", envelope.CausationID)
+}
+
+func TestRelayKeepsOrderPerKey(t *testing.T) {
+	db, mem := openMemDB()
+	o := New(avrostry.NewKafkaAvroCodec(&memRegistry{}, avrostry.NewCacheCodec()), Config{})
+
+	tx, err := db.Begin()
+	require.Nil(t, err)
+	for i, id := range []string{"a1", "a2", "a1", "a2"} {
+		headers := []avrostry.MessageHeader{{Key: "n", Value: fmt.Sprint(i)}}
+		require.Nil(t, o.Store(tx, "accounts", account{id, i}, headers))
+	}
+	require.Nil(t, tx.Commit())
+
+	var errs []error
+	publisher := &fakePublisher{down: map[string]bool{"a1": true}}
+	cfg := DefaultRelayConfig()
+	cfg.ErrorHandler = func(err error) {
+		errs = append(errs, err)
+	}
+	relay := NewRelay(db, publisher, cfg)
+
+	sent, err := relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 2, sent)
+	require.Len(t, errs, 1)
+	require.Equal(t, []string{"1", "3"}, []string{publisher.published[0].header("n"), publisher.published[1].header("n")})
+
+	rows := mem.snapshot()
+	require.Equal(t, 1, rows[0].attempts)
+	require.Equal(t, "broker down", rows[0].lastError)
+	require.Equal(t, 0, rows[2].attempts) // waited for rows[0]
+	require.NotNil(t, rows[1].sentAt)
+
+	publisher.down = nil
+	sent, err = relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, sent, "rows[2] was read behind the failed rows[0]")
+	require.Equal(t, "a1", publisher.published[2].key)
+	require.Equal(t, "0", publisher.published[2].header("n"))
+
+	sent, err = relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	require.Equal(t, "2", publisher.published[3].header("n"))
+
+	sent, err = relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, sent)
+}
+
+func TestRelayFailingKeyDoesNotHoldBackTheOthers(t *testing.T) {
+	db, _ := openMemDB()
+	o := New(avrostry.NewKafkaAvroCodec(&memRegistry{}, avrostry.NewCacheCodec()), Config{})
+
+	tx, err := db.Begin()
+	require.Nil(t, err)
+	for i, id := range []string{"a1", "a1", "a1", "a2"} {
+		require.Nil(t, o.Store(tx, "accounts", account{id, i}, nil))
+	}
+	require.Nil(t, tx.Commit())
+
+	publisher := &fakePublisher{down: map[string]bool{"a1": true}}
+	cfg := DefaultRelayConfig()
+	cfg.BatchSize = 2
+	relay := NewRelay(db, publisher, cfg)
+
+	sent, err := relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, sent, "the batch only has events of a1")
+
+	sent, err = relay.RelayOnce(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+	require.Equal(t, "a2", publisher.published[0].key)
+}
+
+func TestRelayRunReturnsNilWhenCancelled(t *testing.T) {
+	db, _ := openMemDB()
+	var errs []error
+	cfg := DefaultRelayConfig()
+	cfg.ErrorHandler = func(err error) {
+		errs = append(errs, err)
+	}
+	relay := NewRelay(db, &fakePublisher{}, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Nil(t, relay.Run(ctx))
+	require.Empty(t, errs)
+}
+
+func TestDollarPlaceholder(t *testing.T) {
+	cfg := Config{Table: "events_outbox", Placeholder: DollarPlaceholder}
+	require.Equal(t, "UPDATE events_outbox SET sent_at = $1 WHERE id = $2", cfg.query("UPDATE %s SET sent_at = ? WHERE id = ?"))
+}
@@ -0,0 +1,182 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/josgilmo/avrostry"
+)
+
+// Publisher sends encoded messages, implemented by KafkaRegistryProducer
+type Publisher interface {
+	PublishEncoded(topic string, key, value []byte, headers []avrostry.MessageHeader) (int32, int64, error)
+}
+
+// RelayConfig Relay configuration
+type RelayConfig struct {
+	Config
+	PollInterval time.Duration
+	BatchSize    int             // rows read per pass
+	ErrorHandler func(err error) // optional, failures to publish or to update the outbox
+}
+
+// DefaultRelayConfig polls every second
+func DefaultRelayConfig() RelayConfig {
+	return RelayConfig{
+		PollInterval: time.Second,
+		BatchSize:    100,
+	}
+}
+
+// Relay publishes the pending events of the outbox in insertion order and
+// marks them as sent. An event failing to publish is retried on the next
+// pass, the later events with the same key wait for it to keep their order.
+// Each pass reads the events never tried first, so the failing ones don't
+// hold back the other keys.
+//
+// Events are published with the value and headers Outbox stored, envelope
+// or CloudEvent included, so an event published again keeps its event ID
+// and IdempotencyMiddleware skips the duplicate.
+//
+// Delivery is at least once: an event published but not marked as sent is
+// published again. Run a single relay per outbox table.
+type Relay struct {
+	db        *sql.DB
+	publisher Publisher
+	cfg       RelayConfig
+	wake      chan struct{}
+}
+
+// NewRelay Relay constructor, zero PollInterval and BatchSize take the defaults
+func NewRelay(db *sql.DB, publisher Publisher, cfg RelayConfig) *Relay {
+	defaults := DefaultRelayConfig()
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaults.PollInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaults.BatchSize
+	}
+	return &Relay{
+		db:        db,
+		publisher: publisher,
+		cfg:       cfg,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Notify starts a pass without waiting for the poll interval, call it after
+// committing a transaction that stored events
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays the outbox until ctx is cancelled, then returns nil
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sent, err := r.RelayOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				r.handleError(err)
+			}
+			// keep going while the batches are full
+			if err != nil || sent < r.cfg.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+type pendingEvent struct {
+	id      int64
+	topic   string
+	key     []byte
+	headers []avrostry.MessageHeader
+	payload []byte
+}
+
+// RelayOnce publishes a batch of pending events, returning how many were sent
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	events, err := r.pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	blocked := map[string]bool{}
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		if blocked[string(event.key)] {
+			continue
+		}
+
+		if _, _, err := r.publisher.PublishEncoded(event.topic, event.key, event.payload, event.headers); err != nil {
+			blocked[string(event.key)] = true
+			r.handleError(err)
+			if _, err := r.db.ExecContext(ctx, r.cfg.query("UPDATE %s SET attempts = attempts + 1, last_error = ? WHERE id = ?"),
+				err.Error(), event.id); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		if _, err := r.db.ExecContext(ctx, r.cfg.query("UPDATE %s SET sent_at = ? WHERE id = ?"),
+			time.Now().UTC(), event.id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// pending the events to publish, leaving out the ones behind a failed event
+// of their key. The failed events come last, after the ones never tried.
+func (r *Relay) pending(ctx context.Context) ([]pendingEvent, error) {
+	rows, err := r.db.QueryContext(ctx, r.cfg.query(
+		"SELECT id, topic, event_key, headers, payload FROM %[1]s e WHERE sent_at IS NULL AND NOT EXISTS ("+
+			"SELECT 1 FROM %[1]s f WHERE f.sent_at IS NULL AND f.attempts > 0 AND f.event_key = e.event_key AND f.id < e.id"+
+			") ORDER BY attempts, id LIMIT ?"),
+		r.cfg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []pendingEvent
+	for rows.Next() {
+		var (
+			event   pendingEvent
+			headers string
+		)
+		if err := rows.Scan(&event.id, &event.topic, &event.key, &headers, &event.payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(headers), &event.headers); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r *Relay) handleError(err error) {
+	if r.cfg.ErrorHandler != nil {
+		r.cfg.ErrorHandler(err)
+	}
+}
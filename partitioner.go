@@ -0,0 +1,164 @@
+package avrostry
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+
+	"github.com/Shopify/sarama"
+)
+
+// Partitioner chooses the partition of the message of an event. key is the
+// encoded message key; event is nil for messages published with PublishEncoded.
+type Partitioner interface {
+	Partition(event DomainEvent, key []byte, numPartitions int32) (int32, error)
+}
+
+// PartitionerFunc a function as Partitioner
+type PartitionerFunc func(event DomainEvent, key []byte, numPartitions int32) (int32, error)
+
+// Partition Partitioner
+func (f PartitionerFunc) Partition(event DomainEvent, key []byte, numPartitions int32) (int32, error) {
+	return f(event, key, numPartitions)
+}
+
+// ExplicitPartition every message goes to partition
+func ExplicitPartition(partition int32) Partitioner {
+	return PartitionerFunc(func(_ DomainEvent, _ []byte, numPartitions int32) (int32, error) {
+		if partition < 0 || partition >= numPartitions {
+			return -1, fmt.Errorf("partition: %d, out of range, the topic has %d", partition, numPartitions)
+		}
+		return partition, nil
+	})
+}
+
+// Murmur2Partitioner the default partitioner of the Java producer, so keys
+// land in the same partitions as with Java clients. Messages without key are
+// spread randomly.
+func Murmur2Partitioner() Partitioner {
+	return PartitionerFunc(func(_ DomainEvent, key []byte, numPartitions int32) (int32, error) {
+		if key == nil {
+			return rand.Int31n(numPartitions), nil
+		}
+		return (murmur2(key) & 0x7fffffff) % numPartitions, nil
+	})
+}
+
+// murmur2 hash of the Java client, org.apache.kafka.common.utils.Utils
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// PartitionerRoutes Partitioner by subject or type of the event, like
+// TopicRoutes. Events without route use Default, or sarama's hash of the key.
+type PartitionerRoutes struct {
+	matcher eventMatcher
+	Default Partitioner
+}
+
+// NewPartitionerRoutes PartitionerRoutes constructor
+func NewPartitionerRoutes() *PartitionerRoutes {
+	return &PartitionerRoutes{}
+}
+
+// Subject partitions the events of subject with partitioner
+func (r *PartitionerRoutes) Subject(subject string, partitioner Partitioner) *PartitionerRoutes {
+	r.matcher.setSubject(subject, partitioner)
+	return r
+}
+
+// Type partitions the events of the Go type of event with partitioner
+func (r *PartitionerRoutes) Type(event DomainEvent, partitioner Partitioner) *PartitionerRoutes {
+	r.matcher.setType(event, partitioner)
+	return r
+}
+
+// Partition Partitioner
+func (r *PartitionerRoutes) Partition(event DomainEvent, key []byte, numPartitions int32) (int32, error) {
+	if partitioner, ok := r.matcher.match(event); ok {
+		return partitioner.(Partitioner).Partition(event, key, numPartitions)
+	}
+	if r.Default != nil {
+		return r.Default.Partition(event, key, numPartitions)
+	}
+	return hashPartition(key, numPartitions)
+}
+
+// hashPartition the FNV-1a hash of sarama's default partitioner
+func hashPartition(key []byte, numPartitions int32) (int32, error) {
+	if key == nil {
+		return rand.Int31n(numPartitions), nil
+	}
+	hasher := fnv.New32a()
+	hasher.Write(key)
+	partition := int32(hasher.Sum32()) % numPartitions
+	if partition < 0 {
+		partition = -partition
+	}
+	return partition, nil
+}
+
+// saramaPartitioner adapts a Partitioner to sarama, the event travels in
+// the message key
+type saramaPartitioner struct {
+	partitioner Partitioner
+}
+
+func newSaramaPartitioner(partitioner Partitioner) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		return &saramaPartitioner{partitioner}
+	}
+}
+
+func (sp *saramaPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	var key []byte
+	if msg.Key != nil {
+		var err error
+		if key, err = msg.Key.Encode(); err != nil {
+			return -1, err
+		}
+	}
+
+	var event DomainEvent
+	if key, ok := msg.Key.(eventKey); ok {
+		event = key.event
+	}
+	return sp.partitioner.Partition(event, key, numPartitions)
+}
+
+func (sp *saramaPartitioner) RequiresConsistency() bool {
+	return true
+}
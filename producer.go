@@ -1,11 +1,16 @@
 package avrostry
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
 	"github.com/Shopify/sarama"
 )
 
 // ProducerConfig Producer configuration
-type producerConfig struct {
+type ProducerConfig struct {
 	Addrs         []string
 	ClientID      string
 	MaxRetries    int
@@ -13,43 +18,129 @@ type producerConfig struct {
 	ReturnSuccess bool
 	Compression   sarama.CompressionCodec
 	Version       sarama.KafkaVersion
+	Security      SecurityConfig
+	SaramaConfig  *sarama.Config // optional, base for the settings not covered here
 	//
 	SchemaRegistryClient SchemaRegistryClient
+	SchemaRegistryURL    string // used without SchemaRegistryClient
 	CacheCodec           *CacheCodec
+	SchemaResolver       *SchemaResolver // optional, named types defined in other subjects
+	// Check events against their schema before encoding, reporting every violation
+	ValidateEvents bool
+	TopicRouter    TopicRouter // optional, topics of the events published without one
+	Partitioner    Partitioner // optional, sarama's hash of the key by default
+	// CloudEvents binding of the messages, the envelope headers when disabled
+	CloudEvents       CloudEventsMode
+	CloudEventsSource string // CloudEvents source and envelope Producer, ClientID when empty
+	// Wrap the publishing of every event, the first one is the outermost.
+	// Synchronous producer only, batches go through them event by event,
+	// encoded events and tombstones skip them.
+	Middlewares []ProducerMiddleware
+	// Asynchronous producer only
+	MaxInFlight      int              // messages waiting for the broker acknowledgement, 0 for no limit
+	DeliveryCallback DeliveryCallback // called for messages published without their own callback
+	// RequiredAcks is forced to WaitForAll by both
+	Idempotent bool // retries don't write duplicates, MaxRetries must be positive
+	// Synchronous producer only
+	TransactionalID    string        // enables transactions, implies Idempotent
+	TransactionTimeout time.Duration // aborted by the coordinator after it
 }
 
-func DefaultProducerConfig() producerConfig {
-	return producerConfig{
+func DefaultProducerConfig() ProducerConfig {
+	return ProducerConfig{
 		MaxRetries:    5,
 		RequiredAcks:  sarama.WaitForLocal,
 		ReturnSuccess: true,
 		Compression:   sarama.CompressionSnappy,
 		Version:       sarama.V0_11_0_0,
 		CacheCodec:    NewCacheCodec(),
+		MaxInFlight:   1000,
+
+		TransactionTimeout: time.Minute,
 	}
 }
 
 // KafkaRegistryProducer Struct for Encode and publish messages in Avro format with Schema Registry
 type KafkaRegistryProducer struct {
 	producer sarama.SyncProducer
-	codec    *KafkaAvroCodec
+	encoder  *messageEncoder
+	txn      *transactionalProducer // nil without TransactionalID
+	publish  PublishFunc            // send wrapped by the middlewares
+	wrapped  bool                   // publish has middlewares
+}
+
+func NewKafkaRegistryProducer(cfg ProducerConfig) (*KafkaRegistryProducer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := newSaramaProducerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TransactionalID != "" {
+		producer, err := newTransactionalProducer(cfg, config)
+		if err != nil {
+			return nil, err
+		}
+		erp := newKafkaRegistryProducer(producer, cfg)
+		erp.txn = producer
+		return erp, nil
+	}
+
+	producer, err := sarama.NewSyncProducer(cfg.Addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	return newKafkaRegistryProducer(producer, cfg), nil
 }
 
-func NewKafkaRegistryProducer(cfg producerConfig) (*KafkaRegistryProducer, error) {
-	config := sarama.NewConfig()
+func newKafkaRegistryProducer(producer sarama.SyncProducer, cfg ProducerConfig) *KafkaRegistryProducer {
+	erp := &KafkaRegistryProducer{producer: producer, encoder: newMessageEncoder(cfg), wrapped: len(cfg.Middlewares) > 0}
+	erp.publish = chainProducerMiddlewares(cfg.Middlewares, erp.send)
+	return erp
+}
+
+func newSaramaProducerConfig(cfg ProducerConfig) (*sarama.Config, error) {
+	config := baseSaramaConfig(cfg.SaramaConfig)
+	if err := cfg.Security.apply(config); err != nil {
+		return nil, err
+	}
 	config.ClientID = cfg.ClientID
 	config.Producer.Retry.Max = cfg.MaxRetries
 	config.Producer.RequiredAcks = cfg.RequiredAcks
 	config.Producer.Return.Successes = cfg.ReturnSuccess
-	config.Producer.Compression = sarama.CompressionSnappy
+	config.Producer.Compression = cfg.Compression
+	if cfg.Idempotent && cfg.TransactionalID == "" {
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+	}
+	if cfg.Partitioner != nil {
+		config.Producer.Partitioner = newSaramaPartitioner(cfg.Partitioner)
+	}
 	config.Version = cfg.Version
+	return config, nil
+}
 
-	producer, err := sarama.NewSyncProducer(cfg.Addrs, config)
+// PublishEvent publish a DomainEvent to the topic chosen by the TopicRouter
+func (erp *KafkaRegistryProducer) PublishEvent(event DomainEvent) (partition int32, offset int64, err error) {
+	return erp.PublishEventWithHeaders(event, nil)
+}
+
+// PublishEventWithHeaders publish a DomainEvent to the topic chosen by the TopicRouter
+func (erp *KafkaRegistryProducer) PublishEventWithHeaders(event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error) {
+	return erp.PublishEventWithContext(context.Background(), event, headers)
+}
+
+// PublishEventWithContext publish a DomainEvent to the topic chosen by the
+// TopicRouter, its envelope continues the one of ctx
+func (erp *KafkaRegistryProducer) PublishEventWithContext(ctx context.Context, event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error) {
+	topic, err := routeTopic(erp.encoder.router, event)
 	if err != nil {
-		return nil, err
+		return -1, -1, err
 	}
-	codec := NewKafkaAvroCodec(cfg.SchemaRegistryClient, cfg.CacheCodec)
-	return &KafkaRegistryProducer{producer, codec}, nil
+	return erp.PublishWithContext(ctx, topic, event, headers)
 }
 
 // Publish encode to a Avro format and publish a DomainEvent to Kafka
@@ -59,25 +150,209 @@ func (erp *KafkaRegistryProducer) Publish(topic string, event DomainEvent) (part
 
 // Publish encode to a Avro format and publish a DomainEvent to Kafka
 func (erp *KafkaRegistryProducer) PublishWithHeaders(topic string, event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error) {
-	binary, err := erp.codec.Encode(event)
+	return erp.PublishWithContext(context.Background(), topic, event, headers)
+}
+
+// PublishWithContext publish a DomainEvent to Kafka, its envelope continues
+// the one of ctx, like the context of a consumed message
+func (erp *KafkaRegistryProducer) PublishWithContext(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error) {
+	return erp.publish(ctx, topic, event, headers)
+}
+
+// send the innermost PublishFunc of the middleware chain
+func (erp *KafkaRegistryProducer) send(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error) {
+	msg, err := erp.encoder.encode(ctx, topic, event, headers)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return erp.producer.SendMessage(msg)
+}
+
+// PublishEncoded publish a message whose key and value were already encoded,
+// like the events stored in an outbox
+func (erp *KafkaRegistryProducer) PublishEncoded(topic string, key, value []byte, headers []MessageHeader) (partition int32, offset int64, err error) {
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(value),
+		Headers: toRecordHeaders(headers),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	return erp.producer.SendMessage(msg)
+}
+
+// PublishTombstone publish a message without value, deleting key from a
+// compacted topic. The key must be encoded as the events were, without event
+// the Partitioner decides as for encoded events.
+func (erp *KafkaRegistryProducer) PublishTombstone(topic string, key []byte) (partition int32, offset int64, err error) {
+	return erp.producer.SendMessage(&sarama.ProducerMessage{Topic: topic, Key: sarama.ByteEncoder(key)})
+}
+
+// PublishEventTombstone publish a message without value with the key of
+// event, its ID or encoded key for a KeyedEvent, deleting the event from a
+// compacted topic. It goes to the partition the event was published to.
+func (erp *KafkaRegistryProducer) PublishEventTombstone(topic string, event DomainEvent) (partition int32, offset int64, err error) {
+	key, err := erp.encoder.encodeKey(event)
 	if err != nil {
 		return -1, -1, err
 	}
+	return erp.producer.SendMessage(&sarama.ProducerMessage{Topic: topic, Key: key})
+}
+
+// Validate checks the event, and its key for a KeyedEvent, against their schemas
+func (erp *KafkaRegistryProducer) Validate(event DomainEvent) error {
+	return erp.encoder.validateEvent(event)
+}
+
+// BeginTxn opens a transaction, the events published until CommitTxn or
+// AbortTxn belong to it. Only one transaction is open at a time.
+func (erp *KafkaRegistryProducer) BeginTxn() error {
+	if erp.txn == nil {
+		return ErrNotTransactional
+	}
+	return erp.txn.beginTxn()
+}
+
+// SendOffsetsToTxn commits the offsets of the consumer group with the
+// transaction, offsets are the next messages to consume per topic and partition
+func (erp *KafkaRegistryProducer) SendOffsetsToTxn(groupID string, offsets map[string]map[int32]int64) error {
+	if erp.txn == nil {
+		return ErrNotTransactional
+	}
+	return erp.txn.sendOffsetsToTxn(groupID, offsets)
+}
+
+// CommitTxn makes the events of the transaction visible to read committed
+// consumers, it fails with *TxnAbortRequiredError when an event wasn't written
+func (erp *KafkaRegistryProducer) CommitTxn() error {
+	if erp.txn == nil {
+		return ErrNotTransactional
+	}
+	return erp.txn.endTxn(true)
+}
+
+// AbortTxn discards the events and offsets of the transaction
+func (erp *KafkaRegistryProducer) AbortTxn() error {
+	if erp.txn == nil {
+		return ErrNotTransactional
+	}
+	return erp.txn.endTxn(false)
+}
+
+// messageEncoder builds the Kafka messages of the events, shared by every producer
+type messageEncoder struct {
+	codec       *KafkaAvroCodec
+	validate    bool
+	router      TopicRouter
+	producer    string // envelope Producer
+	cloudEvents CloudEventsMode
+}
+
+func newMessageEncoder(cfg ProducerConfig) *messageEncoder {
+	me := &messageEncoder{
+		codec:    NewKafkaAvroCodecWithResolver(schemaRegistryClient(cfg.SchemaRegistryClient, cfg.SchemaRegistryURL), cfg.CacheCodec, cfg.SchemaResolver),
+		validate: cfg.ValidateEvents,
+		router:   cfg.TopicRouter,
+		producer: cfg.ClientID,
 
-	var saramaHeaders []sarama.RecordHeader
-	if len(headers) > 0 {
-		saramaHeaders = make([]sarama.RecordHeader, len(headers))
-		for z, h := range headers {
-			saramaHeaders[z] = sarama.RecordHeader{Key: []byte(h.Key), Value: []byte(h.Value)}
+		cloudEvents: cfg.CloudEvents,
+	}
+	if cfg.CloudEventsSource != "" {
+		me.producer = cfg.CloudEventsSource
+	}
+	return me
+}
+
+// encode the message of event, with the envelope headers or as a CloudEvent
+func (me *messageEncoder) encode(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (*sarama.ProducerMessage, error) {
+	if me.validate {
+		if err := me.validateEvent(event); err != nil {
+			return nil, err
 		}
 	}
 
-	msg := &sarama.ProducerMessage{
-		Key:     sarama.StringEncoder(event.ID()),
+	value, err := me.codec.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := me.encodeKey(event)
+	if err != nil {
+		return nil, err
+	}
+
+	value, headers, err = EventMessage(ctx, me.cloudEvents, me.producer, event, value, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Key:     key,
 		Topic:   topic,
-		Value:   sarama.ByteEncoder(binary),
-		Headers: saramaHeaders,
+		Value:   sarama.ByteEncoder(value),
+		Headers: toRecordHeaders(headers),
+	}, nil
+}
+
+// EventMessage the message value and headers of event, encoded with the
+// codec as value, as the producers publish it within ctx: with the envelope
+// headers or as a CloudEvent of mode. producer is the envelope Producer, and
+// headers replace the ones with their key.
+func EventMessage(ctx context.Context, mode CloudEventsMode, producer string, event DomainEvent, value []byte, headers []MessageHeader) ([]byte, []MessageHeader, error) {
+	schemaID := int32(binary.BigEndian.Uint32(value[1:5]))
+	envelope := newEnvelope(ctx, producer, event, schemaID)
+	switch mode {
+	case CloudEventsBinary:
+		return value, withHeaders(newCloudEvent(envelope, event, value).BinaryHeaders(), headers), nil
+	case CloudEventsStructured:
+		structured, err := json.Marshal(newCloudEvent(envelope, event, value))
+		if err != nil {
+			return nil, nil, err
+		}
+		return structured, withHeaders([]MessageHeader{{Key: ContentTypeHeader, Value: CloudEventsJSONType}}, headers), nil
+	default:
+		return value, withHeaders(envelope.Headers(), headers), nil
 	}
+}
 
-	return erp.producer.SendMessage(msg)
+func toRecordHeaders(headers []MessageHeader) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	saramaHeaders := make([]sarama.RecordHeader, len(headers))
+	for z, h := range headers {
+		saramaHeaders[z] = sarama.RecordHeader{Key: []byte(h.Key), Value: []byte(h.Value)}
+	}
+	return saramaHeaders
+}
+
+// encodeKey the ID of the event is the message key unless it is a KeyedEvent
+func (me *messageEncoder) encodeKey(event DomainEvent) (sarama.Encoder, error) {
+	keyed, ok := event.(KeyedEvent)
+	if !ok {
+		return eventKey{sarama.StringEncoder(event.ID()), event}, nil
+	}
+	key, err := me.codec.EncodeKey(keyed)
+	if err != nil {
+		return nil, err
+	}
+	return eventKey{sarama.ByteEncoder(key), event}, nil
+}
+
+// eventKey message key carrying its event to the Partitioner, sarama keeps
+// the message metadata for itself
+type eventKey struct {
+	sarama.Encoder
+	event DomainEvent
+}
+
+func (me *messageEncoder) validateEvent(event DomainEvent) error {
+	if err := me.codec.Validate(event); err != nil {
+		return err
+	}
+	if keyed, ok := event.(KeyedEvent); ok {
+		return me.codec.Validate(keyEvent{keyed})
+	}
+	return nil
 }
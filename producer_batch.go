@@ -0,0 +1,134 @@
+package avrostry
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// PublishResult outcome of publishing one event of a batch
+type PublishResult struct {
+	Index     int // position of the event in the batch
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+// BatchError some events of a batch could not be published, the
+// results tell which ones and why
+type BatchError struct {
+	Failed int
+	Total  int
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d events could not be published", e.Failed, e.Total)
+}
+
+// PublishBatch encodes the events in parallel and sends them to topic in a
+// single call, returning a result per event in the same order.
+//
+// A batch is not atomic: events failing to encode are not sent, and the broker
+// can reject some messages while accepting the others. In both cases the
+// remaining events are published and a *BatchError is returned, the Err of
+// each result tells which events must be retried.
+//
+// With Middlewares the events are published one by one through them, in
+// order, instead of in a single call.
+func (erp *KafkaRegistryProducer) PublishBatch(topic string, events []DomainEvent) ([]PublishResult, error) {
+	if erp.wrapped {
+		return erp.publishEach(topic, events)
+	}
+
+	results := make([]PublishResult, len(events))
+	msgs := erp.encoder.encodeBatch(topic, events, results)
+
+	var (
+		toSend  []*sarama.ProducerMessage
+		indexes = make(map[*sarama.ProducerMessage]int, len(msgs))
+	)
+	for i, msg := range msgs {
+		if msg != nil {
+			toSend = append(toSend, msg)
+			indexes[msg] = i
+		}
+	}
+
+	if len(toSend) > 0 {
+		err := erp.producer.SendMessages(toSend)
+		if producerErrs, ok := err.(sarama.ProducerErrors); ok {
+			for _, producerErr := range producerErrs {
+				results[indexes[producerErr.Msg]].Err = producerErr.Err
+			}
+		} else if err != nil {
+			for _, msg := range toSend {
+				results[indexes[msg]].Err = err
+			}
+		}
+	}
+
+	failed := 0
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Partition, results[i].Offset = -1, -1
+			failed++
+		} else {
+			results[i].Partition, results[i].Offset = msgs[i].Partition, msgs[i].Offset
+		}
+	}
+	if failed > 0 {
+		return results, &BatchError{Failed: failed, Total: len(events)}
+	}
+	return results, nil
+}
+
+// publishEach publishes the events of a batch through the middlewares
+func (erp *KafkaRegistryProducer) publishEach(topic string, events []DomainEvent) ([]PublishResult, error) {
+	results := make([]PublishResult, len(events))
+	failed := 0
+	for i, event := range events {
+		results[i].Index = i
+		results[i].Partition, results[i].Offset, results[i].Err = erp.publish(context.Background(), topic, event, nil)
+		if results[i].Err != nil {
+			results[i].Partition, results[i].Offset = -1, -1
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, &BatchError{Failed: failed, Total: len(events)}
+	}
+	return results, nil
+}
+
+// encodeBatch encodes the events with a worker per CPU, the message of the
+// events failing to encode is nil and their error set in results
+func (me *messageEncoder) encodeBatch(topic string, events []DomainEvent, results []PublishResult) []*sarama.ProducerMessage {
+	msgs := make([]*sarama.ProducerMessage, len(events))
+	indexes := make(chan int)
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(events) {
+		workers = len(events)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i].Index = i
+				msgs[i], results[i].Err = me.encode(context.Background(), topic, events[i], nil)
+			}
+		}()
+	}
+	for i := range events {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return msgs
+}
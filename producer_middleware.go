@@ -0,0 +1,95 @@
+package avrostry
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// PublishFunc publishes an event, the next step of a middleware chain
+type PublishFunc func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (partition int32, offset int64, err error)
+
+// ProducerMiddleware wraps the publishing of the events. It sees the event,
+// topic and headers before encoding, can change them or not call next at
+// all, and receives the partition and offset, or error, from next.
+type ProducerMiddleware func(next PublishFunc) PublishFunc
+
+func chainProducerMiddlewares(middlewares []ProducerMiddleware, publish PublishFunc) PublishFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		publish = middlewares[i](publish)
+	}
+	return publish
+}
+
+// ErrEventFiltered an event blocked by FilterMiddleware
+var ErrEventFiltered = errors.New("event filtered")
+
+// FilterMiddleware publishes only the events allowed, the others fail with
+// ErrEventFiltered without being encoded
+func FilterMiddleware(allow func(ctx context.Context, topic string, event DomainEvent) bool) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (int32, int64, error) {
+			if !allow(ctx, topic, event) {
+				return -1, -1, ErrEventFiltered
+			}
+			return next(ctx, topic, event, headers)
+		}
+	}
+}
+
+// HeadersMiddleware adds the headers returned by headersOf, like a tenant or
+// the trace context taken from ctx. Headers given when publishing win.
+func HeadersMiddleware(headersOf func(ctx context.Context, topic string, event DomainEvent) []MessageHeader) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (int32, int64, error) {
+			return next(ctx, topic, event, withHeaders(headersOf(ctx, topic, event), headers))
+		}
+	}
+}
+
+// StaticHeadersMiddleware adds headers to every event
+func StaticHeadersMiddleware(headers ...MessageHeader) ProducerMiddleware {
+	return HeadersMiddleware(func(context.Context, string, DomainEvent) []MessageHeader {
+		return headers
+	})
+}
+
+// LoggingMiddleware logs every event published, and every failure
+func LoggingMiddleware(logger sarama.StdLogger) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (int32, int64, error) {
+			start := time.Now()
+			partition, offset, err := next(ctx, topic, event, headers)
+			if err != nil {
+				logger.Printf("could not publish event: %s, id: %s, topic: %s: %v", event.Subject(), event.ID(), topic, err)
+			} else {
+				logger.Printf("published event: %s, id: %s, topic: %s, partition: %d, offset: %d, in %s",
+					event.Subject(), event.ID(), topic, partition, offset, time.Since(start))
+			}
+			return partition, offset, err
+		}
+	}
+}
+
+// MetricsMiddleware records in registry, like the MetricRegistry of sarama,
+// the publish-latency timer and publish-error-rate meter, for every topic and
+// per topic with the -for-topic-<topic> suffix
+func MetricsMiddleware(registry metrics.Registry) ProducerMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (int32, int64, error) {
+			start := time.Now()
+			partition, offset, err := next(ctx, topic, event, headers)
+			elapsed := time.Since(start)
+			for _, suffix := range []string{"", "-for-topic-" + topic} {
+				metrics.GetOrRegisterTimer("publish-latency"+suffix, registry).Update(elapsed)
+				if err != nil {
+					metrics.GetOrRegisterMeter("publish-error-rate"+suffix, registry).Mark(1)
+				}
+			}
+			return partition, offset, err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package avrostry
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducerMiddlewares(t *testing.T) {
+	broker := newMockProducerBroker(t, "words", sarama.NewMockProduceResponse(t))
+	defer broker.Close()
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+
+	var (
+		logs     bytes.Buffer
+		registry = metrics.NewRegistry()
+		calls    []string
+		seen     []MessageHeader
+	)
+	recorder := func(name string) ProducerMiddleware {
+		return func(next PublishFunc) PublishFunc {
+			return func(ctx context.Context, topic string, event DomainEvent, headers []MessageHeader) (int32, int64, error) {
+				calls = append(calls, name)
+				seen = headers
+				return next(ctx, topic, event, headers)
+			}
+		}
+	}
+	cfg.Middlewares = []ProducerMiddleware{
+		recorder("outer"),
+		LoggingMiddleware(log.New(&logs, "", 0)),
+		MetricsMiddleware(registry),
+		FilterMiddleware(func(_ context.Context, _ string, event DomainEvent) bool {
+			return event.(Word).Word != "secret"
+		}),
+		StaticHeadersMiddleware(MessageHeader{Key: "tenant", Value: "acme"}, MessageHeader{Key: "env", Value: "test"}),
+		recorder("inner"),
+	}
+
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+
+	partition, _, err := producer.PublishWithHeaders("words", Word{Word: "uno"}, []MessageHeader{{Key: "env", Value: "prod"}})
+	require.Nil(t, err)
+	require.Equal(t, int32(0), partition)
+	require.Equal(t, []string{"outer", "inner"}, calls)
+	require.Equal(t, []MessageHeader{{Key: "tenant", Value: "acme"}, {Key: "env", Value: "prod"}}, seen)
+	require.Contains(t, logs.String(), "published event: words, id: 1, topic: words, partition: 0")
+
+	calls = nil
+	_, _, err = producer.Publish("words", Word{Word: "secret"})
+	require.Equal(t, ErrEventFiltered, err)
+	require.Equal(t, []string{"outer"}, calls)
+	require.Contains(t, logs.String(), "could not publish event: words")
+
+	require.Equal(t, int64(2), registry.Get("publish-latency").(metrics.Timer).Count())
+	require.Equal(t, int64(2), registry.Get("publish-latency-for-topic-words").(metrics.Timer).Count())
+	require.Equal(t, int64(1), registry.Get("publish-error-rate-for-topic-words").(metrics.Meter).Count())
+
+	calls = nil
+	results, err := producer.PublishBatch("words", []DomainEvent{Word{Word: "dos"}, Word{Word: "secret"}})
+	require.Equal(t, &BatchError{Failed: 1, Total: 2}, err)
+	require.Nil(t, results[0].Err)
+	require.Equal(t, PublishResult{Index: 1, Partition: -1, Offset: -1, Err: ErrEventFiltered}, results[1])
+	require.Equal(t, []string{"outer", "inner", "outer"}, calls)
+	require.Equal(t, int64(4), registry.Get("publish-latency").(metrics.Timer).Count())
+
+	_, err = NewKafkaRegistryAsyncProducer(cfg)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,63 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishBatchPartialFailure(t *testing.T) {
+	broker := newMockProducerBroker(t, "words", sarama.NewMockProduceResponse(t))
+	defer broker.Close()
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+
+	events := []DomainEvent{
+		Word{Word: "uno"},
+		invalidEmployee{map[string]interface{}{}},
+		Word{Word: "tres"},
+	}
+	results, err := producer.PublishBatch("words", events)
+	require.Equal(t, &BatchError{Failed: 1, Total: 3}, err)
+	require.Len(t, results, 3)
+
+	for i, result := range results {
+		require.Equal(t, i, result.Index)
+	}
+	require.Nil(t, results[0].Err)
+	require.Nil(t, results[2].Err)
+	require.Equal(t, int32(0), results[2].Partition)
+
+	_, missing := results[1].Err.(*MissingFieldsError)
+	require.True(t, missing)
+	require.Equal(t, int64(-1), results[1].Offset)
+}
+
+func TestPublishTombstones(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("words", 0, broker.BrokerID()).
+			SetLeader("words", 1, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+	cfg.Partitioner = NewPartitionerRoutes().Type(Word{}, ExplicitPartition(1))
+
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+
+	partition, _, err := producer.PublishEventTombstone("words", Word{Word: "uno"})
+	require.Nil(t, err)
+	require.Equal(t, int32(1), partition)
+
+	_, _, err = producer.PublishTombstone("words", []byte("1"))
+	require.Nil(t, err)
+}
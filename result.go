@@ -0,0 +1,90 @@
+package avrostry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ContextEventHandler handles a message within ctx, cancelled after the
+// ProcessingTimeout or when ReadMessages returns. It carries the Envelope of
+// the message like ConsumerMessage.Context.
+type ContextEventHandler func(ctx context.Context, msg *ConsumerMessage) Result
+
+type resultAction int
+
+const (
+	actionAck resultAction = iota
+	actionRetry
+	actionDeadLetter
+	actionSkip
+	actionStop
+)
+
+// Result what the consumer does with a handled message, the zero value is Ack
+type Result struct {
+	action resultAction
+	after  time.Duration
+	reason string
+	err    error
+}
+
+// Ack the message was handled, it is committed
+func Ack() Result {
+	return Result{action: actionAck}
+}
+
+// Retry the message after the delay, 0 for the backoff of MaxIntervalSeconds.
+// It counts towards MaxRetries; with RetryDelays it goes to the next retry
+// topic whatever the delay.
+func Retry(after time.Duration) Result {
+	return Result{action: actionRetry, after: after}
+}
+
+// SendToDeadLetter the message is discarded without more retries, sent to the
+// DeadLetterTopic with reason
+func SendToDeadLetter(reason string) Result {
+	return Result{action: actionDeadLetter, reason: reason}
+}
+
+// Skip the message is not for this handler, it is committed
+func Skip() Result {
+	return Result{action: actionSkip}
+}
+
+// Stop the consumer, ReadMessages returns err without committing the message
+func Stop(err error) Result {
+	return Result{action: actionStop, err: err}
+}
+
+func (r Result) String() string {
+	switch r.action {
+	case actionRetry:
+		if r.after > 0 {
+			return fmt.Sprintf("retry after %s", r.after)
+		}
+		return "retry"
+	case actionDeadLetter:
+		return "dead letter: " + r.reason
+	case actionSkip:
+		return "skip"
+	case actionStop:
+		return fmt.Sprintf("stop: %v", r.err)
+	}
+	return "ack"
+}
+
+// failed whether the message wasn't handled
+func (r Result) failed() bool {
+	return r.action == actionRetry || r.action == actionDeadLetter || r.action == actionStop
+}
+
+// AdaptEventHandler handler as a ContextEventHandler, false is Retry(0)
+func AdaptEventHandler(handler EventHandler) ContextEventHandler {
+	return func(_ context.Context, msg *ConsumerMessage) Result {
+		if handler(msg) {
+			return Ack()
+		}
+		return Retry(0)
+	}
+}
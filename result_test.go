@@ -0,0 +1,88 @@
+package avrostry
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// resultConsumer a consumer handing tombstones to handler, retrying without
+// backoff
+func resultConsumer(handler ContextEventHandler, errs *[]error) *KafkaRegistryConsumerGroup {
+	return &KafkaRegistryConsumerGroup{
+		cfg: ConsumerConfig{
+			ProcessingTimeout: time.Minute,
+			DeliverTombstones: true,
+			MaxRetries:        3,
+		},
+		random:     rand.New(rand.NewSource(1)),
+		handler:    handler,
+		errHandler: func(err error) { *errs = append(*errs, err) },
+	}
+}
+
+// requireProcessed processes msg, to be committed by the consumer
+func requireProcessed(t *testing.T, rgc *KafkaRegistryConsumerGroup, msg *sarama.ConsumerMessage) {
+	acked, err := rgc.process(context.Background(), msg)
+	require.Nil(t, err)
+	require.True(t, acked)
+}
+
+func TestProcessResults(t *testing.T) {
+	tombstone := &sarama.ConsumerMessage{Topic: "words", Partition: 1, Offset: 7, Key: []byte("1")}
+	var (
+		errs    []error
+		results []Result
+		calls   int
+	)
+	rgc := resultConsumer(func(ctx context.Context, msg *ConsumerMessage) Result {
+		_, hasDeadline := ctx.Deadline()
+		require.True(t, hasDeadline)
+		require.True(t, msg.IsTombstone)
+		calls++
+		if calls > len(results) {
+			return Ack()
+		}
+		return results[calls-1]
+	}, &errs)
+
+	results = []Result{Retry(0), Retry(time.Millisecond)}
+	requireProcessed(t, rgc, tombstone)
+	require.Equal(t, 3, calls)
+	require.Empty(t, errs)
+
+	calls, results = 0, []Result{Retry(0), Retry(0), Retry(0), Retry(0)}
+	requireProcessed(t, rgc, tombstone)
+	require.Equal(t, 3, calls)
+	require.Len(t, errs, 1)
+	require.Equal(t, "", errs[0].(*DiscardedMessageError).Reason())
+
+	calls, results, errs = 0, []Result{SendToDeadLetter("unknown employee")}, nil
+	requireProcessed(t, rgc, tombstone)
+	require.Equal(t, 1, calls)
+	require.Equal(t, "unknown employee", errs[0].(*DiscardedMessageError).Reason())
+	require.Contains(t, errs[0].Error(), "unknown employee")
+
+	calls, results, errs = 0, []Result{Skip()}, nil
+	requireProcessed(t, rgc, tombstone)
+	require.Empty(t, errs)
+
+	calls, results = 0, []Result{Retry(0), Stop(errors.New("database down"))}
+	_, err := rgc.process(context.Background(), tombstone)
+	require.Equal(t, 2, calls)
+	require.Contains(t, err.Error(), "database down")
+	require.Contains(t, err.Error(), "offset: 7")
+}
+
+func TestAdaptEventHandler(t *testing.T) {
+	commit := true
+	handler := AdaptEventHandler(func(*ConsumerMessage) bool { return commit })
+	require.Equal(t, Ack(), handler(context.Background(), &ConsumerMessage{}))
+	commit = false
+	require.Equal(t, Retry(0), handler(context.Background(), &ConsumerMessage{}))
+}
@@ -0,0 +1,200 @@
+package avrostry
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/pkg/errors"
+)
+
+// Headers of the messages sent to a retry topic, added to the original ones
+const (
+	RetryHeaderPrefix       = "retry_"
+	RetryAttemptHeader      = RetryHeaderPrefix + "attempt"
+	RetryTopicHeader        = RetryHeaderPrefix + "topic" // where the message was first delivered
+	RetryPartitionHeader    = RetryHeaderPrefix + "partition"
+	RetryOffsetHeader       = RetryHeaderPrefix + "offset"
+	RetryFirstFailureHeader = RetryHeaderPrefix + "first_failure" // RFC 3339 with nanoseconds
+)
+
+// RetryTopic the retry topic of topic for delay, like words.retry.5s or
+// words.retry.1m. Its messages are consumed delay after they were sent.
+func RetryTopic(topic string, delay time.Duration) string {
+	suffix := delay.String()
+	if strings.HasSuffix(suffix, "m0s") {
+		suffix = suffix[:len(suffix)-2]
+	}
+	if strings.HasSuffix(suffix, "h0m") {
+		suffix = suffix[:len(suffix)-2]
+	}
+	return topic + ".retry." + suffix
+}
+
+// retryState where from and how many times a message was retried, zero for
+// messages outside the retry topics
+type retryState struct {
+	attempt      int
+	topic        string
+	partition    int32
+	offset       int64
+	firstFailure time.Time
+}
+
+// parseRetryState the retry headers of msg, malformed ones are ignored
+func parseRetryState(msg *sarama.ConsumerMessage) retryState {
+	var state retryState
+	for _, h := range msg.Headers {
+		if h == nil {
+			continue
+		}
+		value := string(h.Value)
+		switch string(h.Key) {
+		case RetryAttemptHeader:
+			state.attempt, _ = strconv.Atoi(value)
+		case RetryTopicHeader:
+			state.topic = value
+		case RetryPartitionHeader:
+			partition, _ := strconv.ParseInt(value, 10, 32)
+			state.partition = int32(partition)
+		case RetryOffsetHeader:
+			state.offset, _ = strconv.ParseInt(value, 10, 64)
+		case RetryFirstFailureHeader:
+			state.firstFailure, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	if state.topic == "" {
+		return retryState{}
+	}
+	return state
+}
+
+func (s retryState) headers() []MessageHeader {
+	return []MessageHeader{
+		{Key: RetryAttemptHeader, Value: strconv.Itoa(s.attempt)},
+		{Key: RetryTopicHeader, Value: s.topic},
+		{Key: RetryPartitionHeader, Value: strconv.FormatInt(int64(s.partition), 10)},
+		{Key: RetryOffsetHeader, Value: strconv.FormatInt(s.offset, 10)},
+		{Key: RetryFirstFailureHeader, Value: s.firstFailure.UTC().Format(time.RFC3339Nano)},
+	}
+}
+
+// retryMessage msg, delivered with state, as sent to the next retry topic
+func retryMessage(msg *sarama.ConsumerMessage, state retryState, delays []time.Duration) *sarama.ProducerMessage {
+	next := state
+	if next.attempt == 0 {
+		next = retryState{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset, firstFailure: time.Now()}
+	}
+	next.attempt++
+	topic := RetryTopic(next.topic, delays[state.attempt])
+	return copyMessage(topic, msg, append(originalHeaders(msg), toRecordHeaders(next.headers())...))
+}
+
+// sendRetry sends msg to the retry topic of its next attempt
+func (rgc *KafkaRegistryConsumerGroup) sendRetry(msg *sarama.ConsumerMessage, state retryState) error {
+	retried := retryMessage(msg, state, rgc.cfg.RetryDelays)
+	_, _, err := rgc.republisher.SendMessage(retried)
+	return errors.Wrapf(err, "could not send message to retry topic: %s", retried.Topic)
+}
+
+// readPartitions consumes every partition on its own, so the messages waiting
+// in the retry topics don't hold the others back. Without Concurrency the
+// handler is still called for one message at a time.
+func (rgc *KafkaRegistryConsumerGroup) readPartitions(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// closed at the start of a rebalance, which releases every partition
+	released := make(chan struct{})
+
+	fatal := make(chan error, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-fatal:
+			return err
+
+		case err := <-rgc.workers.failed():
+			return err
+
+		case err, ok := <-rgc.consumer.Errors():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			if err := rgc.kafkaError(err); err != nil {
+				return err
+			}
+
+		case n, ok := <-rgc.consumer.Notifications():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			if n.Type == cluster.RebalanceStart {
+				close(released)
+				released = make(chan struct{})
+			}
+
+		case pc, ok := <-rgc.consumer.Partitions():
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			wg.Add(1)
+			go func(released <-chan struct{}) {
+				defer wg.Done()
+				if err := rgc.consumePartition(ctx, pc, released); err != nil {
+					select {
+					case fatal <- err:
+					default:
+					}
+				}
+			}(released)
+		}
+	}
+}
+
+// consumePartition processes the messages of pc until it is released by a
+// rebalance, delaying the ones of a retry topic. A message whose delay is
+// interrupted by the release is left to the partition's next owner.
+func (rgc *KafkaRegistryConsumerGroup) consumePartition(ctx context.Context, pc cluster.PartitionConsumer, released <-chan struct{}) error {
+	delay := rgc.retryTopics[pc.Topic()]
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-released:
+			return nil
+
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return nil
+			}
+			if delay > 0 && !msg.Timestamp.IsZero() {
+				select {
+				case <-time.After(time.Until(msg.Timestamp.Add(delay))):
+				case <-released:
+					return nil
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			if err := rgc.consume(ctx, msg); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
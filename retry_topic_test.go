@@ -0,0 +1,122 @@
+package avrostry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTopic(t *testing.T) {
+	require.Equal(t, "words.retry.5s", RetryTopic("words", 5*time.Second))
+	require.Equal(t, "words.retry.1m", RetryTopic("words", time.Minute))
+	require.Equal(t, "words.retry.10m", RetryTopic("words", 10*time.Minute))
+	require.Equal(t, "words.retry.1m30s", RetryTopic("words", 90*time.Second))
+	require.Equal(t, "words.retry.2h", RetryTopic("words", 2*time.Hour))
+}
+
+func TestRetryMessages(t *testing.T) {
+	delays := []time.Duration{5 * time.Second, time.Minute}
+	original := &sarama.ConsumerMessage{
+		Topic:     "words",
+		Partition: 1,
+		Offset:    12,
+		Key:       []byte("1"),
+		Value:     []byte("uno"),
+		Headers:   []*sarama.RecordHeader{{Key: []byte(EventIDHeader), Value: []byte("uno")}},
+	}
+	require.Equal(t, retryState{}, parseRetryState(original))
+
+	first := retryMessage(original, parseRetryState(original), delays)
+	require.Equal(t, "words.retry.5s", first.Topic)
+	delivered := consumed(t, first, 3)
+	state := parseRetryState(delivered)
+	require.Equal(t, 1, state.attempt)
+	require.Equal(t, "words", state.topic)
+	require.Equal(t, int32(1), state.partition)
+	require.Equal(t, int64(12), state.offset)
+	require.WithinDuration(t, time.Now(), state.firstFailure, time.Minute)
+
+	second := retryMessage(delivered, state, delays)
+	require.Equal(t, "words.retry.1m", second.Topic)
+	require.Len(t, second.Headers, 6)
+	require.Equal(t, []byte(EventIDHeader), second.Headers[0].Key)
+	next := parseRetryState(consumed(t, second, 8))
+	require.Equal(t, 2, next.attempt)
+	require.Equal(t, int64(12), next.offset)
+	require.Equal(t, state.firstFailure, next.firstFailure)
+
+	// dead letters of retried messages are redriven to the original topic
+	dl := DeadLetter{Topic: next.topic, Partition: next.partition, Offset: next.offset}
+	redriven, _, err := redriveMessage(consumed(t, deadLetterMessage("words.dlq", consumed(t, second, 8), dl), 0))
+	require.Nil(t, err)
+	require.Equal(t, "words", redriven.Topic)
+	require.Equal(t, []sarama.RecordHeader{*original.Headers[0]}, redriven.Headers)
+}
+
+func TestConsumerConfigRetryDelays(t *testing.T) {
+	cfg, err := NewConsumerConfig(
+		ConsumerBrokers("kafka:9092"),
+		ConsumerName("employees"),
+		ConsumerTopics("employees"),
+	)
+	require.Nil(t, err)
+	cfg.SchemaRegistryURL = "http://registry:8081"
+	require.Nil(t, cfg.settings()["retry_delays"]("5s, 1m, 10m"))
+	require.Equal(t, []time.Duration{5 * time.Second, time.Minute, 10 * time.Minute}, cfg.RetryDelays)
+	require.Equal(t, []string{"DeadLetterTopic"}, configFields(cfg.Validate()))
+	cfg.DeadLetterTopic = "employees-dlq"
+	require.Nil(t, cfg.Validate())
+
+	cfg.RetryDelays = append(cfg.RetryDelays, 0)
+	require.Equal(t, []string{"RetryDelays[3]"}, configFields(cfg.Validate()))
+}
+
+// fakePartitionConsumer a partition consumer of messages
+type fakePartitionConsumer struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (f *fakePartitionConsumer) AsyncClose()                               {}
+func (f *fakePartitionConsumer) Close() error                              { return nil }
+func (f *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage  { return f.messages }
+func (f *fakePartitionConsumer) Errors() <-chan *sarama.ConsumerError      { return nil }
+func (f *fakePartitionConsumer) HighWaterMarkOffset() int64                { return 0 }
+func (f *fakePartitionConsumer) Topic() string                             { return f.topic }
+func (f *fakePartitionConsumer) Partition() int32                          { return 0 }
+func (f *fakePartitionConsumer) InitialOffset() int64                      { return 0 }
+func (f *fakePartitionConsumer) MarkOffset(offset int64, metadata string)  {}
+func (f *fakePartitionConsumer) ResetOffset(offset int64, metadata string) {}
+
+func TestConsumePartitionLeavesDelayedMessageOnRelease(t *testing.T) {
+	var (
+		errs    []error
+		handled int
+	)
+	rgc := resultConsumer(func(context.Context, *ConsumerMessage) Result {
+		handled++
+		return Ack()
+	}, &errs)
+	topic := RetryTopic("words", time.Hour)
+	rgc.retryTopics = map[string]time.Duration{topic: time.Hour}
+
+	pc := &fakePartitionConsumer{topic: topic, messages: make(chan *sarama.ConsumerMessage, 1)}
+	pc.messages <- &sarama.ConsumerMessage{Topic: topic, Timestamp: time.Now(), Value: []byte("x")}
+	released := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- rgc.consumePartition(context.Background(), pc, released)
+	}()
+
+	close(released)
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("still waiting for the delay of a released partition")
+	}
+	require.Zero(t, handled)
+}
@@ -0,0 +1,138 @@
+package avrostry
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EventFactory builds the event of its type from a decoded message
+type EventFactory func(map[string]interface{}) (DomainEvent, error)
+
+// TypedEventHandler handles a message with its event built by an EventFactory
+type TypedEventHandler func(DomainEvent, *ConsumerMessage) (shouldCommit bool)
+
+// ContextTypedEventHandler the TypedEventHandler of HandleContextEvent
+type ContextTypedEventHandler func(ctx context.Context, event DomainEvent, msg *ConsumerMessage) Result
+
+// EventRouter dispatches messages to handlers by their Subject. Subjects
+// ending with * match by prefix, * alone matches any, an exact match wins
+// over the prefixes and the longest prefix over the others. Its HandleMessage
+// is an EventHandler and its HandleContextMessage a ContextEventHandler, the
+// latter keeps the Result of the context handlers.
+type EventRouter struct {
+	subjects   map[string]ContextEventHandler
+	prefixes   []prefixRoute // longest first
+	fallback   ContextEventHandler
+	errHandler ErrorHandler
+}
+
+type prefixRoute struct {
+	prefix  string
+	handler ContextEventHandler
+}
+
+// NewEventRouter EventRouter constructor, errHandler gets the events an
+// EventFactory couldn't build, optional
+func NewEventRouter(errHandler ErrorHandler) *EventRouter {
+	if errHandler == nil {
+		errHandler = NullErrorHandler
+	}
+	return &EventRouter{subjects: map[string]ContextEventHandler{}, errHandler: errHandler}
+}
+
+// Handle routes the messages of subject to handler, replacing the previous one
+func (r *EventRouter) Handle(subject string, handler EventHandler) *EventRouter {
+	return r.HandleContext(subject, AdaptEventHandler(handler))
+}
+
+// HandleContext routes the messages of subject to handler, replacing the
+// previous one
+func (r *EventRouter) HandleContext(subject string, handler ContextEventHandler) *EventRouter {
+	if !strings.HasSuffix(subject, "*") {
+		r.subjects[subject] = handler
+		return r
+	}
+
+	prefix := strings.TrimSuffix(subject, "*")
+	for i := range r.prefixes {
+		if r.prefixes[i].prefix == prefix {
+			r.prefixes[i].handler = handler
+			return r
+		}
+	}
+	r.prefixes = append(r.prefixes, prefixRoute{prefix, handler})
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+	return r
+}
+
+// HandleEvent routes the messages of the subject of event to handler, with
+// their event built by factory. Messages it can't build go to the
+// ErrorHandler and are committed.
+func (r *EventRouter) HandleEvent(event DomainEvent, factory EventFactory, handler TypedEventHandler) *EventRouter {
+	return r.Handle(event.Subject(), func(msg *ConsumerMessage) bool {
+		built, err := factory(msg.Event)
+		if err != nil {
+			r.errHandler(errors.Wrapf(err, "could not build event: subject: %s, topic: %s, partition: %d, offset: %d",
+				msg.Subject, msg.Topic, msg.Partition, msg.Offset))
+			return true
+		}
+		return handler(built, msg)
+	})
+}
+
+// HandleContextEvent routes the messages of the subject of event to handler,
+// with their event built by factory. Messages it can't build are sent to
+// the DeadLetterTopic.
+func (r *EventRouter) HandleContextEvent(event DomainEvent, factory EventFactory, handler ContextTypedEventHandler) *EventRouter {
+	return r.HandleContext(event.Subject(), func(ctx context.Context, msg *ConsumerMessage) Result {
+		built, err := factory(msg.Event)
+		if err != nil {
+			return SendToDeadLetter("could not build event: " + err.Error())
+		}
+		return handler(ctx, built, msg)
+	})
+}
+
+// Fallback handles the messages without a route, they are committed
+// without one
+func (r *EventRouter) Fallback(handler EventHandler) *EventRouter {
+	return r.FallbackContext(AdaptEventHandler(handler))
+}
+
+// FallbackContext like Fallback for a ContextEventHandler
+func (r *EventRouter) FallbackContext(handler ContextEventHandler) *EventRouter {
+	r.fallback = handler
+	return r
+}
+
+// HandleMessage the EventHandler dispatching msg, the Results of the context
+// handlers commit msg unless they are failures
+func (r *EventRouter) HandleMessage(msg *ConsumerMessage) bool {
+	return !r.HandleContextMessage(msg.Context(), msg).failed()
+}
+
+// HandleContextMessage the ContextEventHandler dispatching msg, Skip
+// without a route
+func (r *EventRouter) HandleContextMessage(ctx context.Context, msg *ConsumerMessage) Result {
+	if handler := r.route(msg.Subject); handler != nil {
+		return handler(ctx, msg)
+	}
+	return Skip()
+}
+
+func (r *EventRouter) route(subject string) ContextEventHandler {
+	if handler, ok := r.subjects[subject]; ok {
+		return handler
+	}
+	for _, route := range r.prefixes {
+		if strings.HasPrefix(subject, route.prefix) {
+			return route.handler
+		}
+	}
+	return r.fallback
+}
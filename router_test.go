@@ -0,0 +1,97 @@
+package avrostry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventRouterRoutes(t *testing.T) {
+	var routed []string
+	route := func(name string) EventHandler {
+		return func(*ConsumerMessage) bool {
+			routed = append(routed, name)
+			return true
+		}
+	}
+
+	router := NewEventRouter(nil).
+		Handle("employees", route("employees")).
+		Handle("employees*", route("employees*")).
+		Handle("employees-v2*", route("employees-v2*")).
+		Handle("*", route("*"))
+	for _, subject := range []string{"employees", "employees-key", "employees-v2", "words"} {
+		require.True(t, router.HandleMessage(&ConsumerMessage{Subject: subject}))
+	}
+	require.Equal(t, []string{"employees", "employees*", "employees-v2*", "*"}, routed)
+
+	routed = nil
+	router = NewEventRouter(nil).Handle("employees", route("employees"))
+	require.True(t, router.HandleMessage(&ConsumerMessage{Subject: "words"}))
+	require.Empty(t, routed)
+	router.Fallback(route("fallback"))
+	router.HandleMessage(&ConsumerMessage{Subject: "words"})
+	require.Equal(t, []string{"fallback"}, routed)
+}
+
+func TestEventRouterBuildsEvents(t *testing.T) {
+	var errs []error
+	router := NewEventRouter(func(err error) { errs = append(errs, err) })
+
+	var handled []Word
+	router.HandleEvent(Word{},
+		func(event map[string]interface{}) (DomainEvent, error) {
+			word, ok := event["Word"].(string)
+			if !ok {
+				return nil, errors.New("Word is not a string")
+			}
+			return Word{Word: word}, nil
+		},
+		func(event DomainEvent, msg *ConsumerMessage) bool {
+			handled = append(handled, event.(Word))
+			return msg.Offset != 1
+		})
+
+	require.True(t, router.HandleMessage(&ConsumerMessage{Subject: "words", Event: map[string]interface{}{"Word": "uno"}}))
+	require.False(t, router.HandleMessage(&ConsumerMessage{Subject: "words", Offset: 1, Event: map[string]interface{}{"Word": "dos"}}))
+	require.Equal(t, []Word{{"uno"}, {"dos"}}, handled)
+
+	require.True(t, router.HandleMessage(&ConsumerMessage{Subject: "words", Offset: 2, Event: map[string]interface{}{"Word": 3}}))
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "offset: 2")
+}
+
+func TestEventRouterContextHandlers(t *testing.T) {
+	router := NewEventRouter(nil)
+	router.HandleContextEvent(Word{},
+		func(event map[string]interface{}) (DomainEvent, error) {
+			word, ok := event["Word"].(string)
+			if !ok {
+				return nil, errors.New("Word is not a string")
+			}
+			return Word{Word: word}, nil
+		},
+		func(_ context.Context, event DomainEvent, _ *ConsumerMessage) Result {
+			if event.(Word).Word == "dos" {
+				return Retry(time.Second)
+			}
+			return Ack()
+		})
+	router.FallbackContext(func(context.Context, *ConsumerMessage) Result {
+		return Stop(errors.New("unknown subject"))
+	})
+
+	ctx := context.Background()
+	require.Equal(t, Ack(), router.HandleContextMessage(ctx, &ConsumerMessage{Subject: "words", Event: map[string]interface{}{"Word": "uno"}}))
+	require.Equal(t, Retry(time.Second), router.HandleContextMessage(ctx, &ConsumerMessage{Subject: "words", Event: map[string]interface{}{"Word": "dos"}}))
+	require.False(t, router.HandleMessage(&ConsumerMessage{Subject: "words", Event: map[string]interface{}{"Word": "dos"}}))
+
+	result := router.HandleContextMessage(ctx, &ConsumerMessage{Subject: "words", Event: map[string]interface{}{"Word": 3}})
+	require.Equal(t, SendToDeadLetter("could not build event: Word is not a string"), result)
+	require.Equal(t, "stop: unknown subject", router.HandleContextMessage(ctx, &ConsumerMessage{Subject: "employees"}).String())
+
+	require.Equal(t, Skip(), NewEventRouter(nil).HandleContextMessage(ctx, &ConsumerMessage{Subject: "words"}))
+}
@@ -0,0 +1,115 @@
+package avrostry
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TopicAware is implemented by events naming their own topic
+type TopicAware interface {
+	Topic() string
+}
+
+// TopicRouter chooses the topic of an event published without one
+type TopicRouter interface {
+	Topic(event DomainEvent) (string, error)
+}
+
+// TopicRouterFunc a function as TopicRouter
+type TopicRouterFunc func(event DomainEvent) (string, error)
+
+// Topic TopicRouter
+func (f TopicRouterFunc) Topic(event DomainEvent) (string, error) {
+	return f(event)
+}
+
+// NoTopicError no route matches the event
+type NoTopicError struct {
+	Subject string
+}
+
+func (e *NoTopicError) Error() string {
+	return fmt.Sprintf("no topic for event of subject: %s", e.Subject)
+}
+
+// eventMatcher values registered by event subject or Go type, the
+// subject wins when both match
+type eventMatcher struct {
+	subjects map[string]interface{}
+	types    map[reflect.Type]interface{}
+}
+
+func (m *eventMatcher) setSubject(subject string, v interface{}) {
+	if m.subjects == nil {
+		m.subjects = map[string]interface{}{}
+	}
+	m.subjects[subject] = v
+}
+
+func (m *eventMatcher) setType(event DomainEvent, v interface{}) {
+	if m.types == nil {
+		m.types = map[reflect.Type]interface{}{}
+	}
+	m.types[reflect.TypeOf(event)] = v
+}
+
+func (m *eventMatcher) match(event DomainEvent) (interface{}, bool) {
+	if event == nil {
+		return nil, false
+	}
+	if v, ok := m.subjects[event.Subject()]; ok {
+		return v, true
+	}
+	v, ok := m.types[reflect.TypeOf(event)]
+	return v, ok
+}
+
+// TopicRoutes TopicRouter by subject or type of the event, TopicAware
+// events choose their topic themselves. Routes are registered before
+// publishing, they aren't safe to change concurrently.
+type TopicRoutes struct {
+	matcher eventMatcher
+	// Topic of the events without route, none when empty
+	Default string
+}
+
+// NewTopicRoutes TopicRoutes constructor
+func NewTopicRoutes() *TopicRoutes {
+	return &TopicRoutes{}
+}
+
+// Subject routes the events of subject to topic
+func (r *TopicRoutes) Subject(subject, topic string) *TopicRoutes {
+	r.matcher.setSubject(subject, topic)
+	return r
+}
+
+// Type routes the events of the Go type of event to topic, a pointer and
+// its value are different types
+func (r *TopicRoutes) Type(event DomainEvent, topic string) *TopicRoutes {
+	r.matcher.setType(event, topic)
+	return r
+}
+
+// Topic TopicRouter
+func (r *TopicRoutes) Topic(event DomainEvent) (string, error) {
+	if aware, ok := event.(TopicAware); ok {
+		return aware.Topic(), nil
+	}
+	if topic, ok := r.matcher.match(event); ok {
+		return topic.(string), nil
+	}
+	if r.Default != "" {
+		return r.Default, nil
+	}
+	return "", &NoTopicError{Subject: event.Subject()}
+}
+
+// routeTopic the topic of event with router, only TopicAware events can be
+// routed without one
+func routeTopic(router TopicRouter, event DomainEvent) (string, error) {
+	if router == nil {
+		router = NewTopicRoutes()
+	}
+	return router.Topic(event)
+}
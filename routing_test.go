@@ -0,0 +1,115 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+// routedWord a Word publishing to its own topic
+type routedWord struct {
+	Word
+}
+
+func (routedWord) Topic() string {
+	return "routed-words"
+}
+
+func TestTopicRoutes(t *testing.T) {
+	routes := NewTopicRoutes().
+		Subject("josgilmo.avrostry.create_employee", "employees").
+		Type(Word{}, "words")
+
+	topic, err := routes.Topic(Word{Word: "uno"})
+	require.Nil(t, err)
+	require.Equal(t, "words", topic)
+
+	topic, err = routes.Topic(invalidEmployee{})
+	require.Nil(t, err)
+	require.Equal(t, "employees", topic)
+
+	topic, err = routes.Topic(routedWord{})
+	require.Nil(t, err)
+	require.Equal(t, "routed-words", topic)
+
+	_, err = routes.Topic(&Word{})
+	require.Equal(t, &NoTopicError{Subject: Word{}.Subject()}, err)
+
+	routes.Default = "events"
+	topic, err = routes.Topic(&Word{})
+	require.Nil(t, err)
+	require.Equal(t, "events", topic)
+}
+
+func TestMurmur2MatchesJavaClient(t *testing.T) {
+	for key, hash := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		require.Equal(t, hash, murmur2([]byte(key)), key)
+	}
+
+	partition, err := Murmur2Partitioner().Partition(nil, []byte("foobar"), 10)
+	require.Nil(t, err)
+	require.Equal(t, int32((-790332482&0x7fffffff)%10), partition)
+}
+
+func TestPartitionerRoutes(t *testing.T) {
+	routes := NewPartitionerRoutes().
+		Type(Word{}, ExplicitPartition(2)).
+		Subject("josgilmo.avrostry.create_employee", PartitionerFunc(func(event DomainEvent, key []byte, n int32) (int32, error) {
+			return n - 1, nil
+		}))
+
+	partition, err := routes.Partition(Word{}, []byte("uno"), 3)
+	require.Nil(t, err)
+	require.Equal(t, int32(2), partition)
+	_, err = routes.Partition(Word{}, []byte("uno"), 2)
+	require.NotNil(t, err)
+
+	partition, err = routes.Partition(invalidEmployee{}, []byte("1"), 8)
+	require.Nil(t, err)
+	require.Equal(t, int32(7), partition)
+
+	expected, err := sarama.NewHashPartitioner("").Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("uno")}, 8)
+	require.Nil(t, err)
+	partition, err = routes.Partition(&Word{}, []byte("uno"), 8)
+	require.Nil(t, err)
+	require.Equal(t, expected, partition)
+}
+
+func TestPublishEventRoutesAndPartitions(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("words", 0, broker.BrokerID()).
+			SetLeader("words", 1, broker.BrokerID()).
+			SetLeader("routed-words", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+	cfg.TopicRouter = NewTopicRoutes().Type(Word{}, "words")
+	cfg.Partitioner = NewPartitionerRoutes().Type(Word{}, ExplicitPartition(1))
+
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+
+	partition, _, err := producer.PublishEvent(Word{Word: "uno"})
+	require.Nil(t, err)
+	require.Equal(t, int32(1), partition)
+
+	partition, _, err = producer.PublishEvent(routedWord{Word{Word: "dos"}})
+	require.Nil(t, err)
+	require.Equal(t, int32(0), partition)
+
+	_, _, err = producer.PublishEvent(invalidEmployee{})
+	require.Equal(t, &NoTopicError{Subject: "josgilmo.avrostry.create_employee"}, err)
+}
@@ -0,0 +1,99 @@
+package avrostry
+
+import "sync"
+
+// SchemaFormat encodes and decodes the payload of events for a schema type
+type SchemaFormat interface {
+	Type() SchemaType
+
+	// Encode converts the native event, as returned by ToStringMap,
+	// to the payload written after the message framing
+	Encode(schema string, native interface{}) ([]byte, error)
+
+	// Decode converts a payload, written with schema, to a native value
+	Decode(schema string, payload []byte) (interface{}, error)
+}
+
+// TypedSchemaEvent is implemented by events with a schema type other than Avro,
+// Schema is registered and used for encoding in place of AvroSchema
+type TypedSchemaEvent interface {
+	SchemaType() SchemaType
+	Schema() string
+}
+
+func eventSchema(event DomainEvent) (SchemaType, string) {
+	if typed, ok := event.(TypedSchemaEvent); ok {
+		return typed.SchemaType(), typed.Schema()
+	}
+	return AvroSchemaType, event.AvroSchema()
+}
+
+// AvroFormat Avro binary payloads, fields missing in the native
+// events are filled with the default values declared in the schema
+type AvroFormat struct {
+	cacheCodec *CacheCodec
+	strict     bool
+
+	sync.RWMutex
+	types map[string]*avroType // schema => parsed schema
+}
+
+// NewAvroFormat AvroFormat constructor
+func NewAvroFormat(cache *CacheCodec) *AvroFormat {
+	return &AvroFormat{cacheCodec: cache, types: map[string]*avroType{}}
+}
+
+// NewStrictAvroFormat AvroFormat whose Validate also reports the fields not
+// defined in the schema, which goavro ignores when encoding
+func NewStrictAvroFormat(cache *CacheCodec) *AvroFormat {
+	f := NewAvroFormat(cache)
+	f.strict = true
+	return f
+}
+
+func (f *AvroFormat) Type() SchemaType {
+	return AvroSchemaType
+}
+
+func (f *AvroFormat) Encode(schema string, native interface{}) ([]byte, error) {
+	codec, err := f.cacheCodec.Get(schema)
+	if err != nil {
+		return nil, err
+	}
+	if t := f.parse(schema); t != nil {
+		native, err = t.fillDefaults(native)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codec.BinaryFromNative(nil, native)
+}
+
+// parse returns nil for schemas accepted by goavro but not understood
+// by the parser, they are encoded as they are
+func (f *AvroFormat) parse(schema string) *avroType {
+	f.RLock()
+	t, exists := f.types[schema]
+	f.RUnlock()
+	if exists {
+		return t
+	}
+
+	t, err := parseAvroSchema(schema)
+	if err != nil {
+		t = nil
+	}
+	f.Lock()
+	f.types[schema] = t
+	f.Unlock()
+	return t
+}
+
+func (f *AvroFormat) Decode(schema string, payload []byte) (interface{}, error) {
+	codec, err := f.cacheCodec.Get(schema)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := codec.NativeFromBinary(payload)
+	return native, err
+}
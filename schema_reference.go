@@ -0,0 +1,294 @@
+package avrostry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SchemaReference Confluent reference to a named type defined in another subject
+type SchemaReference struct {
+	// Full name of the referenced Avro type
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int32  `json:"version"`
+}
+
+// SchemaReferencer is implemented by events that declare explicitly the
+// references of their AvroSchema.
+type SchemaReferencer interface {
+	SchemaReferences() []SchemaReference
+}
+
+var avroPrimitives = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+// namedTypeLookup returns the definition of a named type given its full name.
+type namedTypeLookup func(fullName string) (definition interface{}, found bool)
+
+// SchemaResolver stores named types defined in other subjects, so an event
+// AvroSchema can use them only by name.
+type SchemaResolver struct {
+	sync.RWMutex
+	types map[string]*namedType // full name => type
+}
+
+type namedType struct {
+	subject    string
+	schema     string
+	definition interface{}
+}
+
+// NewSchemaResolver SchemaResolver constructor.
+func NewSchemaResolver() *SchemaResolver {
+	return &SchemaResolver{types: map[string]*namedType{}}
+}
+
+// Add stores every named type defined in schema as belonging to subject.
+func (r *SchemaResolver) Add(subject, schema string) error {
+	definitions, err := namedTypeDefinitions(schema)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	for name, definition := range definitions {
+		r.types[name] = &namedType{subject: subject, schema: schema, definition: definition}
+	}
+	r.Unlock()
+	return nil
+}
+
+// AddEvent stores the named types defined in the event schema under its subject.
+func (r *SchemaResolver) AddEvent(event DomainEvent) error {
+	return r.Add(event.Subject(), event.AvroSchema())
+}
+
+// Resolve returns schema with every named type known by the resolver inlined.
+func (r *SchemaResolver) Resolve(schema string) (string, error) {
+	return expandSchema(schema, r.lookup)
+}
+
+func (r *SchemaResolver) lookup(fullName string) (interface{}, bool) {
+	r.RLock()
+	t, found := r.types[fullName]
+	r.RUnlock()
+	if !found {
+		return nil, false
+	}
+	return t.definition, true
+}
+
+func (r *SchemaResolver) get(fullName string) (*namedType, bool) {
+	r.RLock()
+	t, found := r.types[fullName]
+	r.RUnlock()
+	return t, found
+}
+
+// unresolvedNames returns the named types used, but not defined, in schema.
+func unresolvedNames(schema string) ([]string, error) {
+	var names []string
+	_, err := expandSchema(schema, func(fullName string) (interface{}, bool) {
+		names = append(names, fullName)
+		return nil, false
+	})
+	return names, err
+}
+
+// namedTypeDefinitions returns every record, enum and fixed defined in schema
+// hashed by full name. The name of each definition is replaced by its full
+// name, so it can be inlined in any other namespace.
+func namedTypeDefinitions(schema string) (map[string]interface{}, error) {
+	node, err := parseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	definitions := map[string]interface{}{}
+	w := &schemaWalker{
+		defined: map[string]bool{},
+		onDefinition: func(fullName string, definition map[string]interface{}) {
+			definitions[fullName] = definition
+		},
+	}
+	if _, err := w.walk(node, ""); err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+// expandSchema inlines, the first time it is used, every named type not
+// defined in schema but found by lookup.
+func expandSchema(schema string, lookup namedTypeLookup) (string, error) {
+	node, err := parseSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	w := &schemaWalker{defined: map[string]bool{}, lookup: lookup}
+	expanded, err := w.walk(node, "")
+	if err != nil {
+		return "", err
+	}
+	if !w.changed {
+		return schema, nil
+	}
+	buf, err := json.Marshal(expanded)
+	return string(buf), err
+}
+
+func parseSchema(schema string) (interface{}, error) {
+	var node interface{}
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+	if err := decoder.Decode(&node); err != nil {
+		return nil, fmt.Errorf("cannot parse schema: %s", err)
+	}
+	return node, nil
+}
+
+type schemaWalker struct {
+	defined      map[string]bool
+	lookup       namedTypeLookup
+	onDefinition func(fullName string, definition map[string]interface{})
+	changed      bool
+}
+
+func (w *schemaWalker) walk(node interface{}, namespace string) (interface{}, error) {
+	switch n := node.(type) {
+	case string:
+		return w.walkName(n, namespace)
+
+	case []interface{}:
+		for i, branch := range n {
+			expanded, err := w.walk(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = expanded
+		}
+		return n, nil
+
+	case map[string]interface{}:
+		typeName, _ := n["type"].(string)
+		switch typeName {
+		case "record", "error", "enum", "fixed":
+			return w.walkDefinition(n, namespace)
+		case "array":
+			return w.walkField(n, "items", namespace)
+		case "map":
+			return w.walkField(n, "values", namespace)
+		}
+		return w.walkField(n, "type", namespace)
+	}
+
+	return node, nil
+}
+
+func (w *schemaWalker) walkName(name string, namespace string) (interface{}, error) {
+	if avroPrimitives[name] {
+		return name, nil
+	}
+	fullName := qualifyName(name, namespace)
+	if w.defined[fullName] || w.lookup == nil {
+		return name, nil
+	}
+	definition, found := w.lookup(fullName)
+	if !found {
+		return name, nil
+	}
+
+	// Definitions are shared between schemas, work on a copy
+	copied, err := copySchemaNode(definition)
+	if err != nil {
+		return nil, err
+	}
+	w.changed = true
+	return w.walk(copied, namespace)
+}
+
+func (w *schemaWalker) walkDefinition(definition map[string]interface{}, namespace string) (interface{}, error) {
+	name, _ := definition["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("named type without name: %v", definition["type"])
+	}
+	if ns, ok := definition["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	fullName := qualifyName(name, namespace)
+	w.defined[fullName] = true
+
+	if w.onDefinition != nil {
+		copied := make(map[string]interface{}, len(definition))
+		for k, v := range definition {
+			copied[k] = v
+		}
+		copied["name"] = fullName
+		delete(copied, "namespace")
+		w.onDefinition(fullName, copied)
+	}
+
+	if definition["type"] != "record" && definition["type"] != "error" {
+		return definition, nil
+	}
+
+	fields, _ := definition["fields"].([]interface{})
+	for _, f := range fields {
+		field, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, err := w.walkField(field, "type", namespaceOf(fullName)); err != nil {
+			return nil, err
+		}
+	}
+	return definition, nil
+}
+
+func (w *schemaWalker) walkField(node map[string]interface{}, key string, namespace string) (interface{}, error) {
+	value, found := node[key]
+	if !found {
+		return node, nil
+	}
+	expanded, err := w.walk(value, namespace)
+	if err != nil {
+		return nil, err
+	}
+	node[key] = expanded
+	return node, nil
+}
+
+func qualifyName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func namespaceOf(fullName string) string {
+	if i := strings.LastIndex(fullName, "."); i >= 0 {
+		return fullName[:i]
+	}
+	return ""
+}
+
+func copySchemaNode(node interface{}) (interface{}, error) {
+	buf, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	err = decoder.Decode(&copied)
+	return copied, err
+}
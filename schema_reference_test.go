@@ -0,0 +1,209 @@
+package avrostry
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/require"
+)
+
+const phoneSchema = `{
+	"type": "record",
+	"name": "phone",
+	"namespace": "common",
+	"fields": [
+		{"name": "countryCode", "type": "string", "default": "34"},
+		{"name": "number", "type": "string"}
+	]
+}`
+
+const contactSchema = `{
+	"type": "record",
+	"name": "contact",
+	"namespace": "crm",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "phone", "type": ["null", "common.phone"]},
+		{"name": "mobile", "type": "common.phone"}
+	]
+}`
+
+type contact struct {
+	Name   string
+	Number string
+}
+
+func (contact) AvroSchema() string {
+	return contactSchema
+}
+
+func (contact) Subject() string {
+	return "crm.contact"
+}
+
+func (c contact) ToStringMap() map[string]interface{} {
+	phone := map[string]interface{}{"countryCode": "34", "number": c.Number}
+	return map[string]interface{}{
+		"name":   c.Name,
+		"phone":  goavro.Union("common.phone", phone),
+		"mobile": phone,
+	}
+}
+
+func (c contact) ID() string {
+	return c.Name
+}
+
+func TestExpandSchemaInlinesFirstUseOnly(t *testing.T) {
+	resolver := NewSchemaResolver()
+	require.Nil(t, resolver.Add("phone", phoneSchema))
+
+	expanded, err := resolver.Resolve(contactSchema)
+	require.Nil(t, err)
+	require.NotEqual(t, contactSchema, expanded)
+
+	// The second use of common.phone must stay as a name, goavro fails on redefinitions
+	_, err = goavro.NewCodec(expanded)
+	require.Nil(t, err)
+
+	names, err := unresolvedNames(expanded)
+	require.Nil(t, err)
+	require.Empty(t, names)
+}
+
+func TestExpandSchemaKeepsSelfContainedSchemas(t *testing.T) {
+	expanded, err := NewSchemaResolver().Resolve(phoneSchema)
+	require.Nil(t, err)
+	require.Equal(t, phoneSchema, expanded)
+
+	names, err := unresolvedNames(contactSchema)
+	require.Nil(t, err)
+	require.Equal(t, []string{"common.phone", "common.phone"}, names)
+}
+
+func TestNamedTypeDefinitionsQualifiesNestedTypes(t *testing.T) {
+	definitions, err := namedTypeDefinitions(`{
+		"type": "record",
+		"name": "address",
+		"namespace": "common",
+		"fields": [
+			{"name": "country", "type": {"type": "enum", "name": "country", "symbols": ["ES", "UK"]}},
+			{"name": "zip", "type": {"type": "fixed", "name": "other.zip", "size": 5}}
+		]
+	}`)
+	require.Nil(t, err)
+	require.Len(t, definitions, 3)
+	require.Contains(t, definitions, "common.address")
+	require.Contains(t, definitions, "common.country")
+	require.Contains(t, definitions, "other.zip")
+}
+
+func TestCodecWithLocalResolverRegistersReferences(t *testing.T) {
+	registry, server := newFakeSchemaRegistry()
+	defer server.Close()
+
+	resolver := NewSchemaResolver()
+	require.Nil(t, resolver.Add("phone", phoneSchema))
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	codec := NewKafkaAvroCodecWithResolver(manager, NewCacheCodec(), resolver)
+
+	buf, err := codec.Encode(contact{Name: "John", Number: "2070685000"})
+	require.Nil(t, err)
+
+	contactVersions := registry.subjects["crm.contact"]
+	require.Len(t, contactVersions, 1)
+	require.Equal(t, []SchemaReference{{Name: "common.phone", Subject: "phone", Version: 1}}, contactVersions[0].References)
+
+	// Consumers without local resolver resolve the references from the registry
+	manager = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	subject, event, err := NewKafkaAvroCodec(manager, NewCacheCodec()).Decode(buf)
+	require.Nil(t, err)
+	require.Equal(t, "crm.contact", subject)
+
+	data := event.(map[string]interface{})
+	require.Equal(t, "John", data["name"])
+	require.Equal(t, "2070685000", data["mobile"].(map[string]interface{})["number"])
+}
+
+func TestCodecWithoutReferencesSupport(t *testing.T) {
+	resolver := NewSchemaResolver()
+	require.Nil(t, resolver.Add("phone", phoneSchema))
+	codec := NewKafkaAvroCodecWithResolver(plainSchemaRegistry{}, NewCacheCodec(), resolver)
+
+	_, err := codec.Encode(contact{Name: "John"})
+	require.NotNil(t, err)
+}
+
+type plainSchemaRegistry struct{}
+
+func (plainSchemaRegistry) Register(subject, schema string) (int32, error) {
+	return 1, nil
+}
+
+func (plainSchemaRegistry) GetByID(id int32) (string, error) {
+	return "", nil
+}
+
+type countingSchemaRegistry struct {
+	plainSchemaRegistry
+	registered int
+}
+
+func (r *countingSchemaRegistry) Register(subject, schema string) (int32, error) {
+	r.registered++
+	return 1, nil
+}
+
+func TestCodecWithResolverCachesSchemasWithoutReferences(t *testing.T) {
+	registry := &countingSchemaRegistry{}
+	codec := NewKafkaAvroCodecWithResolver(registry, NewCacheCodec(), NewSchemaResolver())
+
+	for i := 0; i < 3; i++ {
+		_, err := codec.Encode(Word{Word: "hola"})
+		require.Nil(t, err)
+	}
+	require.Equal(t, 1, registry.registered)
+}
+
+type subjectCountingSchemaRegistry struct {
+	plainSchemaRegistry
+	registered map[string]int
+}
+
+func (r *subjectCountingSchemaRegistry) Register(subject, schema string) (int32, error) {
+	r.registered[subject]++
+	return 1, nil
+}
+
+func (r *subjectCountingSchemaRegistry) RegisterWithType(subject, schema string, schemaType SchemaType, references []SchemaReference) (int32, error) {
+	r.registered[subject]++
+	return 2, nil
+}
+
+func (r *subjectCountingSchemaRegistry) GetMetadataByID(id int32) (*SchemaMetadata, error) {
+	return nil, nil
+}
+
+type renamedWord struct {
+	Word
+}
+
+func (renamedWord) Subject() string {
+	return "renamed-word"
+}
+
+func TestCodecRegistersSchemasOncePerSubject(t *testing.T) {
+	registry := &subjectCountingSchemaRegistry{registered: map[string]int{}}
+	codec := NewKafkaAvroCodecWithResolver(registry, NewCacheCodec(), NewSchemaResolver())
+
+	for i := 0; i < 2; i++ {
+		_, err := codec.Encode(Word{Word: "hola"})
+		require.Nil(t, err)
+		_, err = codec.Encode(renamedWord{Word{Word: "hola"}})
+		require.Nil(t, err)
+		_, err = codec.Encode(person{map[string]interface{}{"id": "1", "name": "John", "age": 51}})
+		require.Nil(t, err)
+	}
+	require.Equal(t, map[string]int{"words": 1, "renamed-word": 1, "person": 1}, registry.registered)
+}
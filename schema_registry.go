@@ -1,11 +1,13 @@
 package avrostry
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -16,11 +18,47 @@ type SchemaRegistryClient interface {
 	GetByID(id int32) (schema string, err error)
 }
 
+// SchemaReferenceClient Interface for Schema Registries supporting schema references
+type SchemaReferenceClient interface {
+	SchemaRegistryClient
+	RegisterWithReferences(subject, schema string, references []SchemaReference) (id int32, err error)
+	GetMetadataByID(id int32) (*SchemaMetadata, error)
+	GetBySubjectAndVersion(subject string, version int32) (*SchemaMetadata, error)
+	LookupBySubjectAndSchema(subject, schema string, references []SchemaReference) (*SchemaMetadata, error)
+}
+
+// SchemaTypeClient Interface for Schema Registries supporting schema types other than Avro
+type SchemaTypeClient interface {
+	SchemaRegistryClient
+	RegisterWithType(subject, schema string, schemaType SchemaType, references []SchemaReference) (id int32, err error)
+	GetMetadataByID(id int32) (*SchemaMetadata, error)
+}
+
+// SchemaType Schema Registry schema format
+type SchemaType string
+
+const (
+	AvroSchemaType     SchemaType = "AVRO"
+	JSONSchemaType     SchemaType = "JSON"
+	ProtobufSchemaType SchemaType = "PROTOBUF"
+)
+
 // SchemaMetadata Metainformation about Schemas
 type SchemaMetadata struct {
-	ID      int32
-	Version int32
-	Schema  string
+	ID         int32             `json:"id"`
+	Subject    string            `json:"subject,omitempty"`
+	Version    int32             `json:"version"`
+	SchemaType SchemaType        `json:"schemaType,omitempty"`
+	Schema     string            `json:"schema"`
+	References []SchemaReference `json:"references,omitempty"`
+}
+
+// Type returns the schema type, Schema Registry omits it for Avro schemas
+func (m *SchemaMetadata) Type() SchemaType {
+	if m.SchemaType == "" {
+		return AvroSchemaType
+	}
+	return m.SchemaType
 }
 
 // CompatibilityLevel Schema Registry compatibility level
@@ -60,7 +98,16 @@ type RegisterSchemaResponse struct {
 
 // GetSchemaResponse Schema string response
 type GetSchemaResponse struct {
-	Schema string `json:"schema"`
+	SchemaType SchemaType        `json:"schemaType,omitempty"`
+	Schema     string            `json:"schema"`
+	References []SchemaReference `json:"references,omitempty"`
+}
+
+// RegisterSchemaRequest Schema register and lookup request
+type RegisterSchemaRequest struct {
+	SchemaType SchemaType        `json:"schemaType,omitempty"`
+	Schema     string            `json:"schema"`
+	References []SchemaReference `json:"references,omitempty"`
 }
 
 type HttpDoer interface {
@@ -85,38 +132,56 @@ func NewSchemaRegistryManager(registryURL string, cache *CacheSchemaRegistry, ht
 
 // Register set a subject schema in Schema Registry if there is not in cache.
 func (srm *SchemaRegistryManager) Register(subject string, schema string) (int32, error) {
+	return srm.RegisterWithReferences(subject, schema, nil)
+}
+
+// RegisterWithReferences set a subject schema, which uses named types defined
+// in other subjects, in Schema Registry if there is not in cache.
+func (srm *SchemaRegistryManager) RegisterWithReferences(subject string, schema string, references []SchemaReference) (int32, error) {
+	return srm.RegisterWithType(subject, schema, AvroSchemaType, references)
+}
+
+// RegisterWithType set a subject schema of any schema type in Schema Registry if there is not in cache.
+func (srm *SchemaRegistryManager) RegisterWithType(subject string, schema string, schemaType SchemaType, references []SchemaReference) (int32, error) {
 	id, exists := srm.cache.GetIDBySubjectAndSquema(subject, schema)
 	if exists {
 		return id, nil
 	}
 
-	request, err := srm.newDefaultRequest("POST",
-		fmt.Sprintf(RegisterNewSchema, subject),
-		strings.NewReader(fmt.Sprintf(`{"schema": %s}`, strconv.Quote(schema))))
-
-	response, err := srm.httpDoer.Do(request)
+	body, err := srm.post(fmt.Sprintf(RegisterNewSchema, url.PathEscape(subject)),
+		newRegisterSchemaRequest(schema, schemaType, references))
 	if err != nil {
 		return 0, err
 	}
 
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
+	var decodedResponse RegisterSchemaResponse
+	err = json.Unmarshal(body, &decodedResponse)
 	if err != nil {
 		return 0, err
 	}
+	srm.cache.SetBySubjectSquema(subject, schema, decodedResponse.ID)
+	srm.cache.SetReferencesByID(decodedResponse.ID, references)
+	srm.cache.SetSchemaTypeByID(decodedResponse.ID, schemaType)
+	return decodedResponse.ID, err
+}
 
-	if !isOK(response.StatusCode) {
-		return 0, newError(body)
+// LookupBySubjectAndSchema retrieve the id and version of a schema already registered under subject
+func (srm *SchemaRegistryManager) LookupBySubjectAndSchema(subject string, schema string, references []SchemaReference) (*SchemaMetadata, error) {
+	body, err := srm.post(fmt.Sprintf(CheckIsRegistered, url.PathEscape(subject)),
+		RegisterSchemaRequest{Schema: schema, References: references})
+	if err != nil {
+		return nil, err
 	}
 
-	var decodedResponse RegisterSchemaResponse
-	err = json.Unmarshal(body, &decodedResponse)
+	var metadata SchemaMetadata
+	err = json.Unmarshal(body, &metadata)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	srm.cache.SetBySubjectSquema(subject, schema, decodedResponse.ID)
-	return decodedResponse.ID, err
+	srm.cache.SetBySubjectSquema(subject, schema, metadata.ID)
+	srm.cache.SetReferencesByID(metadata.ID, metadata.References)
+	srm.cache.SetBySubjectVersion(subject, metadata.Version, &metadata)
+	return &metadata, nil
 }
 
 // GetByID given an id, retrieve the related Schema from Kafka Schema Registry
@@ -126,34 +191,114 @@ func (srm *SchemaRegistryManager) GetByID(id int32) (string, error) {
 		return schema, nil
 	}
 
-	request, err := srm.newDefaultRequest("GET", fmt.Sprintf(GetSchemaByID, id), nil)
+	metadata, err := srm.GetMetadataByID(id)
 	if err != nil {
 		return "", err
 	}
+	return metadata.Schema, nil
+}
+
+// GetMetadataByID given an id, retrieve the related Schema and its references from Kafka Schema Registry
+func (srm *SchemaRegistryManager) GetMetadataByID(id int32) (*SchemaMetadata, error) {
+	schema, exists := srm.cache.GetByID(id)
+	if exists {
+		// Schemas cached without references don't use them
+		references, _ := srm.cache.GetReferencesByID(id)
+		schemaType, _ := srm.cache.GetSchemaTypeByID(id)
+		return &SchemaMetadata{ID: id, SchemaType: schemaType, Schema: schema, References: references}, nil
+	}
+
+	body, err := srm.get(fmt.Sprintf(GetSchemaByID, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var decodedResponse GetSchemaResponse
+	err = json.Unmarshal(body, &decodedResponse)
+	if err != nil {
+		return nil, err
+	}
+	srm.cache.SetSchemaByID(id, decodedResponse.Schema)
+	srm.cache.SetReferencesByID(id, decodedResponse.References)
+	srm.cache.SetSchemaTypeByID(id, decodedResponse.SchemaType)
+	return &SchemaMetadata{
+		ID:         id,
+		SchemaType: decodedResponse.SchemaType,
+		Schema:     decodedResponse.Schema,
+		References: decodedResponse.References,
+	}, nil
+}
+
+// GetBySubjectAndVersion retrieve a concrete version of a subject from Kafka Schema Registry
+func (srm *SchemaRegistryManager) GetBySubjectAndVersion(subject string, version int32) (*SchemaMetadata, error) {
+	metadata, exists := srm.cache.GetBySubjectVersion(subject, version)
+	if exists {
+		return metadata, nil
+	}
+
+	body, err := srm.get(fmt.Sprintf(GetSpecificSubjectVersion, url.PathEscape(subject), strconv.Itoa(int(version))))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata = &SchemaMetadata{}
+	err = json.Unmarshal(body, metadata)
+	if err != nil {
+		return nil, err
+	}
+	srm.cache.SetSchemaByID(metadata.ID, metadata.Schema)
+	srm.cache.SetReferencesByID(metadata.ID, metadata.References)
+	srm.cache.SetSchemaTypeByID(metadata.ID, metadata.SchemaType)
+	srm.cache.SetBySubjectVersion(subject, version, metadata)
+	return metadata, nil
+}
+
+// newRegisterSchemaRequest omits the schema type for Avro, so registries without
+// support for other schema types keep working
+func newRegisterSchemaRequest(schema string, schemaType SchemaType, references []SchemaReference) RegisterSchemaRequest {
+	if schemaType == AvroSchemaType {
+		schemaType = ""
+	}
+	return RegisterSchemaRequest{SchemaType: schemaType, Schema: schema, References: references}
+}
+
+func (srm *SchemaRegistryManager) get(uri string) ([]byte, error) {
+	request, err := srm.newDefaultRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return srm.do(request)
+}
+
+func (srm *SchemaRegistryManager) post(uri string, payload interface{}) ([]byte, error) {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	request, err := srm.newDefaultRequest("POST", uri, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return srm.do(request)
+}
 
+func (srm *SchemaRegistryManager) do(request *http.Request) ([]byte, error) {
 	response, err := srm.httpDoer.Do(request)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if !isOK(response.StatusCode) {
-		return "", newError(body)
+		return nil, newError(body)
 	}
-
-	var decodedResponse GetSchemaResponse
-	err = json.Unmarshal(body, &decodedResponse)
-	if err != nil {
-		return "", err
-	}
-	srm.cache.SetSchemaByID(id, decodedResponse.Schema)
-	return decodedResponse.Schema, err
+	return body, nil
 }
 
 func (srm *SchemaRegistryManager) newDefaultRequest(method string, uri string, reader io.Reader) (*http.Request, error) {
@@ -0,0 +1,165 @@
+package avrostry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSchemaRegistry in memory Schema Registry serving the API used by SchemaRegistryManager
+type fakeSchemaRegistry struct {
+	sync.Mutex
+	schemas  []*SchemaMetadata            // id - 1 => schema
+	subjects map[string][]*SchemaMetadata // subject => version - 1 => schema
+	requests int
+}
+
+func newFakeSchemaRegistry() (*fakeSchemaRegistry, *httptest.Server) {
+	registry := &fakeSchemaRegistry{subjects: map[string][]*SchemaMetadata{}}
+	return registry, httptest.NewServer(registry)
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "schemas":
+		id, _ := strconv.Atoi(parts[2])
+		if id < 1 || id > len(f.schemas) {
+			f.error(w, 40403, "Schema not found")
+			return
+		}
+		schema := f.schemas[id-1]
+		json.NewEncoder(w).Encode(GetSchemaResponse{SchemaType: schema.SchemaType, Schema: schema.Schema, References: schema.References})
+
+	case r.Method == "GET" && len(parts) == 4 && parts[0] == "subjects":
+		versions := f.subjects[parts[1]]
+		version, _ := strconv.Atoi(parts[3])
+		if version < 1 || version > len(versions) {
+			f.error(w, 40402, "Version not found")
+			return
+		}
+		json.NewEncoder(w).Encode(versions[version-1])
+
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "subjects":
+		var request RegisterSchemaRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		schema := f.lookup(parts[1], request)
+		if schema == nil {
+			schema = &SchemaMetadata{
+				ID:         int32(len(f.schemas) + 1),
+				Subject:    parts[1],
+				Version:    int32(len(f.subjects[parts[1]]) + 1),
+				SchemaType: request.SchemaType,
+				Schema:     request.Schema,
+				References: request.References,
+			}
+			f.schemas = append(f.schemas, schema)
+			f.subjects[parts[1]] = append(f.subjects[parts[1]], schema)
+		}
+		json.NewEncoder(w).Encode(RegisterSchemaResponse{ID: schema.ID})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[0] == "subjects":
+		var request RegisterSchemaRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		schema := f.lookup(parts[1], request)
+		if schema == nil {
+			f.error(w, 40403, "Schema not found")
+			return
+		}
+		json.NewEncoder(w).Encode(schema)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeSchemaRegistry) lookup(subject string, request RegisterSchemaRequest) *SchemaMetadata {
+	for _, schema := range f.subjects[subject] {
+		if schema.Schema == request.Schema && schema.SchemaType == request.SchemaType {
+			return schema
+		}
+	}
+	return nil
+}
+
+func (f *fakeSchemaRegistry) error(w http.ResponseWriter, code int32, message string) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(ErrorMessage{Code: code, Message: message})
+}
+
+func TestSchemaRegistryManagerRegisterWithReferences(t *testing.T) {
+	_, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+
+	phoneID, err := manager.Register("phone", phoneSchema)
+	require.Nil(t, err)
+
+	references := []SchemaReference{{Name: "common.phone", Subject: "phone", Version: 1}}
+	id, err := manager.RegisterWithReferences("contact", contactSchema, references)
+	require.Nil(t, err)
+	require.NotEqual(t, phoneID, id)
+
+	// A new manager, without cache, gets the references from the registry
+	manager = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	metadata, err := manager.GetMetadataByID(id)
+	require.Nil(t, err)
+	require.Equal(t, contactSchema, metadata.Schema)
+	require.Equal(t, references, metadata.References)
+
+	metadata, err = manager.GetBySubjectAndVersion("phone", 1)
+	require.Nil(t, err)
+	require.Equal(t, phoneID, metadata.ID)
+	require.Equal(t, phoneSchema, metadata.Schema)
+
+	metadata, err = manager.LookupBySubjectAndSchema("contact", contactSchema, references)
+	require.Nil(t, err)
+	require.Equal(t, id, metadata.ID)
+	require.Equal(t, int32(1), metadata.Version)
+}
+
+func TestSchemaRegistryManagerError(t *testing.T) {
+	_, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+
+	_, err := manager.GetByID(42)
+	require.NotNil(t, err)
+	registryErr, ok := err.(*ErrorMessage)
+	require.True(t, ok, fmt.Sprintf("unexpected error %T", err))
+	require.Equal(t, int32(40403), registryErr.Code)
+}
+
+func TestSchemaRegistryManagerRegisterWithType(t *testing.T) {
+	registry, server := newFakeSchemaRegistry()
+	defer server.Close()
+	manager := NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+
+	avroID, err := manager.Register("avro", phoneSchema)
+	require.Nil(t, err)
+	jsonID, err := manager.RegisterWithType("json", `{"type": "object"}`, JSONSchemaType, nil)
+	require.Nil(t, err)
+
+	// Avro is the default schema type, it's not sent for compatibility with old registries
+	require.Equal(t, SchemaType(""), registry.subjects["avro"][0].SchemaType)
+	require.Equal(t, JSONSchemaType, registry.subjects["json"][0].SchemaType)
+
+	manager = NewSchemaRegistryManager(server.URL, NewCacheSchemaRegistry(), http.DefaultClient)
+	metadata, err := manager.GetMetadataByID(avroID)
+	require.Nil(t, err)
+	require.Equal(t, AvroSchemaType, metadata.Type())
+	metadata, err = manager.GetMetadataByID(jsonID)
+	require.Nil(t, err)
+	require.Equal(t, JSONSchemaType, metadata.Type())
+}
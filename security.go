@@ -0,0 +1,154 @@
+package avrostry
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// SASLMechanism SASL authentication mechanism
+type SASLMechanism string
+
+const (
+	SASLPlain       SASLMechanism = "PLAIN"
+	SASLScramSHA256 SASLMechanism = "SCRAM-SHA-256"
+	SASLScramSHA512 SASLMechanism = "SCRAM-SHA-512"
+)
+
+// UnsupportedSASLMechanismError a mechanism other than PLAIN and SCRAM
+type UnsupportedSASLMechanismError struct {
+	Mechanism SASLMechanism
+}
+
+func (e *UnsupportedSASLMechanismError) Error() string {
+	return fmt.Sprintf("SASL mechanism: %s, unsupported, use %s, %s or %s",
+		e.Mechanism, SASLPlain, SASLScramSHA256, SASLScramSHA512)
+}
+
+// scramHashes hash of each SCRAM mechanism
+var scramHashes = map[SASLMechanism]scram.HashGeneratorFcn{
+	SASLScramSHA256: sha256.New,
+	SASLScramSHA512: sha512.New,
+}
+
+// supported whether apply knows the mechanism, empty is PLAIN
+func (m SASLMechanism) supported() bool {
+	return m == "" || m == SASLPlain || scramHashes[m] != nil
+}
+
+// scramClient sarama.SCRAMClient of the xdg/scram conversation
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+// TLSConfig encrypts the connections to the brokers
+type TLSConfig struct {
+	Enable             bool
+	CAFile             string // PEM, the system pool when empty
+	CertFile           string // PEM client certificate, with KeyFile
+	KeyFile            string
+	InsecureSkipVerify bool // development only, accepts any broker certificate
+}
+
+// SASLConfig authenticates with the brokers
+type SASLConfig struct {
+	Enable    bool
+	Mechanism SASLMechanism // SASLPlain when empty
+	User      string
+	Password  string
+}
+
+// SecurityConfig TLS and SASL settings of producers and consumers, both
+// enabled for SASL_SSL clusters
+type SecurityConfig struct {
+	TLS  TLSConfig
+	SASL SASLConfig
+}
+
+// apply sets the security settings on config
+func (sc SecurityConfig) apply(config *sarama.Config) error {
+	if sc.TLS.Enable {
+		tlsConfig, err := sc.TLS.build()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if sc.SASL.Enable {
+		mechanism := sc.SASL.Mechanism
+		if !mechanism.supported() {
+			return &UnsupportedSASLMechanismError{mechanism}
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = sc.SASL.User
+		config.Net.SASL.Password = sc.SASL.Password
+		if hash := scramHashes[mechanism]; hash != nil {
+			config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hash: hash}
+			}
+		} else {
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		}
+	}
+	return nil
+}
+
+func (tc TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify}
+
+	if tc.CAFile != "" {
+		ca, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in CA file: %s", tc.CAFile)
+		}
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// baseSaramaConfig a copy of override, or the sarama defaults without it
+func baseSaramaConfig(override *sarama.Config) *sarama.Config {
+	if override == nil {
+		return sarama.NewConfig()
+	}
+	config := *override
+	return &config
+}
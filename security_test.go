@@ -0,0 +1,98 @@
+package avrostry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self signed certificate and its key as PEM files
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "avrostry-test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestSecurityConfigTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avrostry")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	config := sarama.NewConfig()
+	security := SecurityConfig{TLS: TLSConfig{Enable: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}}
+	require.Nil(t, security.apply(config))
+	require.True(t, config.Net.TLS.Enable)
+	require.NotNil(t, config.Net.TLS.Config.RootCAs)
+	require.Len(t, config.Net.TLS.Config.Certificates, 1)
+	require.False(t, config.Net.TLS.Config.InsecureSkipVerify)
+
+	security.TLS.CAFile = keyFile
+	require.NotNil(t, security.apply(sarama.NewConfig()))
+}
+
+func TestSecurityConfigSASL(t *testing.T) {
+	config := sarama.NewConfig()
+	require.Nil(t, SecurityConfig{SASL: SASLConfig{Enable: true, User: "john", Password: "secret"}}.apply(config))
+	require.True(t, config.Net.SASL.Enable)
+	require.Equal(t, "john", config.Net.SASL.User)
+
+	require.Equal(t, sarama.SASLMechanism(sarama.SASLTypePlaintext), config.Net.SASL.Mechanism)
+
+	scram := SecurityConfig{SASL: SASLConfig{Enable: true, Mechanism: SASLScramSHA512, User: "john", Password: "secret"}}
+	config = sarama.NewConfig()
+	require.Nil(t, scram.apply(config))
+	require.Equal(t, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), config.Net.SASL.Mechanism)
+	require.Nil(t, config.Validate())
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	require.Nil(t, client.Begin("john", "secret", ""))
+	first, err := client.Step("")
+	require.Nil(t, err)
+	require.Contains(t, first, "n=john,r=")
+	require.False(t, client.Done())
+
+	gssapi := SecurityConfig{SASL: SASLConfig{Enable: true, Mechanism: "GSSAPI", User: "john"}}
+	require.Equal(t, &UnsupportedSASLMechanismError{"GSSAPI"}, gssapi.apply(sarama.NewConfig()))
+}
+
+func TestSaramaConfigOverride(t *testing.T) {
+	override := sarama.NewConfig()
+	override.Metadata.Retry.Max = 9
+
+	cfg := DefaultProducerConfig()
+	cfg.ClientID = "avrostry-test"
+	cfg.SaramaConfig = override
+	config, err := newSaramaProducerConfig(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 9, config.Metadata.Retry.Max)
+	require.Equal(t, "avrostry-test", config.ClientID)
+	require.Equal(t, "sarama", override.ClientID)
+}
@@ -0,0 +1,622 @@
+package avrostry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+var (
+	// ErrNotTransactional transaction methods of a producer without TransactionalID
+	ErrNotTransactional = errors.New("producer has no TransactionalID")
+	// ErrTxnInProgress BeginTxn while a transaction is open
+	ErrTxnInProgress = errors.New("transaction already in progress")
+	// ErrNoTxn publishing with a transactional producer, or ending a
+	// transaction, without BeginTxn
+	ErrNoTxn = errors.New("no transaction in progress")
+)
+
+// TxnAbortRequiredError a message of the transaction failed, it can't be
+// committed and must be aborted
+type TxnAbortRequiredError struct {
+	Err error
+}
+
+func (e *TxnAbortRequiredError) Error() string {
+	return fmt.Sprintf("transaction must be aborted: %s", e.Err)
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// transactionalProducer sarama.SyncProducer whose messages belong to the
+// transaction opened by beginTxn. sarama 1.27 produces idempotently but
+// doesn't run transactions, the producer id, sequence numbers and
+// transaction requests are handled here with the requests of sarama.
+//
+// Messages are sent one request at a time.
+type transactionalProducer struct {
+	client          sarama.Client
+	config          *sarama.Config
+	transactionalID string
+	txnTimeout      time.Duration
+
+	sync.Mutex
+	producerID    int64
+	producerEpoch int16
+	sequences     map[topicPartition]int32
+	partitioners  map[string]sarama.Partitioner
+	coordinator   *sarama.Broker // nil until looked up
+	// a batch may have been written without its response, the sequence of
+	// its partition is unknown until the epoch is bumped
+	staleEpoch bool
+
+	inTxn         bool
+	txnStarted    bool // partitions or offsets were added to the transaction
+	txnPartitions map[topicPartition]bool
+	txnErr        error
+}
+
+func newTransactionalProducer(cfg ProducerConfig, config *sarama.Config) (*transactionalProducer, error) {
+	config.Producer.RequiredAcks = sarama.WaitForAll
+
+	client, err := sarama.NewClient(cfg.Addrs, config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &transactionalProducer{
+		client:          client,
+		config:          config,
+		transactionalID: cfg.TransactionalID,
+		txnTimeout:      cfg.TransactionTimeout,
+		partitioners:    map[string]sarama.Partitioner{},
+	}
+	if err := p.initProducerID(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// initProducerID gets the producer id, or bumps the epoch of the current
+// one, fencing the batches sent with the previous epoch. Sequences start
+// again from 0.
+func (p *transactionalProducer) initProducerID() error {
+	err := p.retry(func() error {
+		coordinator, err := p.txnCoordinator()
+		if err != nil {
+			return err
+		}
+		res, err := coordinator.InitProducerID(&sarama.InitProducerIDRequest{
+			TransactionalID:    &p.transactionalID,
+			TransactionTimeout: p.txnTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Err != sarama.ErrNoError {
+			return res.Err
+		}
+		p.producerID, p.producerEpoch = res.ProducerID, res.ProducerEpoch
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.sequences = map[topicPartition]int32{}
+	p.staleEpoch = false
+	return nil
+}
+
+// SendMessage sarama.SyncProducer
+func (p *transactionalProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := p.SendMessages([]*sarama.ProducerMessage{msg}); err != nil {
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			return -1, -1, errs[0].Err
+		}
+		return -1, -1, err
+	}
+	return msg.Partition, msg.Offset, nil
+}
+
+// SendMessages sarama.SyncProducer, nothing is sent once a message of the
+// transaction failed
+func (p *transactionalProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.inTxn {
+		return ErrNoTxn
+	}
+	if p.txnErr != nil {
+		return &TxnAbortRequiredError{p.txnErr}
+	}
+
+	batches := map[topicPartition][]*sarama.ProducerMessage{}
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if err := p.partition(msg); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+			continue
+		}
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = time.Now()
+		}
+		tp := topicPartition{msg.Topic, msg.Partition}
+		batches[tp] = append(batches[tp], msg)
+	}
+
+	if err := p.addPartitionsToTxn(batches); err != nil {
+		for _, batch := range batches {
+			for _, msg := range batch {
+				errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+			}
+		}
+		batches = nil
+	}
+
+	errs = append(errs, p.send(batches)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	p.txnErr = errs[0].Err
+	return errs
+}
+
+// Close sarama.SyncProducer, an open transaction is aborted by the
+// coordinator once it times out
+func (p *transactionalProducer) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.coordinator != nil {
+		p.coordinator.Close()
+		p.coordinator = nil
+	}
+	return p.client.Close()
+}
+
+func (p *transactionalProducer) partition(msg *sarama.ProducerMessage) error {
+	partitioner, ok := p.partitioners[msg.Topic]
+	if !ok {
+		partitioner = p.config.Producer.Partitioner(msg.Topic)
+		p.partitioners[msg.Topic] = partitioner
+	}
+	partitions, err := p.client.Partitions(msg.Topic)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return sarama.ErrLeaderNotAvailable
+	}
+	i, err := partitioner.Partition(msg, int32(len(partitions)))
+	if err != nil {
+		return err
+	}
+	msg.Partition = partitions[i]
+	return nil
+}
+
+// send produces the batches, retrying the partitions failing with retriable
+// errors with the same sequence numbers. A batch failing after a request
+// without response may have been written, the epoch must be bumped before
+// producing again.
+func (p *transactionalProducer) send(batches map[topicPartition][]*sarama.ProducerMessage) sarama.ProducerErrors {
+	var errs sarama.ProducerErrors
+	maybeWritten := map[topicPartition]bool{}
+	for attempt := 0; len(batches) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.config.Producer.Retry.Backoff)
+			topics := map[string]bool{}
+			for tp := range batches {
+				topics[tp.topic] = true
+			}
+			for topic := range topics {
+				p.client.RefreshMetadata(topic)
+			}
+		}
+
+		retries := map[topicPartition][]*sarama.ProducerMessage{}
+		for tp, err := range p.produce(batches, maybeWritten) {
+			if retriable(err) && attempt < p.config.Producer.Retry.Max {
+				retries[tp] = batches[tp]
+				continue
+			}
+			if maybeWritten[tp] {
+				p.staleEpoch = true
+			}
+			for _, msg := range batches[tp] {
+				errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+			}
+		}
+		batches = retries
+	}
+	return errs
+}
+
+// produce sends a request to the leader of each partition, returning the
+// errors of the partitions that failed. The batches sent without knowing
+// whether they were written are added to maybeWritten, only those accept a
+// duplicate sequence number.
+func (p *transactionalProducer) produce(batches map[topicPartition][]*sarama.ProducerMessage, maybeWritten map[topicPartition]bool) map[topicPartition]error {
+	failed := map[topicPartition]error{}
+	byLeader := map[*sarama.Broker][]topicPartition{}
+	for tp := range batches {
+		leader, err := p.client.Leader(tp.topic, tp.partition)
+		if err != nil {
+			failed[tp] = err
+			continue
+		}
+		byLeader[leader] = append(byLeader[leader], tp)
+	}
+
+	for leader, tps := range byLeader {
+		req := &sarama.ProduceRequest{
+			TransactionalID: &p.transactionalID,
+			RequiredAcks:    p.config.Producer.RequiredAcks,
+			Timeout:         int32(p.config.Producer.Timeout / time.Millisecond),
+			Version:         3,
+		}
+		for _, tp := range tps {
+			batch, err := p.recordBatch(batches[tp], p.sequences[tp])
+			if err != nil {
+				failed[tp] = err
+				continue
+			}
+			req.AddBatch(tp.topic, tp.partition, batch)
+		}
+
+		res, err := leader.Produce(req)
+		if err != nil {
+			leader.Close()
+		}
+		for _, tp := range tps {
+			if _, ok := failed[tp]; ok {
+				continue
+			}
+			var block *sarama.ProduceResponseBlock
+			if res != nil {
+				block = res.GetBlock(tp.topic, tp.partition)
+			}
+			switch {
+			case err != nil:
+				failed[tp] = err
+				maybeWritten[tp] = true
+			case block == nil:
+				failed[tp] = sarama.ErrIncompleteResponse
+				maybeWritten[tp] = true
+			case block.Err == sarama.ErrNoError,
+				block.Err == sarama.ErrDuplicateSequenceNumber && maybeWritten[tp]:
+				for i, msg := range batches[tp] {
+					msg.Offset = block.Offset + int64(i)
+				}
+				p.sequences[tp] = nextSequence(p.sequences[tp], len(batches[tp]))
+			default:
+				failed[tp] = block.Err
+				if block.Err == sarama.ErrRequestTimedOut || block.Err == sarama.ErrNetworkException {
+					maybeWritten[tp] = true
+				}
+			}
+		}
+	}
+	return failed
+}
+
+// recordBatch the transactional batch of msgs, starting at sequence
+func (p *transactionalProducer) recordBatch(msgs []*sarama.ProducerMessage, sequence int32) (*sarama.RecordBatch, error) {
+	first := msgs[0].Timestamp
+	batch := &sarama.RecordBatch{
+		Version:          2,
+		Codec:            p.config.Producer.Compression,
+		CompressionLevel: p.config.Producer.CompressionLevel,
+		FirstTimestamp:   first,
+		MaxTimestamp:     first,
+		ProducerID:       p.producerID,
+		ProducerEpoch:    p.producerEpoch,
+		FirstSequence:    sequence,
+		IsTransactional:  true,
+		LastOffsetDelta:  int32(len(msgs) - 1),
+	}
+	for i, msg := range msgs {
+		key, err := encodeValue(msg.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := encodeValue(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		headers := make([]*sarama.RecordHeader, len(msg.Headers))
+		for j := range msg.Headers {
+			headers[j] = &msg.Headers[j]
+		}
+		if msg.Timestamp.After(batch.MaxTimestamp) {
+			batch.MaxTimestamp = msg.Timestamp
+		}
+		batch.Records = append(batch.Records, &sarama.Record{
+			Headers:        headers,
+			TimestampDelta: msg.Timestamp.Sub(first),
+			OffsetDelta:    int64(i),
+			Key:            key,
+			Value:          value,
+		})
+	}
+	return batch, nil
+}
+
+func encodeValue(enc sarama.Encoder) ([]byte, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	return enc.Encode()
+}
+
+// beginTxn bumps the epoch first when the previous transaction left
+// sequences unknown
+func (p *transactionalProducer) beginTxn() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.inTxn {
+		return ErrTxnInProgress
+	}
+	if p.staleEpoch {
+		if err := p.initProducerID(); err != nil {
+			return err
+		}
+	}
+	p.inTxn, p.txnStarted, p.txnErr = true, false, nil
+	p.txnPartitions = map[topicPartition]bool{}
+	return nil
+}
+
+func (p *transactionalProducer) addPartitionsToTxn(batches map[topicPartition][]*sarama.ProducerMessage) error {
+	partitions := map[string][]int32{}
+	for tp := range batches {
+		if !p.txnPartitions[tp] {
+			partitions[tp.topic] = append(partitions[tp.topic], tp.partition)
+		}
+	}
+	if len(partitions) == 0 {
+		return nil
+	}
+
+	err := p.retry(func() error {
+		coordinator, err := p.txnCoordinator()
+		if err != nil {
+			return err
+		}
+		res, err := coordinator.AddPartitionsToTxn(&sarama.AddPartitionsToTxnRequest{
+			TransactionalID: p.transactionalID,
+			ProducerID:      p.producerID,
+			ProducerEpoch:   p.producerEpoch,
+			TopicPartitions: partitions,
+		})
+		if err != nil {
+			return err
+		}
+		return firstPartitionError(res.Errors)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.txnStarted = true
+	for topic, ids := range partitions {
+		for _, id := range ids {
+			p.txnPartitions[topicPartition{topic, id}] = true
+		}
+	}
+	return nil
+}
+
+func (p *transactionalProducer) sendOffsetsToTxn(groupID string, offsets map[string]map[int32]int64) error {
+	p.Lock()
+	defer p.Unlock()
+	if !p.inTxn {
+		return ErrNoTxn
+	}
+
+	err := p.retry(func() error {
+		coordinator, err := p.txnCoordinator()
+		if err != nil {
+			return err
+		}
+		res, err := coordinator.AddOffsetsToTxn(&sarama.AddOffsetsToTxnRequest{
+			TransactionalID: p.transactionalID,
+			ProducerID:      p.producerID,
+			ProducerEpoch:   p.producerEpoch,
+			GroupID:         groupID,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Err != sarama.ErrNoError {
+			return res.Err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.txnStarted = true
+
+	topics := map[string][]*sarama.PartitionOffsetMetadata{}
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			topics[topic] = append(topics[topic], &sarama.PartitionOffsetMetadata{Partition: partition, Offset: offset})
+		}
+	}
+	return p.retry(func() error {
+		coordinator, err := p.findCoordinator(sarama.CoordinatorGroup, groupID)
+		if err != nil {
+			return err
+		}
+		defer coordinator.Close()
+		res, err := coordinator.TxnOffsetCommit(&sarama.TxnOffsetCommitRequest{
+			TransactionalID: p.transactionalID,
+			GroupID:         groupID,
+			ProducerID:      p.producerID,
+			ProducerEpoch:   p.producerEpoch,
+			Topics:          topics,
+		})
+		if err != nil {
+			return err
+		}
+		return firstPartitionError(res.Topics)
+	})
+}
+
+// endTxn commits or aborts the open transaction, a transaction with failed
+// messages can only be aborted
+func (p *transactionalProducer) endTxn(commit bool) error {
+	p.Lock()
+	defer p.Unlock()
+	if !p.inTxn {
+		return ErrNoTxn
+	}
+	if commit && p.txnErr != nil {
+		return &TxnAbortRequiredError{p.txnErr}
+	}
+
+	if p.txnStarted {
+		err := p.retry(func() error {
+			coordinator, err := p.txnCoordinator()
+			if err != nil {
+				return err
+			}
+			res, err := coordinator.EndTxn(&sarama.EndTxnRequest{
+				TransactionalID:   p.transactionalID,
+				ProducerID:        p.producerID,
+				ProducerEpoch:     p.producerEpoch,
+				TransactionResult: commit,
+			})
+			if err != nil {
+				return err
+			}
+			if res.Err != sarama.ErrNoError {
+				return res.Err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	p.inTxn = false
+	return nil
+}
+
+// txnCoordinator the coordinator of the transactional id, looked up again
+// after it failed
+func (p *transactionalProducer) txnCoordinator() (*sarama.Broker, error) {
+	if p.coordinator != nil {
+		return p.coordinator, nil
+	}
+	coordinator, err := p.findCoordinator(sarama.CoordinatorTransaction, p.transactionalID)
+	if err != nil {
+		return nil, err
+	}
+	p.coordinator = coordinator
+	return coordinator, nil
+}
+
+// findCoordinator sends FindCoordinator to the known brokers until one
+// answers, the returned broker is connected
+func (p *transactionalProducer) findCoordinator(coordinatorType sarama.CoordinatorType, key string) (*sarama.Broker, error) {
+	err := sarama.ErrOutOfBrokers
+	for _, broker := range p.client.Brokers() {
+		if err = openBroker(broker, p.config); err != nil {
+			continue
+		}
+		var res *sarama.FindCoordinatorResponse
+		res, err = broker.FindCoordinator(&sarama.FindCoordinatorRequest{
+			Version:         1,
+			CoordinatorKey:  key,
+			CoordinatorType: coordinatorType,
+		})
+		if err != nil {
+			continue
+		}
+		if res.Err != sarama.ErrNoError {
+			return nil, res.Err
+		}
+		if err := openBroker(res.Coordinator, p.config); err != nil {
+			return nil, err
+		}
+		return res.Coordinator, nil
+	}
+	return nil, err
+}
+
+func openBroker(broker *sarama.Broker, config *sarama.Config) error {
+	if err := broker.Open(config); err != nil && err != sarama.ErrAlreadyConnected {
+		return err
+	}
+	_, err := broker.Connected()
+	return err
+}
+
+// retry calls f until it succeeds or fails with an error not worth retrying,
+// the transaction coordinator is looked up again before every retry
+func (p *transactionalProducer) retry(f func() error) error {
+	var err error
+	for attempt := 0; attempt <= p.config.Producer.Retry.Max; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.config.Producer.Retry.Backoff)
+			if p.coordinator != nil {
+				p.coordinator.Close()
+				p.coordinator = nil
+			}
+		}
+		if err = f(); err == nil || !(coordinatorError(err) || retriable(err)) {
+			return err
+		}
+	}
+	return err
+}
+
+func firstPartitionError(topics map[string][]*sarama.PartitionError) error {
+	for _, partitions := range topics {
+		for _, partition := range partitions {
+			if partition.Err != sarama.ErrNoError {
+				return partition.Err
+			}
+		}
+	}
+	return nil
+}
+
+func coordinatorError(err error) bool {
+	switch err {
+	case sarama.ErrOffsetsLoadInProgress, sarama.ErrConsumerCoordinatorNotAvailable,
+		sarama.ErrNotCoordinatorForConsumer, sarama.ErrConcurrentTransactions:
+		return true
+	}
+	return false
+}
+
+// retriable errors other than Kafka ones are network errors
+func retriable(err error) bool {
+	kerr, ok := err.(sarama.KError)
+	if !ok {
+		return err != nil
+	}
+	switch kerr {
+	case sarama.ErrUnknownTopicOrPartition, sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition,
+		sarama.ErrRequestTimedOut, sarama.ErrNetworkException, sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend:
+		return true
+	}
+	return false
+}
+
+// nextSequence sequence numbers wrap around to 0 after MaxInt32
+func nextSequence(sequence int32, n int) int32 {
+	return int32((int64(sequence) + int64(n)) % (math.MaxInt32 + 1))
+}
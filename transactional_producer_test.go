@@ -0,0 +1,210 @@
+package avrostry
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func mockTxnHandlers(t *testing.T, broker *sarama.MockBroker) map[string]sarama.MockResponse {
+	return map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("words", 0, broker.BrokerID()).
+			SetLeader("counts", 0, broker.BrokerID()),
+		// Version 1 for both the transaction and the group coordinator
+		"FindCoordinatorRequest": sarama.NewMockWrapper(&sarama.FindCoordinatorResponse{
+			Version:     1,
+			Coordinator: sarama.NewBroker(broker.Addr()),
+		}),
+		"InitProducerIDRequest":     sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 7, ProducerEpoch: 1}),
+		"AddPartitionsToTxnRequest": sarama.NewMockWrapper(&sarama.AddPartitionsToTxnResponse{}),
+		"AddOffsetsToTxnRequest":    sarama.NewMockWrapper(&sarama.AddOffsetsToTxnResponse{}),
+		"TxnOffsetCommitRequest":    sarama.NewMockWrapper(&sarama.TxnOffsetCommitResponse{}),
+		"EndTxnRequest":             sarama.NewMockWrapper(&sarama.EndTxnResponse{}),
+		"ProduceRequest":            sarama.NewMockProduceResponse(t).SetVersion(3),
+	}
+}
+
+func newMockTxnBroker(t *testing.T) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(mockTxnHandlers(t, broker))
+	return broker
+}
+
+func newTestTxnProducer(t *testing.T, broker *sarama.MockBroker) (*KafkaRegistryProducer, func()) {
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	cfg.TransactionalID = "counter-1"
+	cfg.MaxRetries = 0
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+	return producer, closeRegistry
+}
+
+func TestTransactionalProducer(t *testing.T) {
+	broker := newMockTxnBroker(t)
+	defer broker.Close()
+	producer, closeRegistry := newTestTxnProducer(t, broker)
+	defer closeRegistry()
+
+	_, _, err := producer.Publish("words", Word{Word: "uno"})
+	require.Equal(t, ErrNoTxn, err)
+
+	require.Nil(t, producer.BeginTxn())
+	require.Equal(t, ErrTxnInProgress, producer.BeginTxn())
+	_, _, err = producer.Publish("words", Word{Word: "uno"})
+	require.Nil(t, err)
+	_, _, err = producer.Publish("counts", Word{Word: "dos"})
+	require.Nil(t, err)
+	_, _, err = producer.Publish("words", Word{Word: "tres"})
+	require.Nil(t, err)
+	require.Nil(t, producer.SendOffsetsToTxn("counter", map[string]map[int32]int64{"input": {0: 42}}))
+	require.Nil(t, producer.CommitTxn())
+	require.Equal(t, ErrNoTxn, producer.CommitTxn())
+
+	require.Equal(t, int32(2), producer.txn.sequences[topicPartition{"words", 0}])
+	require.Equal(t, int32(1), producer.txn.sequences[topicPartition{"counts", 0}])
+
+	var (
+		coordinators = map[sarama.CoordinatorType]string{}
+		added        []string
+		produced     int
+		end          *sarama.EndTxnRequest
+	)
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.FindCoordinatorRequest:
+			require.Equal(t, int16(1), req.Version)
+			coordinators[req.CoordinatorType] = req.CoordinatorKey
+		case *sarama.AddPartitionsToTxnRequest:
+			require.Equal(t, int64(7), req.ProducerID)
+			for topic := range req.TopicPartitions {
+				added = append(added, topic)
+			}
+		case *sarama.ProduceRequest:
+			require.Equal(t, "counter-1", *req.TransactionalID)
+			require.Equal(t, sarama.WaitForAll, req.RequiredAcks)
+			produced++
+		case *sarama.TxnOffsetCommitRequest:
+			require.Equal(t, "counter", req.GroupID)
+			require.Equal(t, int64(42), req.Topics["input"][0].Offset)
+		case *sarama.EndTxnRequest:
+			end = req
+		}
+	}
+	require.Equal(t, map[sarama.CoordinatorType]string{
+		sarama.CoordinatorTransaction: "counter-1",
+		sarama.CoordinatorGroup:       "counter",
+	}, coordinators)
+	require.Equal(t, []string{"words", "counts"}, added)
+	require.Equal(t, 3, produced)
+	require.NotNil(t, end)
+	require.True(t, end.TransactionResult)
+}
+
+func TestTransactionWithFailedEventMustAbort(t *testing.T) {
+	broker := newMockTxnBroker(t)
+	defer broker.Close()
+	producer, closeRegistry := newTestTxnProducer(t, broker)
+	defer closeRegistry()
+	require.Nil(t, producer.BeginTxn())
+
+	handlers := mockTxnHandlers(t, broker)
+	handlers["ProduceRequest"] = sarama.NewMockProduceResponse(t).SetVersion(3).
+		SetError("words", 0, sarama.ErrMessageSizeTooLarge)
+	broker.SetHandlerByMap(handlers)
+	_, _, err := producer.Publish("words", Word{Word: "uno"})
+	require.Equal(t, sarama.ErrMessageSizeTooLarge, err)
+	require.Equal(t, int32(0), producer.txn.sequences[topicPartition{"words", 0}])
+	_, _, err = producer.Publish("counts", Word{Word: "dos"})
+	require.Equal(t, &TxnAbortRequiredError{sarama.ErrMessageSizeTooLarge}, err)
+
+	require.Equal(t, &TxnAbortRequiredError{sarama.ErrMessageSizeTooLarge}, producer.CommitTxn())
+	require.Nil(t, producer.AbortTxn())
+	require.False(t, producer.txn.staleEpoch, "the batch was rejected, sequences are known")
+}
+
+func TestTransactionBumpsEpochAfterAmbiguousFailure(t *testing.T) {
+	broker := newMockTxnBroker(t)
+	defer broker.Close()
+	producer, closeRegistry := newTestTxnProducer(t, broker)
+	defer closeRegistry()
+
+	require.Nil(t, producer.BeginTxn())
+	_, _, err := producer.Publish("words", Word{Word: "uno"})
+	require.Nil(t, err)
+
+	// the broker may have written the batch without answering in time
+	handlers := mockTxnHandlers(t, broker)
+	handlers["ProduceRequest"] = sarama.NewMockProduceResponse(t).SetVersion(3).
+		SetError("words", 0, sarama.ErrRequestTimedOut)
+	handlers["InitProducerIDRequest"] = sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 7, ProducerEpoch: 2})
+	broker.SetHandlerByMap(handlers)
+	_, _, err = producer.Publish("words", Word{Word: "dos"})
+	require.Equal(t, sarama.ErrRequestTimedOut, err)
+	require.Nil(t, producer.AbortTxn())
+	require.True(t, producer.txn.staleEpoch)
+
+	require.Nil(t, producer.BeginTxn())
+	require.Equal(t, int16(2), producer.txn.producerEpoch)
+	require.Empty(t, producer.txn.sequences, "sequences restart with the new epoch")
+
+	inits := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.InitProducerIDRequest); ok {
+			inits++
+		}
+	}
+	require.Equal(t, 2, inits)
+}
+
+func TestTransactionRejectsDuplicateOfUnsentBatch(t *testing.T) {
+	broker := newMockTxnBroker(t)
+	defer broker.Close()
+	producer, closeRegistry := newTestTxnProducer(t, broker)
+	defer closeRegistry()
+	require.Nil(t, producer.BeginTxn())
+
+	handlers := mockTxnHandlers(t, broker)
+	handlers["ProduceRequest"] = sarama.NewMockProduceResponse(t).SetVersion(3).
+		SetError("words", 0, sarama.ErrDuplicateSequenceNumber)
+	broker.SetHandlerByMap(handlers)
+	_, _, err := producer.Publish("words", Word{Word: "uno"})
+	require.Equal(t, sarama.ErrDuplicateSequenceNumber, err, "first attempt, the duplicate is another batch")
+	require.Equal(t, int32(0), producer.txn.sequences[topicPartition{"words", 0}])
+}
+
+func TestIdempotentProducerWithoutTransactions(t *testing.T) {
+	broker := newMockTxnBroker(t)
+	defer broker.Close()
+	cfg, closeRegistry := newTestProducerConfig(t, broker)
+	defer closeRegistry()
+	cfg.Idempotent = true
+
+	producer, err := NewKafkaRegistryProducer(cfg)
+	require.Nil(t, err)
+	require.Equal(t, ErrNotTransactional, producer.BeginTxn())
+
+	partition, _, err := producer.Publish("words", Word{Word: "uno"})
+	require.Nil(t, err)
+	require.Equal(t, int32(0), partition)
+
+	inits := 0
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.InitProducerIDRequest:
+			require.Nil(t, req.TransactionalID)
+			inits++
+		case *sarama.ProduceRequest:
+			require.Nil(t, req.TransactionalID)
+			require.Equal(t, sarama.WaitForAll, req.RequiredAcks)
+		}
+	}
+	require.Equal(t, 1, inits)
+}
+
+func TestNextSequence(t *testing.T) {
+	require.Equal(t, int32(3), nextSequence(1, 2))
+	require.Equal(t, int32(0), nextSequence(2147483647, 1))
+}